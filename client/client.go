@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -19,7 +18,9 @@ import (
 	"time"
 
 	"github.com/buger/jsonparser"
+	"github.com/gorilla/websocket"
 	"github.com/isrc-cas/gt/config"
+	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/logger"
 	"github.com/isrc-cas/gt/predef"
 	"github.com/isrc-cas/gt/util"
@@ -65,7 +66,9 @@ func New(args []string) (c *Client, err error) {
 
 type dialer struct {
 	host      string
+	url       string
 	stun      string
+	proxy     *url.URL
 	tlsConfig *tls.Config
 	dialFn    func() (conn net.Conn, err error)
 }
@@ -84,31 +87,55 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 		if len(u.Port()) < 1 {
 			u.Host = net.JoinHostPort(u.Host, "443")
 		}
-		tlsConfig := &tls.Config{
-			PreferServerCipherSuites: true,
+		d.tlsConfig, err = c.newTLSConfig(u)
+		if err != nil {
+			return
 		}
-		if len(c.config.RemoteCert) > 0 {
-			var cf []byte
-			cf, err = ioutil.ReadFile(c.config.RemoteCert)
+		d.host = u.Host
+		d.dialFn = d.tlsDial
+	case "ws", "wss":
+		if u.Scheme == "wss" {
+			if len(u.Port()) < 1 {
+				u.Host = net.JoinHostPort(u.Host, "443")
+			}
+			d.tlsConfig, err = c.newTLSConfig(u)
 			if err != nil {
-				err = fmt.Errorf("failed to read remote cert file (-remoteCert option) '%s', cause %s", c.config.RemoteCert, err.Error())
 				return
 			}
-			roots := x509.NewCertPool()
-			ok := roots.AppendCertsFromPEM(cf)
-			if !ok {
-				err = fmt.Errorf("failed to parse remote cert file (-remoteCert option) '%s'", c.config.RemoteCert)
+		} else {
+			if c.clientCert != nil {
+				err = fmt.Errorf("remote url (-remote option) '%s' must begin with tls://, wss:// or quic:// to use the client cert", remote)
 				return
 			}
-			tlsConfig.RootCAs = roots
+			if len(u.Port()) < 1 {
+				u.Host = net.JoinHostPort(u.Host, "80")
+			}
+		}
+		d.host = u.Host
+		d.url = u.String()
+		d.dialFn = d.webSocketDial
+	case "quic":
+		// QUIC 基于 UDP，不能通过代理连接
+		if c.remoteProxy != nil {
+			err = fmt.Errorf("remote url (-remote option) '%s' can not be used with the proxy (-remoteProxy option)", remote)
+			return
 		}
-		if c.config.RemoteCertInsecure {
-			tlsConfig.InsecureSkipVerify = true
+		if len(u.Port()) < 1 {
+			u.Host = net.JoinHostPort(u.Host, "443")
+		}
+		d.tlsConfig, err = c.newTLSConfig(u)
+		if err != nil {
+			return
 		}
+		d.tlsConfig.NextProtos = []string{predef.QUICProto}
 		d.host = u.Host
-		d.tlsConfig = tlsConfig
-		d.dialFn = d.tlsDial
+		d.dialFn = d.quicDial
+		return
 	case "tcp":
+		if c.clientCert != nil {
+			err = fmt.Errorf("remote url (-remote option) '%s' must begin with tls://, wss:// or quic:// to use the client cert", remote)
+			return
+		}
 		if len(u.Port()) < 1 {
 			u.Host = net.JoinHostPort(u.Host, "80")
 		}
@@ -116,14 +143,23 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 		d.dialFn = d.dial
 	default:
 		err = fmt.Errorf("remote url (-remote option) '%s' is invalid", remote)
+		return
+	}
+	// 只有 ws:// 使用 HTTP_PROXY，其它的连接与 https 一样使用 HTTPS_PROXY
+	scheme := "https"
+	if u.Scheme == "ws" {
+		scheme = "http"
+	}
+	d.proxy, err = c.proxyURL(&url.URL{Scheme: scheme, Host: d.host})
+	if err != nil {
+		return
+	}
+	if d.proxy != nil {
+		c.Logger.Info().Str("proxy", d.proxy.Redacted()).Msg("connect to remote through proxy")
 	}
 	return
 }
 
-func (d *dialer) initWithRemote(c *Client) (err error) {
-	return d.init(c, c.config.Remote, c.config.RemoteSTUN)
-}
-
 func (d *dialer) initWithRemoteAPI(c *Client) (err error) {
 	req, err := http.NewRequest("GET", c.config.RemoteAPI, nil)
 	if err != nil {
@@ -134,8 +170,14 @@ func (d *dialer) initWithRemoteAPI(c *Client) (err error) {
 	req.URL.RawQuery = query.Encode()
 	req.Header.Set("Request-Id", strconv.FormatInt(time.Now().Unix(), 10))
 	client := http.Client{
+		Transport: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				return c.proxyURL(req.URL)
+			},
+		},
 		Timeout: c.config.RemoteTimeout,
 	}
+	defer client.CloseIdleConnections()
 	resp, err := client.Do(req)
 	if err != nil {
 		return
@@ -164,17 +206,54 @@ func (d *dialer) initWithRemoteAPI(c *Client) (err error) {
 }
 
 func (d *dialer) dial() (conn net.Conn, err error) {
-	return net.Dial("tcp", d.host)
+	return proxyDial(d.proxy, d.host)
 }
 
 func (d *dialer) tlsDial() (conn net.Conn, err error) {
-	return tls.Dial("tcp", d.host, d.tlsConfig)
+	raw, err := proxyDial(d.proxy, d.host)
+	if err != nil {
+		return
+	}
+	tlsConfig := d.tlsConfig
+	if len(tlsConfig.ServerName) == 0 {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(d.host)
+	}
+	tlsConn := tls.Client(raw, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		raw.Close()
+		return
+	}
+	conn = tlsConn
+	return
+}
+
+func (d *dialer) webSocketDial() (conn net.Conn, err error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = d.tlsConfig
+	dialer.Proxy = nil
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		return proxyDial(d.proxy, addr)
+	}
+	ws, _, err := dialer.Dial(d.url, nil)
+	if err != nil {
+		return
+	}
+	conn = connection.NewWebSocketConn(ws)
+	return
 }
 
 // Start runs the client agent.
 func (c *Client) Start() (err error) {
 	c.Logger.Info().Interface("config", c.config).Msg(predef.Version)
 
+	if len(c.config.RemoteClientCert) > 0 || len(c.config.RemoteClientKey) > 0 {
+		err = c.loadClientCert()
+		if err != nil {
+			return
+		}
+	}
 	if len(c.config.ID) < predef.MinIDSize || len(c.config.ID) > predef.MaxIDSize {
 		err = fmt.Errorf("agent id (-id option) '%s' is invalid", c.config.ID)
 		return
@@ -186,15 +265,31 @@ func (c *Client) Start() (err error) {
 		return
 	}
 
-	var dialer dialer
-	if len(c.config.Remote) > 0 {
-		if !strings.Contains(c.config.Remote, "://") {
-			c.config.Remote = "tcp://" + c.config.Remote
+	if len(c.config.RemoteProxy) > 0 {
+		c.remoteProxy, err = parseProxy(c.config.RemoteProxy)
+		if err != nil {
+			return
 		}
-		err = dialer.initWithRemote(c)
+	} else {
+		c.proxyFunc = proxyFromEnvironment()
+	}
+
+	if c.config.ReconnectMaxDelay < c.config.ReconnectDelay {
+		c.config.ReconnectMaxDelay = c.config.ReconnectDelay
+	}
+
+	c.remotes = nil
+	for i, r := range c.config.Remote {
+		if !strings.Contains(r, "://") {
+			r = "tcp://" + r
+			c.config.Remote[i] = r
+		}
+		var d dialer
+		err = d.init(c, r, c.config.RemoteSTUN)
 		if err != nil {
 			return
 		}
+		c.remotes = append(c.remotes, &remote{dialer: d})
 	}
 	if len(c.config.RemoteAPI) > 0 {
 		if !strings.HasPrefix(c.config.RemoteAPI, "http://") &&
@@ -202,27 +297,23 @@ func (c *Client) Start() (err error) {
 			err = fmt.Errorf("remote api url (-remoteAPI option) '%s' must begin with http:// or https://", c.config.RemoteAPI)
 			return
 		}
-		for len(dialer.host) == 0 {
-			if atomic.LoadUint32(&c.closing) == 1 {
-				err = errors.New("client is closing")
+		if len(c.remotes) > 0 {
+			// remoteAPI 返回的服务端优先级最低，在 -remote 指定的服务端都连接失败时才查询
+			c.remotes = append(c.remotes, &remote{api: true, stale: true})
+		} else {
+			err = c.initRemoteAPI()
+			if err != nil {
 				return
 			}
-			err = dialer.initWithRemoteAPI(c)
-			if err == nil {
-				break
-			}
-			c.Logger.Error().Err(err).Msg("failed to query server address")
-			time.Sleep(c.config.ReconnectDelay)
 		}
 	}
-	if len(dialer.host) == 0 {
+	if len(c.remotes) == 0 {
 		err = errors.New("option -remote or -remoteAPI must be specified")
 		return
 	}
 
-	if !strings.HasPrefix(c.config.Local, "http://") &&
-		!strings.HasPrefix(c.config.Local, "https://") {
-		err = fmt.Errorf("local url (-local option) '%s' must begin with http:// or https://", c.config.Local)
+	err = c.initServices()
+	if err != nil {
 		return
 	}
 
@@ -233,8 +324,59 @@ func (c *Client) Start() (err error) {
 	}
 
 	for i := uint(0); i < c.config.RemoteConnections; i++ {
-		go c.connectLoop(dialer)
+		go c.connectLoop()
+	}
+	if c.config.RemoteMaxConnections > c.config.RemoteConnections {
+		go c.scaleLoop()
+	}
+	for _, s := range c.services {
+		if s.LocalHealthCheckInterval > 0 {
+			go c.healthCheckLoop(s)
+		}
+	}
+	return
+}
+
+// initRemoteAPI 在没有指定 -remote 时查询 remoteAPI 直到成功，返回的服务端是唯一的服务端
+func (c *Client) initRemoteAPI() (err error) {
+	var d dialer
+	for failures := uint(1); ; failures++ {
+		if atomic.LoadUint32(&c.closing) == 1 {
+			return errors.New("client is closing")
+		}
+		err = d.initWithRemoteAPI(c)
+		if err == nil {
+			break
+		}
+		delay := backoff(c.config.ReconnectDelay, c.config.ReconnectMaxDelay, failures)
+		c.Logger.Error().Err(err).Dur("delay", delay).Msg("failed to query server address")
+		time.Sleep(delay)
 	}
+	c.remotes = remotes{&remote{dialer: d, api: true}}
+	return
+}
+
+// loadClientCert 加载 tls 连接服务端时使用的客户端证书，未指定 id 时使用证书的 CN 作为 id
+func (c *Client) loadClientCert() (err error) {
+	if len(c.config.RemoteClientCert) == 0 || len(c.config.RemoteClientKey) == 0 {
+		err = errors.New("option -remoteClientCert and -remoteClientKey must be specified together")
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(c.config.RemoteClientCert, c.config.RemoteClientKey)
+	if err != nil {
+		err = fmt.Errorf("failed to load client cert (-remoteClientCert option) '%s', cause %s", c.config.RemoteClientCert, err.Error())
+		return
+	}
+	if len(c.config.ID) == 0 {
+		var leaf *x509.Certificate
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			err = fmt.Errorf("failed to parse client cert (-remoteClientCert option) '%s', cause %s", c.config.RemoteClientCert, err.Error())
+			return
+		}
+		c.config.ID = leaf.Subject.CommonName
+	}
+	c.clientCert = &cert
 	return
 }
 
@@ -252,7 +394,7 @@ func (c *Client) Close() {
 	c.tunnelsRWMtx.Unlock()
 }
 
-func (c *Client) initConn(d dialer) (result *conn, err error) {
+func (c *Client) initConn(d dialer, version byte) (result *conn, err error) {
 	c.initConnMtx.Lock()
 	defer c.initConnMtx.Unlock()
 
@@ -261,17 +403,21 @@ func (c *Client) initConn(d dialer) (result *conn, err error) {
 		return
 	}
 	result = newConn(conn, c)
+	result.version = version
 	result.stuns = append(result.stuns, d.stun)
 	err = result.init()
 	if err != nil {
 		result.Close()
+		return
+	}
+	if qc, ok := conn.(*connection.QUICConn); ok {
+		go result.acceptStreams(qc.Connection)
 	}
 	return
 }
 
-func (c *Client) connect(d dialer) (closing bool) {
-	c.Logger.Info().Msg("trying to connect to remote")
-
+// connect 连接服务端 r 并处理 tunnel，连接失败时 r 进入退避时间，连接断开时等待随机的 ReconnectDelay
+func (c *Client) connect(r *remote) (closing bool) {
 	defer func() {
 		if !predef.Debug {
 			if e := recover(); e != nil {
@@ -280,35 +426,57 @@ func (c *Client) connect(d dialer) (closing bool) {
 		}
 	}()
 
-	conn, err := c.initConn(d)
-	if err == nil {
-		conn.readLoop()
-	} else {
-		c.Logger.Error().Err(err).Msg("failed to connect to remote")
+	d, stale := r.getDialer()
+	if stale {
+		err := d.initWithRemoteAPI(c)
+		if err != nil {
+			delay := r.fail(c.config.ReconnectDelay, c.config.ReconnectMaxDelay)
+			c.Logger.Error().Err(err).Dur("delay", delay).Msg("failed to query server address")
+			return
+		}
+		r.setDialer(d)
+	}
+
+	c.Logger.Info().Str("remote", d.host).Msg("trying to connect to remote")
+	conn, err := c.initConn(d, r.version())
+	if err != nil {
+		delay := r.fail(c.config.ReconnectDelay, c.config.ReconnectMaxDelay)
+		c.Logger.Error().Err(err).Str("remote", d.host).Dur("delay", delay).Msg("failed to connect to remote")
+		return atomic.LoadUint32(&c.closing) == 1
+	}
+	conn.remote = r
+	conn.readLoop()
+	if conn.version == predef.Version2 && atomic.LoadUint32(&c.closing) == 0 {
+		// 只支持 predef.Version1 的服务端不认识 predef.Version2 的握手，不回复任何数据就断开连接
+		if atomic.LoadUint32(&conn.rejected) == 0 {
+			r.acceptVersion2()
+		} else if r.rejectVersion2() {
+			c.Logger.Error().Str("remote", d.host).Dur("retryAfter", version1Duration).
+				Msg("remote rejected protocol version 2 repeatedly, falling back to protocol version 1 without flow control")
+		}
 	}
 
 	if atomic.LoadUint32(&c.closing) == 1 {
 		return true
 	}
-	time.Sleep(c.config.ReconnectDelay)
-
-	for len(c.config.RemoteAPI) > 0 {
-		if atomic.LoadUint32(&c.closing) == 1 {
-			return true
-		}
-		err = d.initWithRemoteAPI(c)
-		if err == nil {
-			break
-		}
-		c.Logger.Error().Err(err).Msg("failed to query server address")
-		time.Sleep(c.config.ReconnectDelay)
+	if atomic.LoadUint32(&conn.ready) == 0 {
+		// 服务端拒绝了 tunnel 或者在就绪之前断开，例如 secret 错误、tunnel 过多或者负载均衡器后面的服务端不可用
+		delay := r.fail(c.config.ReconnectDelay, c.config.ReconnectMaxDelay)
+		c.Logger.Error().Str("remote", d.host).Dur("delay", delay).Msg("remote closed the tunnel before it was ready")
+		return
 	}
+	time.Sleep(jitter(c.config.ReconnectDelay))
 	return
 }
 
-func (c *Client) connectLoop(d dialer) {
+func (c *Client) connectLoop() {
 	for atomic.LoadUint32(&c.closing) == 0 {
-		if c.connect(d) {
+		r, wait := c.remotes.next()
+		if wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+		if c.connect(r) {
 			break
 		}
 	}
@@ -328,6 +496,24 @@ func (c *Client) removeTunnel(conn *conn) {
 	c.tunnelsRWMtx.Unlock()
 }
 
+// GetTCPPort returns the tcp port opened by the remote server for the first tcp:// local service
+func (c *Client) GetTCPPort() uint16 {
+	return c.getRemotePort(predef.ServiceTCP)
+}
+
+// GetUDPPort returns the udp port opened by the remote server for the first udp:// local service
+func (c *Client) GetUDPPort() uint16 {
+	return c.getRemotePort(predef.ServiceUDP)
+}
+
+// GetServicePort returns the port opened by the remote server for the tcp:// or udp:// service at index
+func (c *Client) GetServicePort(index int) uint16 {
+	if index < 0 || index >= len(c.services) {
+		return 0
+	}
+	return c.services[index].getRemotePort()
+}
+
 var errTimeout = errors.New("timeout")
 
 // WaitUntilReady waits until the client connected to server
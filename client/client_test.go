@@ -1,6 +1,7 @@
 package client
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -23,3 +24,20 @@ func TestClientWaitUntilReady(t *testing.T) {
 		t.Fatal("err == timeout")
 	}
 }
+
+func TestInitServicesLocalError(t *testing.T) {
+	for local, cause := range map[string]string{
+		"ftp://127.0.0.1":    "must begin with http://, https://, tcp:// or udp://",
+		"http://127.0.0.1:%": "is invalid, cause",
+	} {
+		c, err := New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.config.Local = local
+		err = c.initServices()
+		if err == nil || !strings.Contains(err.Error(), "-local") || !strings.Contains(err.Error(), cause) {
+			t.Fatalf("local '%s': error %v does not contain the cause '%s'", local, err, cause)
+		}
+	}
+}
@@ -2,15 +2,17 @@ package client
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/pion/webrtc/v3"
 	"io"
 	"net"
-	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -28,6 +30,27 @@ type conn struct {
 	peerTasks      map[uint32]*peerTask
 	peerTasksRWMtx sync.RWMutex
 	stuns          []string
+	// extra 表示 tunnel 是负载高时额外增加的，空闲时会被关闭
+	extra bool
+	// writeNanos 与 writes 统计写入 tunnel 的耗时与次数，用于判断 tunnel 是否拥塞
+	writeNanos uint64
+	writes     uint64
+	// healthReports 为 1 表示服务端接受服务的健康状态
+	healthReports uint32
+	// visitorAddrs 为 1 表示服务端在每个 task 中携带访问者的地址
+	visitorAddrs uint32
+	// visitors 是还没有开始的 task 的访问者地址，只在 readLoop 中使用
+	visitors map[uint32]*connection.Visitor
+	// version 是握手时使用的协议版本，predef.Version2 的 task 使用流量控制
+	version byte
+	// replied 为 1 表示收到过服务端的数据
+	replied uint32
+	// rejected 为 1 表示服务端没有回复任何数据就断开了 tunnel，例如不支持握手的协议版本
+	rejected uint32
+	// ready 为 1 表示服务端接受了 tunnel
+	ready uint32
+	// remote 是 tunnel 连接的服务端，tunnel 就绪时重置 remote 的失败次数，额外的 tunnel 为 nil
+	remote *remote
 }
 
 func newConn(c net.Conn, client *Client) *conn {
@@ -40,6 +63,7 @@ func newConn(c net.Conn, client *Client) *conn {
 		client:    client,
 		tasks:     make(map[uint32]*httpTask, 100),
 		peerTasks: make(map[uint32]*peerTask),
+		visitors:  make(map[uint32]*connection.Visitor),
 	}
 	nc.Logger = client.Logger.With().
 		Str("clientConn", strconv.FormatUint(uint64(uintptr(unsafe.Pointer(nc))), 16)).
@@ -48,37 +72,70 @@ func newConn(c net.Conn, client *Client) *conn {
 }
 
 func (c *conn) init() (err error) {
-	buf := c.Connection.Reader.GetBuf()
-	bufIndex := 0
+	buf := c.Connection.Reader.GetBuf()[:0]
+	option := predef.OptionMaxTunnels
+	if c.client.withHealthChecks() {
+		option |= predef.OptionServiceHealth
+	}
+	if c.client.withHTTP2Services() {
+		option |= predef.OptionHTTP2Services
+	}
+	if c.client.withVisitorAddrs() {
+		option |= predef.OptionVisitorAddr
+	}
 
-	buf[bufIndex] = predef.VersionFirst
-	bufIndex++
-	buf[bufIndex] = 0x01
-	bufIndex++
+	buf = append(buf, predef.VersionFirst, c.version)
 
 	id := c.client.config.ID
-	buf[bufIndex] = byte(len(id))
-	bufIndex++
-	idLen := copy(buf[bufIndex:], id)
-	bufIndex += idLen
+	buf = append(buf, byte(len(id)))
+	buf = append(buf, id...)
 
 	secret := c.client.config.Secret
-	buf[bufIndex] = byte(len(secret))
-	bufIndex++
-	secretLen := copy(buf[bufIndex:], secret)
-	bufIndex += secretLen
+	buf = append(buf, byte(len(secret)))
+	buf = append(buf, secret...)
 
 	// option
-	buf[bufIndex] = 0x00
-	bufIndex++
+	if c.client.withServices {
+		buf = append(buf, predef.OptionServices|option, byte(len(c.client.services)))
+		for _, s := range c.client.services {
+			buf = append(buf, s.typ)
+			port := s.remotePortOption()
+			buf = append(buf, byte(port>>8), byte(port))
+			for _, value := range []string{s.Subdomain, s.PathPrefix, s.HeaderName, s.HeaderValue} {
+				buf = append(buf, byte(len(value)))
+				buf = append(buf, value...)
+			}
+		}
+	} else {
+		s := c.client.services[0]
+		switch s.typ {
+		case predef.ServiceTCP:
+			buf = append(buf, predef.OptionOpenTCPPort|option)
+			buf = append(buf, byte(s.RemoteTCPPort>>8), byte(s.RemoteTCPPort))
+		case predef.ServiceUDP:
+			buf = append(buf, predef.OptionOpenUDPPort|option)
+			buf = append(buf, byte(s.RemoteUDPPort>>8), byte(s.RemoteUDPPort))
+		default:
+			buf = append(buf, option)
+		}
+	}
+
+	_, err = c.Conn.Write(buf)
 
-	_, err = c.Conn.Write(buf[:bufIndex])
+	return
+}
 
+// Write 写入 tunnel 并统计写入的耗时，包括等待其它 task 写入的时间
+func (c *conn) Write(b []byte) (n int, err error) {
+	start := time.Now()
+	n, err = c.Connection.Write(b)
+	atomic.AddUint64(&c.writeNanos, uint64(time.Since(start)))
+	atomic.AddUint64(&c.writes, 1)
 	return
 }
 
 func (c *conn) IsTimeout(e error) (result bool) {
-	if ne, ok := e.(*net.OpError); ok && ne.Timeout() {
+	if ne, ok := e.(net.Error); ok && ne.Timeout() {
 		err := c.Connection.SendPingSignal()
 		if err == nil {
 			result = true
@@ -107,6 +164,10 @@ func (c *conn) readLoop() {
 	var pings int
 	defer func() {
 		c.client.removeTunnel(c)
+		if atomic.LoadUint32(&c.replied) == 0 && c.Reader.Buffered() == 0 &&
+			(errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)) {
+			atomic.StoreUint32(&c.rejected, 1)
+		}
 		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
 			err = nil
 		}
@@ -137,6 +198,7 @@ func (c *conn) readLoop() {
 			}
 			return
 		}
+		atomic.StoreUint32(&c.replied, 1)
 		id := uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
 		_, err = c.Reader.Discard(4)
 		if err != nil {
@@ -150,7 +212,14 @@ func (c *conn) readLoop() {
 			c.Logger.Debug().Msg("read close signal")
 			return
 		case connection.ReadySignal:
-			c.client.addTunnel(c)
+			atomic.StoreUint32(&c.ready, 1)
+			if c.remote != nil {
+				c.remote.succeed()
+			}
+			err = c.client.addReadyTunnel(c)
+			if err != nil {
+				return
+			}
 			c.Logger.Info().Msg("tunnel started")
 			continue
 		case connection.ErrorSignal:
@@ -161,6 +230,12 @@ func (c *conn) readLoop() {
 			errCode := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
 			c.Logger.Info().Err(connection.Error(errCode)).Msg("read error signal")
 			return
+		case connection.InfoSignal:
+			err = c.readInfo()
+			if err != nil {
+				return
+			}
+			continue
 		}
 		peekBytes, err = c.Reader.Peek(2)
 		if err != nil {
@@ -171,7 +246,22 @@ func (c *conn) readLoop() {
 		if err != nil {
 			return
 		}
+		var service *service
 		switch op {
+		case predef.ServicesData:
+			peekBytes, err = c.Reader.Peek(2)
+			if err != nil {
+				return
+			}
+			service, err = c.client.getService(binary.BigEndian.Uint16(peekBytes))
+			if err != nil {
+				return
+			}
+			_, err = c.Reader.Discard(2)
+			if err != nil {
+				return
+			}
+			fallthrough
 		case predef.Data:
 			peekBytes, err = c.Reader.Peek(4)
 			if err != nil {
@@ -183,7 +273,7 @@ func (c *conn) readLoop() {
 				return
 			}
 			r.N = int64(l)
-			rErr, wErr := c.processData(id, r)
+			rErr, wErr := c.processData(id, r, service)
 			if rErr != nil {
 				err = wErr
 				if !errors.Is(err, net.ErrClosed) {
@@ -209,23 +299,126 @@ func (c *conn) readLoop() {
 				}
 				continue
 			}
+		case predef.WindowUpdate:
+			peekBytes, err = c.Reader.Peek(4)
+			if err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(peekBytes)
+			_, err = c.Reader.Discard(4)
+			if err != nil {
+				return
+			}
+			c.tasksRWMtx.RLock()
+			t, ok := c.tasks[id]
+			c.tasksRWMtx.RUnlock()
+			if ok && t.sendWindow != nil {
+				t.sendWindow.Update(n)
+			}
+		case predef.VisitorAddr:
+			var v *connection.Visitor
+			v, err = connection.ReadVisitor(c.Reader)
+			if err != nil {
+				return
+			}
+			c.visitors[id] = v
 		case predef.Close:
+			delete(c.visitors, id)
 			c.tasksRWMtx.RLock()
 			t, ok := c.tasks[id]
 			c.tasksRWMtx.RUnlock()
 			if ok {
-				t.Close()
+				if t.recvBuffer != nil {
+					// 缓存的数据写完后再关闭 task
+					t.recvBuffer.Close()
+				} else {
+					t.Close()
+				}
 			}
 		}
 
 	}
 }
 
-func (c *conn) dial() (task *httpTask, err error) {
-	u, err := url.Parse(c.client.config.Local)
+func (c *conn) readInfo() (err error) {
+	peekBytes, err := c.Reader.Peek(2)
+	if err != nil {
+		return
+	}
+	info := connection.Info(binary.BigEndian.Uint16(peekBytes))
+	_, err = c.Reader.Discard(2)
 	if err != nil {
 		return
 	}
+	switch info {
+	case connection.InfoTCPPortOpened, connection.InfoUDPPortOpened:
+		peekBytes, err = c.Reader.Peek(2)
+		if err != nil {
+			return
+		}
+		port := binary.BigEndian.Uint16(peekBytes)
+		_, err = c.Reader.Discard(2)
+		if err != nil {
+			return
+		}
+		c.client.services[0].setRemotePort(port)
+		if info == connection.InfoTCPPortOpened {
+			c.Logger.Info().Uint16("port", port).Msg("tcp port opened by remote")
+		} else {
+			c.Logger.Info().Uint16("port", port).Msg("udp port opened by remote")
+		}
+	case connection.InfoServicePortOpened:
+		peekBytes, err = c.Reader.Peek(4)
+		if err != nil {
+			return
+		}
+		var s *service
+		s, err = c.client.getService(binary.BigEndian.Uint16(peekBytes))
+		if err != nil {
+			return
+		}
+		port := binary.BigEndian.Uint16(peekBytes[2:])
+		_, err = c.Reader.Discard(4)
+		if err != nil {
+			return
+		}
+		s.setRemotePort(port)
+		c.Logger.Info().Uint16("service", s.index).Uint16("port", port).Msg("service port opened by remote")
+	case connection.InfoMaxTunnels:
+		peekBytes, err = c.Reader.Peek(4)
+		if err != nil {
+			return
+		}
+		max := binary.BigEndian.Uint32(peekBytes)
+		_, err = c.Reader.Discard(4)
+		if err != nil {
+			return
+		}
+		atomic.StoreUint32(&c.client.maxTunnels, max)
+		c.Logger.Debug().Uint32("max", max).Msg("max tunnels allowed by remote")
+	case connection.InfoServiceHealthAccepted:
+		atomic.StoreUint32(&c.healthReports, 1)
+	case connection.InfoHTTP2ServicesAccepted:
+		for _, s := range c.client.services {
+			if !s.LocalHTTP2 {
+				continue
+			}
+			err = c.SendInfoServiceHTTP2(s.index)
+			if err != nil {
+				return
+			}
+		}
+	case connection.InfoVisitorAddrAccepted:
+		atomic.StoreUint32(&c.visitorAddrs, 1)
+	default:
+		err = fmt.Errorf("unknown info signal %d", info)
+	}
+	return
+}
+
+// dial 连接本地服务，v 是访问者的地址，服务端没有携带时为 nil
+func (c *conn) dial(s *service, v *connection.Visitor) (task *httpTask, err error) {
+	u := s.localURL
 	addr := u.Host
 	switch u.Scheme {
 	case "https":
@@ -236,47 +429,89 @@ func (c *conn) dial() (task *httpTask, err error) {
 		if strings.Index(addr, ":") < 0 {
 			addr = addr + ":80"
 		}
+	case "udp":
+		var conn net.Conn
+		conn, err = net.Dial("udp", addr)
+		if err != nil {
+			return
+		}
+		task = newHTTPTask(newUDPConn(conn), c.flowControl())
+		task.service = s
+		return
 	}
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return
 	}
-	task = newHTTPTask(conn)
-	if c.client.config.UseLocalAsHTTPHost {
-		err = task.setHost(u.Host)
+	if len(s.LocalProxyProtocol) > 0 {
+		_, err = conn.Write(appendProxyHeader(nil, s.LocalProxyProtocol, v))
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	task = newHTTPTask(conn, c.flowControl())
+	task.service = s
+	var forwarded *forwardedHeaders
+	if s.forwarded != 0 && v != nil {
+		forwarded = newForwardedHeaders(s.forwarded, v)
+	}
+	if s.rules != nil || forwarded != nil {
+		task.setHTTPRules(s.rules, forwarded)
 	}
 	return
 }
 
-func (c *conn) processData(id uint32, r *bufio.LimitedReader) (readErr, writeErr error) {
-	peekBytes, readErr := r.Peek(2)
-	if readErr != nil {
-		return
+// flowControl 判断 tunnel 上的 task 是否使用流量控制，QUIC tunnel 由 stream 自身控制流量
+func (c *conn) flowControl() bool {
+	_, ok := c.Conn.(*connection.QUICConn)
+	return c.version == predef.Version2 && !ok
+}
+
+// processData 将数据写入 task，service 为 nil 时使用 task 的服务，新的 task 使用第一个服务
+func (c *conn) processData(id uint32, r *bufio.LimitedReader, service *service) (readErr, writeErr error) {
+	c.tasksRWMtx.RLock()
+	t, ok := c.tasks[id]
+	c.tasksRWMtx.RUnlock()
+	if service == nil {
+		if ok {
+			service = t.service
+		} else {
+			service = c.client.services[0]
+		}
 	}
-	// first 2 bytes of p2p sdp request is "X1"(0x5831)
-	isP2P := (uint16(peekBytes[1]) | uint16(peekBytes[0])<<8) == 0x5831
-	c.peerTasksRWMtx.RLock()
-	p2pTask, ok := c.peerTasks[id]
-	c.peerTasksRWMtx.RUnlock()
-	if isP2P || ok {
-		if len(c.stuns) < 1 {
-			respAndClose(id, c, [][]byte{
-				[]byte("HTTP/1.1 403 Forbidden\r\nConnection: Closed\r\n\r\n"),
-			})
+
+	// p2p is only available for http services, tcp and udp data is forwarded as it is
+	if service.typ == predef.ServiceHTTP {
+		var peekBytes []byte
+		peekBytes, readErr = r.Peek(2)
+		if readErr != nil {
+			return
+		}
+		// first 2 bytes of p2p sdp request is "X1"(0x5831)
+		isP2P := (uint16(peekBytes[1]) | uint16(peekBytes[0])<<8) == 0x5831
+		c.peerTasksRWMtx.RLock()
+		p2pTask, ok := c.peerTasks[id]
+		c.peerTasksRWMtx.RUnlock()
+		if isP2P || ok {
+			if len(c.stuns) < 1 {
+				respAndClose(id, c, [][]byte{
+					[]byte("HTTP/1.1 403 Forbidden\r\nConnection: Closed\r\n\r\n"),
+				})
+				return
+			}
+			c.processP2P(id, r, p2pTask, ok)
 			return
 		}
-		c.processP2P(id, r, p2pTask, ok)
-		return
 	}
 
-	c.tasksRWMtx.RLock()
-	t, ok := c.tasks[id]
-	c.tasksRWMtx.RUnlock()
 	if !ok {
 		c.tasksRWMtx.Lock()
 		t, ok = c.tasks[id]
 		if !ok {
-			t, writeErr = c.dial()
+			v := c.visitors[id]
+			delete(c.visitors, id)
+			t, writeErr = c.dial(service, v)
 			if writeErr != nil {
 				c.tasksRWMtx.Unlock()
 				return
@@ -285,28 +520,39 @@ func (c *conn) processData(id uint32, r *bufio.LimitedReader) (readErr, writeErr
 			c.tasksRWMtx.Unlock()
 			t.Logger = c.Logger.With().
 				Uint32("task", id).
+				Uint16("service", service.index).
 				Logger()
 			t.Logger.Info().Msg("task started")
 			go t.process(id, c)
+			if t.recvBuffer != nil {
+				go t.writeLoop(id, c)
+			}
 		} else {
 			c.tasksRWMtx.Unlock()
 		}
 	}
-	_, err := r.WriteTo(t)
-	if err != nil {
-		if oe, ok := err.(*net.OpError); ok {
-			switch oe.Op {
-			case "write":
+	if t.recvBuffer == nil {
+		_, err := r.WriteTo(t)
+		if err != nil {
+			if oe, ok := err.(*net.OpError); ok && oe.Op == "write" {
 				writeErr = err
-			default:
+			} else if errors.Is(err, errInvalidHTTPMessage) {
+				writeErr = err
+				t.Close()
+			} else {
 				readErr = err
 			}
+		}
+	} else if err := t.recvBuffer.Fill(r, int(r.N)); err != nil {
+		if errors.Is(err, connection.ErrWindowExceeded) {
+			writeErr = err
+			t.Close()
 		} else {
 			readErr = err
 		}
 	}
-	if c.client.config.LocalTimeout > 0 {
-		dl := time.Now().Add(c.client.config.LocalTimeout)
+	if t.service.LocalTimeout > 0 {
+		dl := time.Now().Add(t.service.LocalTimeout)
 		writeErr = t.conn.SetReadDeadline(dl)
 		if writeErr != nil {
 			return
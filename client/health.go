@@ -0,0 +1,140 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func (s *service) isHealthy() bool {
+	return atomic.LoadUint32(&s.unhealthy) == 0
+}
+
+// setHealthy 设置服务的健康状态，状态变化时返回 true
+func (s *service) setHealthy(healthy bool) (changed bool) {
+	var v uint32
+	if !healthy {
+		v = 1
+	}
+	return atomic.SwapUint32(&s.unhealthy, v) != v
+}
+
+// checkHealth 检查本地服务的健康状态。配置了 LocalHealthCheckPath 时请求该路径，状态码为 2xx 或者 3xx 表示健康，
+// 否则能够建立 tcp 连接表示健康
+func (s *service) checkHealth() (err error) {
+	timeout := s.LocalHealthCheckInterval
+	if s.LocalTimeout > 0 && s.LocalTimeout < timeout {
+		timeout = s.LocalTimeout
+	}
+	u := *s.localURL
+	if len(s.LocalHealthCheckPath) == 0 {
+		addr := u.Host
+		if strings.Index(addr, ":") < 0 {
+			if u.Scheme == "https" {
+				addr += ":443"
+			} else {
+				addr += ":80"
+			}
+		}
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return
+		}
+		return conn.Close()
+	}
+	u.Path = s.LocalHealthCheckPath
+	u.RawPath = ""
+	u.RawQuery = ""
+	client := http.Client{
+		Transport: &http.Transport{
+			// 本地服务通常使用自签名证书
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		err = &unhealthyStatusError{resp.StatusCode}
+	}
+	return
+}
+
+type unhealthyStatusError struct {
+	code int
+}
+
+func (e *unhealthyStatusError) Error() string {
+	return "unhealthy status code " + strconv.Itoa(e.code)
+}
+
+// healthCheckLoop 定期检查本地服务的健康状态，状态变化时通知所有的 tunnel
+func (c *Client) healthCheckLoop(s *service) {
+	ticker := time.NewTicker(s.LocalHealthCheckInterval)
+	defer ticker.Stop()
+	for atomic.LoadUint32(&c.closing) == 0 {
+		err := s.checkHealth()
+		c.healthMtx.Lock()
+		if s.setHealthy(err == nil) {
+			if err == nil {
+				c.Logger.Info().Uint16("service", s.index).Msg("local service is healthy")
+			} else {
+				c.Logger.Warn().Err(err).Uint16("service", s.index).Msg("local service is unhealthy")
+			}
+			c.tunnelsRWMtx.RLock()
+			for t := range c.tunnels {
+				if atomic.LoadUint32(&t.healthReports) == 1 {
+					e := t.SendInfoServiceHealth(s.index, err == nil)
+					if e != nil {
+						t.Logger.Debug().Err(e).Msg("failed to send the health of service")
+					}
+				}
+			}
+			c.tunnelsRWMtx.RUnlock()
+		}
+		c.healthMtx.Unlock()
+		<-ticker.C
+	}
+}
+
+// addReadyTunnel 添加 tunnel 并发送服务的健康状态。与 healthCheckLoop 互斥，避免 tunnel 收到过期的状态
+func (c *Client) addReadyTunnel(conn *conn) (err error) {
+	c.healthMtx.Lock()
+	defer c.healthMtx.Unlock()
+	c.addTunnel(conn)
+	if atomic.LoadUint32(&conn.healthReports) == 0 {
+		return
+	}
+	for _, s := range c.services {
+		if s.LocalHealthCheckInterval <= 0 {
+			continue
+		}
+		err = conn.SendInfoServiceHealth(s.index, s.isHealthy())
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// withHealthChecks 表示是否有服务开启了健康检查
+func (c *Client) withHealthChecks() bool {
+	for _, s := range c.services {
+		if s.LocalHealthCheckInterval > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	}()
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		local   string
+		path    string
+		healthy bool
+	}{
+		{"tcp://" + l.Addr().String(), "", true},
+		{"tcp://" + closed.Addr().String(), "", false},
+		{"http://" + l.Addr().String(), "/healthz", true},
+		{"http://" + l.Addr().String(), "/down", false},
+		{"http://" + closed.Addr().String(), "/healthz", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &service{localURL: u, LocalHealthCheckPath: tt.path, LocalHealthCheckInterval: time.Second}
+		err = s.checkHealth()
+		if (err == nil) != tt.healthy {
+			t.Errorf("checkHealth(%s%s) = %v, healthy %v is expected", tt.local, tt.path, err, tt.healthy)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/isrc-cas/gt/http1"
+	"github.com/isrc-cas/gt/predef"
+)
+
+// http 消息的解析状态
+const (
+	httpHeader = iota
+	httpBody
+	httpChunkSize
+	httpChunkData
+	httpTrailer
+	// httpUpgrade 表示升级请求已经写入，在收到响应之前缓存之后的数据
+	httpUpgrade
+	// httpRaw 表示之后的数据不再按照 http 消息解析，例如升级后的连接与 HTTP/2
+	httpRaw
+)
+
+// errInvalidHTTPMessage 表示无法解析 http 消息，task 会被关闭，避免之后的数据不经过改写就被转发
+var errInvalidHTTPMessage = errors.New("invalid http message")
+
+// messageWriter 逐个解析写入的 http 消息，完整的消息头交给 writeHeader 处理，body 原样写入 w
+type messageWriter struct {
+	w io.Writer
+	// writeHeader 写入处理后的消息头，返回之后的状态以及 body 的长度
+	writeHeader func(header []byte) (state int, length int64, err error)
+	// prefix 是消息头必须的前缀，不匹配时是无法解析的消息，避免等待不会到来的空行
+	prefix []byte
+	// rawWithoutPrefix 为 true 时不以 prefix 开头的数据原样写入，例如 h2c 本地服务的 HTTP/2 响应
+	rawWithoutPrefix bool
+	state     int
+	header    []byte
+	line      []byte
+	remaining int64
+	// afterBody 是当前消息结束之后的状态，升级请求之后为 httpUpgrade
+	afterBody int
+	// pending 是升级请求之后、收到响应之前缓存的数据
+	pending []byte
+	err     error
+}
+
+// Write 解析并写入 p，出错之后不再写入任何数据
+func (m *messageWriter) Write(p []byte) (n int, err error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err = m.write(p)
+	m.err = err
+	return
+}
+
+func (m *messageWriter) write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		var l int
+		var complete bool
+		switch m.state {
+		case httpRaw:
+			l, err = m.w.Write(p)
+			n += l
+			return
+		case httpUpgrade:
+			if len(m.pending)+len(p) > predef.MaxHTTPHeaderSize {
+				err = errInvalidHTTPMessage
+				return
+			}
+			m.pending = append(m.pending, p...)
+			n += len(p)
+			return
+		case httpBody, httpChunkData:
+			l = len(p)
+			if int64(l) > m.remaining {
+				l = int(m.remaining)
+			}
+			l, err = m.w.Write(p[:l])
+			n += l
+			p = p[l:]
+			m.remaining -= int64(l)
+			if err != nil {
+				return
+			}
+			if m.remaining > 0 {
+				continue
+			}
+			if m.state == httpBody {
+				m.state = m.nextMessage()
+			} else {
+				m.state = httpChunkSize
+			}
+		case httpHeader:
+			m.header, l, complete = appendLine(m.header, p)
+			n += l
+			p = p[l:]
+			if len(m.header) > predef.MaxHTTPHeaderSize {
+				err = errInvalidHTTPMessage
+				return
+			}
+			if !m.hasPrefix() {
+				if !m.rawWithoutPrefix {
+					err = errInvalidHTTPMessage
+					return
+				}
+				err = m.writeRaw(m.header)
+				m.header = m.header[:0]
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if !complete {
+				continue
+			}
+			start := bytes.LastIndexByte(m.header[:len(m.header)-1], '\n') + 1
+			if !http1.IsEmptyLine(m.header[start:]) {
+				continue
+			}
+			if start == 0 {
+				// 消息之前的空行
+				_, err = m.w.Write(m.header)
+			} else {
+				var length int64
+				m.state, length, err = m.writeHeader(m.header)
+				if m.state == httpHeader {
+					if length > 0 {
+						m.remaining = length
+						m.state = httpBody
+					} else {
+						m.state = m.nextMessage()
+					}
+				}
+			}
+			m.header = m.header[:0]
+			if err != nil {
+				return
+			}
+		case httpChunkSize, httpTrailer:
+			m.line, l, complete = appendLine(m.line, p)
+			n += l
+			p = p[l:]
+			if len(m.line) > predef.MaxHTTPHeaderSize {
+				err = errInvalidHTTPMessage
+				return
+			}
+			if !complete {
+				continue
+			}
+			line := m.line
+			m.line = m.line[:0]
+			state := m.state
+			if state == httpTrailer {
+				if http1.IsEmptyLine(line) {
+					state = m.nextMessage()
+				}
+			} else {
+				var size int64
+				size, err = http1.ParseChunkSize(line)
+				switch {
+				case err != nil:
+					err = errInvalidHTTPMessage
+					return
+				case size == 0:
+					state = httpTrailer
+				default:
+					// chunk 的数据以 CRLF 结尾
+					m.remaining = size + 2
+					state = httpChunkData
+				}
+			}
+			_, err = m.w.Write(line)
+			if err != nil {
+				return
+			}
+			m.state = state
+		}
+	}
+	return
+}
+
+// nextMessage 返回当前消息结束之后的状态
+func (m *messageWriter) nextMessage() (state int) {
+	state = m.afterBody
+	m.afterBody = httpHeader
+	return
+}
+
+// hasPrefix 判断已经读取的消息头是否可能以 prefix 开头
+func (m *messageWriter) hasPrefix() bool {
+	l := len(m.header)
+	if l > len(m.prefix) {
+		l = len(m.prefix)
+	}
+	return bytes.Equal(m.header[:l], m.prefix[:l])
+}
+
+// flush 原样写入还没有处理完的数据，例如连接在消息头结束之前关闭
+func (m *messageWriter) flush() (err error) {
+	if len(m.header) > 0 {
+		err = m.writeRaw(m.header)
+		m.header = m.header[:0]
+	}
+	if err == nil && len(m.line) > 0 {
+		err = m.writeRaw(m.line)
+		m.line = m.line[:0]
+	}
+	return
+}
+
+// appendLine 将 p 中到换行符为止的数据追加到 line，返回追加的字节数以及 line 是否以换行符结尾
+func appendLine(line []byte, p []byte) ([]byte, int, bool) {
+	i := bytes.IndexByte(p, '\n')
+	if i < 0 {
+		return append(line, p...), len(p), false
+	}
+	return append(line, p[:i+1]...), i + 1, true
+}
+
+// writeRaw 原样转发之后不再解析的数据
+func (m *messageWriter) writeRaw(data []byte) (err error) {
+	m.state = httpRaw
+	_, err = m.w.Write(data)
+	return
+}
+
+// writerFunc 将函数转换为 io.Writer
+type writerFunc func(p []byte) (n int, err error)
+
+func (f writerFunc) Write(p []byte) (n int, err error) {
+	return f(p)
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// parseProxy 解析 remoteProxy 选项，支持 http://、https:// 和 socks5://
+func parseProxy(rawURL string) (u *url.URL, err error) {
+	u, err = url.Parse(rawURL)
+	if err != nil {
+		err = fmt.Errorf("remote proxy url (-remoteProxy option) '%s' is invalid, cause %s", rawURL, err.Error())
+		return
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		err = fmt.Errorf("remote proxy url (-remoteProxy option) '%s' must begin with http://, https:// or socks5://", u.Redacted())
+		return
+	}
+	if len(u.Hostname()) == 0 {
+		err = fmt.Errorf("remote proxy url (-remoteProxy option) '%s' is invalid", u.Redacted())
+	}
+	return
+}
+
+// getenv 返回环境变量 name 的值，name 为空时使用小写的名称
+func getenv(name string) string {
+	if v := os.Getenv(name); len(v) > 0 {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// proxyFromEnvironment 返回从 HTTP_PROXY、HTTPS_PROXY、ALL_PROXY 与 NO_PROXY 环境变量读取代理的函数，
+// ALL_PROXY 在前两者为空时使用
+func proxyFromEnvironment() func(*url.URL) (*url.URL, error) {
+	all := getenv("ALL_PROXY")
+	conf := &httpproxy.Config{
+		HTTPProxy:  getenv("HTTP_PROXY"),
+		HTTPSProxy: getenv("HTTPS_PROXY"),
+		NoProxy:    getenv("NO_PROXY"),
+		CGI:        os.Getenv("REQUEST_METHOD") != "",
+	}
+	if len(conf.HTTPProxy) == 0 {
+		conf.HTTPProxy = all
+	}
+	if len(conf.HTTPSProxy) == 0 {
+		conf.HTTPSProxy = all
+	}
+	return conf.ProxyFunc()
+}
+
+// proxyURL 返回访问 u 时使用的代理，remoteProxy 选项优先于环境变量，返回 nil 时直接连接
+func (c *Client) proxyURL(u *url.URL) (*url.URL, error) {
+	if c.remoteProxy != nil {
+		return c.remoteProxy, nil
+	}
+	if c.proxyFunc == nil {
+		return nil, nil
+	}
+	return c.proxyFunc(u)
+}
+
+// proxyDial 通过代理 proxyURL 连接 addr，proxyURL 为 nil 时直接连接
+func proxyDial(proxyURL *url.URL, addr string) (conn net.Conn, err error) {
+	if proxyURL == nil {
+		return net.Dial("tcp", addr)
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var d proxy.Dialer
+		d, err = proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return
+		}
+		return d.Dial("tcp", addr)
+	case "http", "https":
+		return httpConnect(proxyURL, addr)
+	}
+	err = fmt.Errorf("unsupported proxy '%s'", proxyURL.Redacted())
+	return
+}
+
+// httpConnect 通过 HTTP CONNECT 方法建立到 addr 的隧道
+func httpConnect(proxyURL *url.URL, addr string) (conn net.Conn, err error) {
+	proxyAddr := proxyURL.Host
+	if len(proxyURL.Port()) < 1 {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	if proxyURL.Scheme == "https" {
+		conn, err = tls.Dial("tcp", proxyAddr, &tls.Config{ServerName: proxyURL.Hostname()})
+	} else {
+		conn, err = net.Dial("tcp", proxyAddr)
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("proxy '%s' refused to connect to '%s': %s", proxyURL.Redacted(), addr, resp.Status)
+		return
+	}
+	if reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, reader: reader}
+	}
+	return
+}
+
+// bufferedConn 先读取 reader 中已经缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
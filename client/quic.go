@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/pool"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/quic-go/quic-go"
+)
+
+func (d *dialer) quicDial() (conn net.Conn, err error) {
+	// tunnel 空闲时也需要保持 QUIC 连接，避免 -remoteTimeout 为 0 时连接超时断开
+	qc, err := quic.DialAddr(context.Background(), d.host, d.tlsConfig, &quic.Config{KeepAlivePeriod: 15 * time.Second})
+	if err != nil {
+		return
+	}
+	stream, err := qc.OpenStreamSync(context.Background())
+	if err != nil {
+		_ = qc.CloseWithError(0, "")
+		return
+	}
+	conn = &connection.QUICConn{Stream: stream, Connection: qc}
+	return
+}
+
+// acceptStreams 接受服务端为每个 task 打开的 QUIC stream
+func (c *conn) acceptStreams(qc *quic.Conn) {
+	for {
+		stream, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			c.Logger.Debug().Err(err).Msg("acceptStreams ended")
+			return
+		}
+		go c.processStream(stream)
+	}
+}
+
+// processStream 转发 QUIC stream 上的 task，stream 以 4 字节的 task id 与 2 字节的服务索引开始，
+// 服务端接受了 predef.OptionVisitorAddr 时之后是访问者的地址
+func (c *conn) processStream(stream *quic.Stream) {
+	header := make([]byte, 6)
+	_, err := io.ReadFull(stream, header)
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("failed to read quic stream header")
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return
+	}
+	id := binary.BigEndian.Uint32(header)
+	var v *connection.Visitor
+	if atomic.LoadUint32(&c.visitorAddrs) == 1 {
+		v, err = connection.ReadVisitor(stream)
+		if err != nil {
+			c.Logger.Debug().Err(err).Msg("failed to read the visitor of quic stream")
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			return
+		}
+	}
+	s, err := c.client.getService(binary.BigEndian.Uint16(header[4:]))
+	if err == nil {
+		var t *httpTask
+		t, err = c.dial(s, v)
+		if err == nil {
+			t.Logger = c.Logger.With().
+				Uint32("task", id).
+				Uint16("service", s.index).
+				Logger()
+			t.Logger.Info().Msg("task started")
+			c.tasksRWMtx.Lock()
+			c.tasks[id] = t
+			c.tasksRWMtx.Unlock()
+			go t.streamWriteLoop(stream)
+			t.processStream(id, c, stream)
+			return
+		}
+	}
+	c.Logger.Warn().Err(err).Uint32("task", id).Msg("failed to dial the local service for quic stream")
+	stream.CancelRead(0)
+	stream.CancelWrite(0)
+}
+
+// streamWriteLoop 将 stream 的数据写入本地服务，stream 结束时关闭 task
+func (t *httpTask) streamWriteLoop(stream *quic.Stream) {
+	var err error
+	buf := pool.BytesPool.Get().([]byte)
+	defer func() {
+		pool.BytesPool.Put(buf)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		if err != nil {
+			t.Logger.Debug().Err(err).Msg("streamWriteLoop ended")
+		}
+		stream.CancelRead(0)
+		t.Close()
+	}()
+	for {
+		var l int
+		l, err = stream.Read(buf)
+		if l > 0 {
+			_, we := t.Write(buf[:l])
+			if we != nil {
+				err = we
+				return
+			}
+			if t.service.LocalTimeout > 0 {
+				dl := time.Now().Add(t.service.LocalTimeout)
+				we = t.conn.SetReadDeadline(dl)
+				if we != nil {
+					err = we
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// processStream 将本地服务的数据写入 stream
+func (t *httpTask) processStream(id uint32, c *conn, stream *quic.Stream) {
+	atomic.AddUint32(&c.TasksCount, 1)
+	var rErr error
+	var wErr error
+	buf := pool.BytesPool.Get().([]byte)
+	defer func() {
+		pool.BytesPool.Put(buf)
+		if errors.Is(rErr, io.EOF) {
+			rErr = nil
+		}
+		if rErr != nil || wErr != nil {
+			t.Logger.Debug().AnErr("read err", rErr).AnErr("write err", wErr).Msg("processStream err")
+		}
+		if wErr != nil {
+			stream.CancelWrite(0)
+		} else {
+			_ = stream.Close()
+		}
+		c.tasksRWMtx.Lock()
+		delete(c.tasks, id)
+		c.tasksRWMtx.Unlock()
+		t.Close()
+		if atomic.AddUint32(&c.TasksCount, ^uint32(0)) == 0 && c.IsClosing() {
+			c.SendCloseSignal()
+			c.Close()
+		}
+	}()
+	for {
+		if t.service.LocalTimeout > 0 {
+			dl := time.Now().Add(t.service.LocalTimeout)
+			rErr = t.conn.SetReadDeadline(dl)
+			if rErr != nil {
+				return
+			}
+		}
+		var l int
+		l, rErr = t.conn.Read(buf)
+		if l > 0 {
+			if predef.Debug {
+				t.Logger.Trace().Hex("data", buf[:l]).Msg("write stream")
+			}
+			_, wErr = stream.Write(buf[:l])
+			if wErr != nil {
+				return
+			}
+		}
+		if rErr != nil {
+			return
+		}
+	}
+}
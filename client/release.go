@@ -4,6 +4,8 @@
 package client
 
 import (
+	"crypto/tls"
+	"net/url"
 	"sync"
 
 	"github.com/isrc-cas/gt/logger"
@@ -18,6 +20,23 @@ type Client struct {
 	tunnels      map[*conn]struct{}
 	tunnelsRWMtx sync.RWMutex
 	tunnelsCond  *sync.Cond
+	services     []*service
+	withServices bool
+	// clientCert 是 tls 连接服务端时使用的客户端证书
+	clientCert *tls.Certificate
+	// remoteProxy 是 remoteProxy 选项指定的代理，proxyFunc 从环境变量读取代理
+	remoteProxy *url.URL
+	proxyFunc   func(*url.URL) (*url.URL, error)
+	// remotes 是按优先级排列的服务端
+	remotes remotes
+	// maxTunnels 是服务端允许的最大 tunnel 数量，0 表示不限制
+	maxTunnels uint32
+	// extraTunnels 是超过 RemoteConnections 的 tunnel 数量，包括正在连接的 tunnel，
+	// growAfter 之前不再增加 tunnel
+	extraTunnels int32
+	growAfter    int64
+	// healthMtx 保证 tunnel 按顺序收到服务的健康状态
+	healthMtx sync.Mutex
 }
 
 func (c *conn) onTunnelClose() {
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// remote 是一个服务端及其健康状态，连接失败后在退避时间内被跳过
+type remote struct {
+	mtx      sync.Mutex
+	dialer   dialer
+	failures uint
+	retryAt  time.Time
+	// api 为 true 时 dialer 来自 remoteAPI，每次重连前重新查询
+	api   bool
+	stale bool
+	// rejections 是 predef.Version2 的握手连续被拒绝的次数
+	rejections uint
+	// version1Until 之前使用没有流量控制的 predef.Version1，之后重新尝试 predef.Version2
+	version1Until time.Time
+}
+
+const (
+	// version2Rejections 是回退到 predef.Version1 之前 predef.Version2 的握手需要连续被拒绝的次数
+	version2Rejections = 3
+	// version1Duration 是回退到 predef.Version1 之后重新尝试 predef.Version2 的间隔
+	version1Duration = 10 * time.Minute
+)
+
+// version 返回与 r 握手时使用的协议版本
+func (r *remote) version() (v byte) {
+	r.mtx.Lock()
+	v = predef.Version2
+	if time.Now().Before(r.version1Until) {
+		v = predef.Version1
+	}
+	r.mtx.Unlock()
+	return
+}
+
+// rejectVersion2 记录一次 predef.Version2 的握手被拒绝，连续被拒绝 version2Rejections 次时
+// 在 version1Duration 之内回退到 predef.Version1，返回是否回退
+func (r *remote) rejectVersion2() (fallback bool) {
+	r.mtx.Lock()
+	r.rejections++
+	if r.rejections >= version2Rejections {
+		r.rejections = 0
+		r.version1Until = time.Now().Add(version1Duration)
+		fallback = true
+	}
+	r.mtx.Unlock()
+	return
+}
+
+// acceptVersion2 在服务端回应了 predef.Version2 的握手后重置被拒绝的次数
+func (r *remote) acceptVersion2() {
+	r.mtx.Lock()
+	r.rejections = 0
+	r.mtx.Unlock()
+}
+
+func (r *remote) getDialer() (d dialer, stale bool) {
+	r.mtx.Lock()
+	d = r.dialer
+	stale = r.stale
+	r.mtx.Unlock()
+	return
+}
+
+func (r *remote) setDialer(d dialer) {
+	r.mtx.Lock()
+	r.dialer = d
+	r.stale = false
+	r.mtx.Unlock()
+}
+
+// fail 记录一次失败，返回在重试之前需要等待的时间
+func (r *remote) fail(base, max time.Duration) (delay time.Duration) {
+	r.mtx.Lock()
+	r.failures++
+	delay = backoff(base, max, r.failures)
+	r.retryAt = time.Now().Add(delay)
+	r.stale = r.api
+	r.mtx.Unlock()
+	return
+}
+
+// succeed 在连接成功后重置失败次数
+func (r *remote) succeed() {
+	r.mtx.Lock()
+	r.failures = 0
+	r.retryAt = time.Time{}
+	r.stale = r.api
+	r.mtx.Unlock()
+}
+
+// remotes 按优先级从高到低保存服务端
+type remotes []*remote
+
+// next 返回优先级最高且不在退避时间内的服务端。所有服务端都在退避时间内时返回最早可以重试的服务端与需要等待的时间
+func (rs remotes) next() (r *remote, wait time.Duration) {
+	now := time.Now()
+	var retryAt time.Time
+	for _, e := range rs {
+		e.mtx.Lock()
+		at := e.retryAt
+		e.mtx.Unlock()
+		if !at.After(now) {
+			return e, 0
+		}
+		if r == nil || at.Before(retryAt) {
+			r = e
+			retryAt = at
+		}
+	}
+	wait = retryAt.Sub(now)
+	return
+}
+
+// backoff 返回第 failures 次失败后的等待时间，从 base 开始指数增长且不超过 max，
+// 并在 [d/2, d) 之间随机抖动，避免大量客户端同时重连
+func backoff(base, max time.Duration, failures uint) time.Duration {
+	d := base
+	for i := uint(1); i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return jitter(d)
+}
+
+// jitter 返回 [d/2, d) 之间的随机时间
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
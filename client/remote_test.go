@@ -0,0 +1,83 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+func TestBackoff(t *testing.T) {
+	base := time.Second
+	max := 10 * time.Second
+	tests := []struct {
+		failures uint
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, max},
+		{100, max},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := backoff(base, max, tt.failures)
+			if d < tt.want/2 || d >= tt.want {
+				t.Fatalf("backoff after %d failures is %s, should be in [%s, %s)", tt.failures, d, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestRemotesNext(t *testing.T) {
+	rs := remotes{{dialer: dialer{host: "a"}}, {dialer: dialer{host: "b"}}}
+	r, wait := rs.next()
+	if r != rs[0] || wait != 0 {
+		t.Fatalf("next() = %s, %s, want a", r.dialer.host, wait)
+	}
+	rs[0].fail(time.Minute, time.Minute)
+	r, wait = rs.next()
+	if r != rs[1] || wait != 0 {
+		t.Fatalf("next() = %s, %s, want b", r.dialer.host, wait)
+	}
+	rs[1].fail(time.Hour, time.Hour)
+	r, wait = rs.next()
+	if r != rs[0] || wait <= 0 || wait > time.Minute {
+		t.Fatalf("next() = %s, %s, want a after waiting", r.dialer.host, wait)
+	}
+	rs[0].succeed()
+	r, wait = rs.next()
+	if r != rs[0] || wait != 0 {
+		t.Fatalf("next() = %s, %s, want a", r.dialer.host, wait)
+	}
+}
+
+func TestRemoteVersionFallback(t *testing.T) {
+	r := &remote{}
+	for i := 1; i < version2Rejections; i++ {
+		if r.rejectVersion2() {
+			t.Fatalf("fell back to version 1 after %d rejections", i)
+		}
+	}
+	r.acceptVersion2()
+	for i := 1; i < version2Rejections; i++ {
+		if r.rejectVersion2() {
+			t.Fatalf("fell back to version 1 after %d rejections following an accept", i)
+		}
+	}
+	if r.version() != predef.Version2 {
+		t.Fatal("version 1 is used before the fallback")
+	}
+	if !r.rejectVersion2() {
+		t.Fatalf("did not fall back to version 1 after %d rejections", version2Rejections)
+	}
+	if r.version() != predef.Version1 {
+		t.Fatal("version 2 is used after the fallback")
+	}
+	r.version1Until = time.Now().Add(-time.Second)
+	if r.version() != predef.Version2 {
+		t.Fatalf("version 2 is not retried after %s", version1Duration)
+	}
+}
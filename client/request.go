@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/isrc-cas/gt/http1"
+)
+
+// requestWriter 逐个解析写入本地服务的 http 请求，按照规则改写每个请求头，并添加访问者的地址。
+// 升级请求之后的数据在 responseReader 收到成功的响应之后才不再解析，无法解析的请求会关闭 task，
+// 避免访问者在之后的请求中伪造访问者的地址或者绕过改写的规则
+type requestWriter struct {
+	messageWriter
+	// mtx 保护 messageWriter，升级请求的响应在 responseReader 中处理
+	mtx sync.Mutex
+	// http2 为 true 时本地服务支持 h2c，HTTP/2 的 preface 之后的数据不再解析
+	http2 bool
+	// rules 为 nil 时不改写请求
+	rules *httpRules
+	// forwarded 为 nil 时不添加访问者的地址
+	forwarded *forwardedHeaders
+	// methods 为 nil 时不记录请求的方法
+	methods *methodQueue
+	headers []http1.Header
+	out     []byte
+}
+
+func newRequestWriter(w io.Writer, rules *httpRules, forwarded *forwardedHeaders, methods *methodQueue) *requestWriter {
+	r := &requestWriter{rules: rules, forwarded: forwarded, methods: methods}
+	r.w = w
+	r.messageWriter.writeHeader = r.writeHeader
+	return r
+}
+
+func (r *requestWriter) Write(p []byte) (n int, err error) {
+	r.mtx.Lock()
+	n, err = r.messageWriter.Write(p)
+	r.mtx.Unlock()
+	return
+}
+
+// upgraded 处理升级请求的响应，accepted 为 true 时之后的数据不再解析，否则继续解析缓存的数据
+func (r *requestWriter) upgraded(accepted bool) (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	state := httpHeader
+	if accepted {
+		state = httpRaw
+	}
+	if r.state != httpUpgrade {
+		// 本地服务在升级请求的 body 结束之前就响应了
+		if r.afterBody == httpUpgrade {
+			r.afterBody = state
+		}
+		return
+	}
+	r.state = state
+	pending := r.pending
+	r.pending = nil
+	if len(pending) > 0 {
+		_, err = r.messageWriter.Write(pending)
+	}
+	return
+}
+
+// writeHeader 转发改写后的请求头，并根据请求头确定 body 的长度，没有 body 长度的请求没有 body
+func (r *requestWriter) writeHeader(header []byte) (state int, length int64, err error) {
+	first, headers, err := http1.ParseHeaders(header)
+	if err != nil {
+		return 0, 0, errInvalidHTTPMessage
+	}
+	fields := bytes.Fields(first)
+	if len(fields) != 3 || !bytes.HasPrefix(fields[2], []byte("HTTP/1.")) {
+		if r.http2 && bytes.Equal(first, []byte("PRI * HTTP/2.0")) {
+			return httpRaw, 0, r.writeRaw(header)
+		}
+		return 0, 0, errInvalidHTTPMessage
+	}
+	out := r.out[:0]
+	if r.rules != nil {
+		out = r.rules.appendRequestLine(out, first)
+		r.headers = r.rules.RequestHeaders.apply(r.headers[:0], headers)
+		headers = r.headers
+	} else {
+		out = append(out, first...)
+	}
+	length, chunked, err := http1.BodyLength(headers)
+	if err != nil {
+		return 0, 0, errInvalidHTTPMessage
+	}
+	out = append(out, "\r\n"...)
+	if r.forwarded != nil {
+		out = r.forwarded.appendHeaders(out, headers)
+	} else {
+		for _, h := range headers {
+			out = appendHeader(out, h.Name, h.Value)
+		}
+	}
+	out = append(out, "\r\n"...)
+	r.out = out
+	upgrade := http1.IsUpgrade(fields[0], headers)
+	if upgrade {
+		r.afterBody = httpUpgrade
+	}
+	if r.methods != nil {
+		r.methods.push(fields[0], upgrade)
+	}
+	_, err = r.w.Write(out)
+	if chunked {
+		state = httpChunkSize
+	}
+	return
+}
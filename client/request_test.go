@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+)
+
+func TestRequestWriter(t *testing.T) {
+	input := "\r\nGET /a HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 10.0.0.1\r\nX-Real-IP: 10.0.0.2\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nX-Re:" +
+		"POST /c HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nForwarded: for=10.0.0.1\r\n\r\n" +
+		"3\r\na\r\n\r\n0\r\nTrailer: 1\r\n\r\n" +
+		"GET /d HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" +
+		"GET /e HTTP/1.1\r\nX-Real-IP: 10.0.0.2\r\n\r\n"
+	expected := "\r\nGET /a HTTP/1.1\r\nHost: example.com\r\n" +
+		"X-Forwarded-For: 10.0.0.1, 1.2.3.4\r\nX-Forwarded-Proto: https\r\nX-Real-IP: 1.2.3.4\r\n" +
+		"Forwarded: for=1.2.3.4;proto=https\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n" +
+		"X-Forwarded-For: 1.2.3.4\r\nX-Forwarded-Proto: https\r\nX-Real-IP: 1.2.3.4\r\n" +
+		"Forwarded: for=1.2.3.4;proto=https\r\n\r\nX-Re:" +
+		"POST /c HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n" +
+		"X-Forwarded-For: 1.2.3.4\r\nX-Forwarded-Proto: https\r\nX-Real-IP: 1.2.3.4\r\n" +
+		"Forwarded: for=10.0.0.1, for=1.2.3.4;proto=https\r\n\r\n" +
+		"3\r\na\r\n\r\n0\r\nTrailer: 1\r\n\r\n" +
+		"GET /d HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"X-Forwarded-For: 1.2.3.4\r\nX-Forwarded-Proto: https\r\nX-Real-IP: 1.2.3.4\r\n" +
+		"Forwarded: for=1.2.3.4;proto=https\r\n\r\n"
+	// 升级成功之后的数据不再解析，升级失败时继续解析之后的请求
+	upgraded := "GET /e HTTP/1.1\r\nX-Real-IP: 10.0.0.2\r\n\r\n"
+	notUpgraded := "GET /e HTTP/1.1\r\n" +
+		"X-Forwarded-For: 1.2.3.4\r\nX-Forwarded-Proto: https\r\nX-Real-IP: 1.2.3.4\r\n" +
+		"Forwarded: for=1.2.3.4;proto=https\r\n\r\n"
+	visitor := &connection.Visitor{RemoteAddr: "1.2.3.4:5678", LocalAddr: "10.0.0.1:443", TLS: true}
+
+	// 以不同的大小切分写入的数据
+	for size := 1; size <= len(input); size++ {
+		var buf bytes.Buffer
+		w := newRequestWriter(&buf, nil, newForwardedHeaders(forwardedX|forwardedRFC7239, visitor), nil)
+		for p := []byte(input); len(p) > 0; {
+			l := size
+			if l > len(p) {
+				l = len(p)
+			}
+			n, err := w.Write(p[:l])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != l {
+				t.Fatalf("%d is expected, but got %d", l, n)
+			}
+			p = p[l:]
+		}
+		if buf.String() != expected {
+			t.Fatalf("size %d: %q is not expected %q", size, buf.String(), expected)
+		}
+		accepted := size%2 == 0
+		err := w.upgraded(accepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := expected + notUpgraded
+		if accepted {
+			e = expected + upgraded
+		}
+		if buf.String() != e {
+			t.Fatalf("size %d, upgrade accepted %v: %q is not expected %q", size, accepted, buf.String(), e)
+		}
+	}
+}
+
+func TestRequestWriterInvalid(t *testing.T) {
+	visitor := &connection.Visitor{RemoteAddr: "[2001:db8::1]:5678", LocalAddr: "[2001:db8::2]:80"}
+	for _, input := range []string{
+		"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nInvalid Header: 1\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nX: " + strings.Repeat("x", predef.MaxHTTPHeaderSize) + "\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nx\r\nGET / HTTP/1.1\r\n\r\n",
+	} {
+		var buf bytes.Buffer
+		w := newRequestWriter(&buf, nil, newForwardedHeaders(forwardedRFC7239, visitor), nil)
+		_, err := w.Write([]byte(input))
+		if err != errInvalidHTTPMessage {
+			t.Fatalf("%q: %v is not expected %v", input, err, errInvalidHTTPMessage)
+		}
+		if strings.Contains(buf.String(), "GET / HTTP/1.1\r\n\r\n") {
+			t.Fatalf("%q: the request after the invalid one is forwarded: %q", input, buf.String())
+		}
+		_, err = w.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		if err != errInvalidHTTPMessage {
+			t.Fatalf("%q: %v is expected after the invalid request, but got %v", input, errInvalidHTTPMessage, err)
+		}
+	}
+
+	// 本地服务支持 h2c 时 HTTP/2 的 preface 之后的数据不再解析
+	input := "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\nGET / HTTP/1.1\r\n\r\n"
+	var buf bytes.Buffer
+	w := newRequestWriter(&buf, nil, newForwardedHeaders(forwardedRFC7239, visitor), nil)
+	w.http2 = true
+	_, err := w.Write([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != input {
+		t.Fatalf("%q is not expected %q", buf.String(), input)
+	}
+
+	buf.Reset()
+	w = newRequestWriter(&buf, nil, newForwardedHeaders(forwardedRFC7239, visitor), nil)
+	_, err = w.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "GET / HTTP/1.0\r\nForwarded: for=\"[2001:db8::1]\";proto=http\r\n\r\n"
+	if buf.String() != expected {
+		t.Fatalf("%q is not expected %q", buf.String(), expected)
+	}
+}
+
+func TestRequestWriterRules(t *testing.T) {
+	rules := &httpRules{
+		RequestHeaders: headerRules{
+			Remove: []string{"Cookie"},
+			Set:    map[string]string{"X-Env": "prod"},
+			Add:    map[string]string{"X-Added": "1"},
+		},
+		RewritePaths: []pathRule{
+			{Prefix: "/api/", Replacement: "/"},
+			{Prefix: "/", Replacement: "/static/"},
+		},
+	}
+	err := rules.init("localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "GET /api/users?id=1 HTTP/1.1\r\nHost: example.com\r\nCookie: a=1\r\nX-Env: dev\r\nX-Env: test\r\n\r\n" +
+		"HEAD /index.html HTTP/1.1\r\nCookie: b=2\r\n\r\n" +
+		"OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	expected := "GET /users?id=1 HTTP/1.1\r\nHost: localhost:8080\r\nX-Env: prod\r\nX-Added: 1\r\n\r\n" +
+		"HEAD /static/index.html HTTP/1.1\r\nHost: localhost:8080\r\nX-Env: prod\r\nX-Added: 1\r\n\r\n" +
+		"OPTIONS * HTTP/1.1\r\nHost: localhost:8080\r\nX-Env: prod\r\nX-Added: 1\r\n\r\n"
+	var buf bytes.Buffer
+	methods := &methodQueue{}
+	w := newRequestWriter(&buf, rules, nil, methods)
+	_, err = w.Write([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("%q is not expected %q", buf.String(), expected)
+	}
+	for _, method := range []string{"", "HEAD", "", ""} {
+		if m, upgrade := methods.pop(); m != method || upgrade {
+			t.Fatalf("method %q, upgrade %v is not expected %q", m, upgrade, method)
+		}
+	}
+}
+
+func TestRequestWriterUpgrade(t *testing.T) {
+	rules := &httpRules{
+		RequestHeaders: headerRules{
+			Remove: []string{"Cookie"},
+			Set:    map[string]string{"X-Env": "prod"},
+		},
+		RewritePaths: []pathRule{{Prefix: "/api/", Replacement: "/"}},
+	}
+	err := rules.init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor := &connection.Visitor{RemoteAddr: "1.2.3.4:5678", LocalAddr: "10.0.0.1:80"}
+	upgrade := "GET /ws HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	// 升级请求之后的请求试图绕过规则并伪造访问者的地址
+	pipelined := "GET /api/admin HTTP/1.1\r\nCookie: a=1\r\nX-Env: dev\r\nX-Real-IP: 10.0.0.2\r\n\r\n"
+	tests := []struct {
+		response string
+		expected string
+	}{
+		{
+			"HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+			"GET /admin HTTP/1.1\r\nX-Env: prod\r\n" +
+				"X-Forwarded-For: 1.2.3.4\r\nX-Forwarded-Proto: http\r\nX-Real-IP: 1.2.3.4\r\n\r\n",
+		},
+		{
+			"HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+			pipelined,
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		methods := &methodQueue{}
+		w := newRequestWriter(&buf, rules, newForwardedHeaders(forwardedX, visitor), methods)
+		_, err = w.Write([]byte(upgrade + pipelined))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := buf.String()
+		if strings.Contains(written, "/admin") {
+			t.Fatalf("%q is forwarded before the upgrade is answered", written)
+		}
+		r := newResponseReader(strings.NewReader(tt.response), &rules.ResponseHeaders, methods)
+		r.requests = w
+		_, err = io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != written+tt.expected {
+			t.Fatalf("response %q: %q is not expected %q", tt.response, buf.String()[len(written):], tt.expected)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"io"
+
+	"github.com/isrc-cas/gt/http1"
+)
+
+// responseReader 逐个解析从本地服务读取的 http 响应，按照规则改写每个响应头，无法解析的响应会关闭 task
+type responseReader struct {
+	messages messageWriter
+	r        io.Reader
+	rules    *headerRules
+	methods  *methodQueue
+	// requests 不为 nil 时通知它升级请求的结果
+	requests *requestWriter
+	buf      []byte
+	headers  []http1.Header
+	// out 中 off 之后是已经处理但还没有被读取的数据
+	out []byte
+	off int
+	err error
+}
+
+func newResponseReader(r io.Reader, rules *headerRules, methods *methodQueue) *responseReader {
+	rr := &responseReader{r: r, rules: rules, methods: methods}
+	rr.messages = messageWriter{
+		w: writerFunc(func(p []byte) (int, error) {
+			rr.out = append(rr.out, p...)
+			return len(p), nil
+		}),
+		writeHeader: rr.writeHeader,
+		prefix:      []byte("HTTP/1."),
+	}
+	return rr
+}
+
+func (r *responseReader) Read(p []byte) (n int, err error) {
+	for r.off == len(r.out) && r.err == nil {
+		if r.messages.state == httpRaw {
+			return r.r.Read(p)
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, 16*1024)
+		}
+		r.out = r.out[:0]
+		r.off = 0
+		var l int
+		l, r.err = r.r.Read(r.buf)
+		_, e := r.messages.Write(r.buf[:l])
+		if e != nil {
+			r.err = e
+		} else if r.err != nil {
+			_ = r.messages.flush()
+		}
+	}
+	if r.off == len(r.out) {
+		return 0, r.err
+	}
+	n = copy(p, r.out[r.off:])
+	r.off += n
+	return
+}
+
+// writeHeader 写入改写后的响应头，并根据请求的方法与响应头确定 body 的长度
+func (r *responseReader) writeHeader(header []byte) (state int, length int64, err error) {
+	first, headers, err := http1.ParseHeaders(header)
+	if err != nil || len(first) < 12 || first[8] != ' ' {
+		return 0, 0, errInvalidHTTPMessage
+	}
+	status, err := http1.ParseDecimal(first[9:12])
+	if err != nil {
+		return 0, 0, errInvalidHTTPMessage
+	}
+	length, chunked, err := http1.BodyLength(headers)
+	if err != nil {
+		return 0, 0, errInvalidHTTPMessage
+	}
+	// 1xx 是中间响应，之后还有最终的响应，101 除外
+	final := status >= 200 || status == 101
+	var method string
+	var upgrade bool
+	if final {
+		method, upgrade = r.methods.pop()
+	}
+	r.out = append(r.out, first...)
+	r.out = append(r.out, "\r\n"...)
+	if final {
+		r.headers = r.rules.apply(r.headers[:0], headers)
+		headers = r.headers
+	}
+	for _, h := range headers {
+		r.out = appendHeader(r.out, h.Name, h.Value)
+	}
+	r.out = append(r.out, "\r\n"...)
+	accepted := status == 101 || method == "CONNECT" && status/100 == 2
+	if upgrade && r.requests != nil {
+		err = r.requests.upgraded(accepted)
+		if err != nil {
+			return
+		}
+	}
+	switch {
+	case accepted:
+		return httpRaw, 0, nil
+	case !final, status == 204, status == 304, method == "HEAD":
+		return httpHeader, 0, nil
+	case length < 0 && !chunked:
+		// 没有长度的 body 直到连接关闭
+		state = httpRaw
+	case chunked:
+		state = httpChunkSize
+	}
+	return
+}
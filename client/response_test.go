@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// chunkReader 每次最多读取 size 字节
+type chunkReader struct {
+	r    io.Reader
+	size int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	return c.r.Read(p)
+}
+
+func TestResponseReader(t *testing.T) {
+	rules := &httpRules{
+		ResponseHeaders: headerRules{
+			Set: map[string]string{"Strict-Transport-Security": "max-age=63072000"},
+			Add: map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+	}
+	err := rules.init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := "Strict-Transport-Security: max-age=63072000\r\nAccess-Control-Allow-Origin: *\r\n"
+	input := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHTTP/" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nStrict-Transport-Security: max-age=1\r\n\r\n5\r\nHTTP/\r\n0\r\n\r\n" +
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n\r\nHTTP/1.1 200 OK\r\n\r\n"
+	expected := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n" + added + "\r\nHTTP/" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n" + added + "\r\n" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n" + added + "\r\n5\r\nHTTP/\r\n0\r\n\r\n" +
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n" + added + "\r\n" +
+		"HTTP/1.1 200 OK\r\n" + added + "\r\nHTTP/1.1 200 OK\r\n\r\n"
+
+	for size := 1; size <= len(input); size++ {
+		methods := &methodQueue{}
+		// 100 Continue 不对应请求，第三个响应是 HEAD 请求的响应
+		for _, method := range []string{"POST", "HEAD", "GET", "GET", "GET"} {
+			methods.push([]byte(method), false)
+		}
+		r := newResponseReader(&chunkReader{strings.NewReader(input), size}, &rules.ResponseHeaders, methods)
+		var buf bytes.Buffer
+		p := make([]byte, size)
+		for {
+			n, err := r.Read(p)
+			buf.Write(p[:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.String() != expected {
+			t.Fatalf("size %d: %q is not expected %q", size, buf.String(), expected)
+		}
+	}
+}
+
+func TestResponseReaderRaw(t *testing.T) {
+	for _, input := range []string{
+		// h2c 本地服务的 SETTINGS 帧
+		"\x00\x00\x00\x04\x00\x00\x00\x00\x00",
+		"HTTP/1.1 200 OK\r\nContent-Le",
+		// 没有长度的 body 直到连接关闭
+		"HTTP/1.1 200 OK\r\n\r\nHTTP/1.1 200 OK\r\n\r\n",
+	} {
+		r := newResponseReader(strings.NewReader(input), &headerRules{}, &methodQueue{})
+		r.messages.rawWithoutPrefix = true
+		output, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != input {
+			t.Fatalf("%q is not expected %q", output, input)
+		}
+	}
+}
+
+func TestResponseReaderInvalid(t *testing.T) {
+	rules := &httpRules{ResponseHeaders: headerRules{Add: map[string]string{"X-Added": "1"}}}
+	err := rules.init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{
+		"\x00\x00\x00\x04\x00\x00\x00\x00\x00",
+		"HTTP/1.1 2xx OK\r\n\r\nHTTP/1.1 200 OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nHTTP/1.1 200 OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nx\r\nHTTP/1.1 200 OK\r\n\r\n",
+	} {
+		r := newResponseReader(strings.NewReader(input), &rules.ResponseHeaders, &methodQueue{})
+		output, err := io.ReadAll(r)
+		if err != errInvalidHTTPMessage {
+			t.Fatalf("%q: %v is not expected %v", input, err, errInvalidHTTPMessage)
+		}
+		if strings.Contains(string(output), "HTTP/1.1 200 OK\r\n\r\n") {
+			t.Fatalf("%q: the response after the invalid one is not rewritten: %q", input, output)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/isrc-cas/gt/http1"
+)
+
+// httpRules 是改写 http:// 本地服务的请求与响应的规则
+type httpRules struct {
+	RequestHeaders  headerRules `yaml:"requestHeaders"`
+	ResponseHeaders headerRules `yaml:"responseHeaders"`
+	// RewritePaths 替换请求路径的前缀，使用第一个匹配的规则
+	RewritePaths []pathRule `yaml:"rewritePaths"`
+}
+
+// headerRules 依次删除、设置与添加字段，字段名不区分大小写
+type headerRules struct {
+	// Remove 删除所有同名的字段
+	Remove []string `yaml:"remove"`
+	// Set 替换第一个同名字段的值并删除其他同名的字段，没有同名的字段时添加到最后
+	Set map[string]string `yaml:"set"`
+	// Add 添加字段，保留同名的字段
+	Add map[string]string `yaml:"add"`
+
+	remove [][]byte
+	set    []http1.Header
+	add    []http1.Header
+}
+
+// pathRule 将以 Prefix 开头的请求路径的前缀替换为 Replacement
+type pathRule struct {
+	Prefix      string `yaml:"prefix"`
+	Replacement string `yaml:"replacement"`
+}
+
+// init 校验并编译规则，host 不为空时设置请求的 Host，除非规则中已经设置了 Host
+func (r *httpRules) init(host string) (err error) {
+	if len(host) > 0 {
+		if r.RequestHeaders.Set == nil {
+			r.RequestHeaders.Set = make(map[string]string)
+		}
+		if _, ok := headerValue(r.RequestHeaders.Set, "Host"); !ok {
+			r.RequestHeaders.Set["Host"] = host
+		}
+	}
+	err = r.RequestHeaders.init()
+	if err != nil {
+		return fmt.Errorf("request headers %s", err.Error())
+	}
+	err = r.ResponseHeaders.init()
+	if err != nil {
+		return fmt.Errorf("response headers %s", err.Error())
+	}
+	for _, p := range r.RewritePaths {
+		if !strings.HasPrefix(p.Prefix, "/") || !strings.HasPrefix(p.Replacement, "/") ||
+			strings.ContainsAny(p.Prefix+p.Replacement, " \t\r\n") {
+			return fmt.Errorf("rewrite path '%s' to '%s' is invalid, both of them must begin with / and contain no spaces", p.Prefix, p.Replacement)
+		}
+	}
+	return
+}
+
+// empty 表示没有改写请求与响应的规则
+func (r *httpRules) empty() bool {
+	return r.RequestHeaders.empty() && r.ResponseHeaders.empty() && len(r.RewritePaths) == 0
+}
+
+// appendRequestLine 追加请求行，origin-form 的请求路径匹配规则时替换前缀
+func (r *httpRules) appendRequestLine(buf []byte, line []byte) []byte {
+	i := bytes.IndexByte(line, ' ')
+	j := bytes.LastIndexByte(line, ' ')
+	if i < 0 || i >= j {
+		return append(buf, line...)
+	}
+	target := line[i+1 : j]
+	for _, p := range r.RewritePaths {
+		if bytes.HasPrefix(target, []byte(p.Prefix)) {
+			buf = append(buf, line[:i+1]...)
+			buf = append(buf, p.Replacement...)
+			buf = append(buf, target[len(p.Prefix):]...)
+			return append(buf, line[j:]...)
+		}
+	}
+	return append(buf, line...)
+}
+
+func (h *headerRules) init() (err error) {
+	for _, name := range h.Remove {
+		err = checkHeader(name, "")
+		if err != nil {
+			return
+		}
+		h.remove = append(h.remove, []byte(name))
+	}
+	h.set, err = compileHeaders(h.Set)
+	if err != nil {
+		return
+	}
+	h.add, err = compileHeaders(h.Add)
+	return
+}
+
+func (h *headerRules) empty() bool {
+	return len(h.remove) == 0 && len(h.set) == 0 && len(h.add) == 0
+}
+
+// apply 将按照规则处理后的字段追加到 dst
+func (h *headerRules) apply(dst []http1.Header, headers []http1.Header) []http1.Header {
+	var done uint64
+	for _, f := range headers {
+		if h.removes(f.Name) {
+			continue
+		}
+		if i := h.setIndex(f.Name); i >= 0 {
+			if done&(1<<i) != 0 {
+				continue
+			}
+			done |= 1 << i
+			f.Value = h.set[i].Value
+		}
+		dst = append(dst, f)
+	}
+	for i, f := range h.set {
+		if done&(1<<i) == 0 {
+			dst = append(dst, f)
+		}
+	}
+	return append(dst, h.add...)
+}
+
+func (h *headerRules) removes(name []byte) bool {
+	for _, r := range h.remove {
+		if bytes.EqualFold(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *headerRules) setIndex(name []byte) int {
+	for i, f := range h.set {
+		if bytes.EqualFold(f.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// compileHeaders 按照字段名排序，使每个请求中添加的字段的顺序不变
+func compileHeaders(m map[string]string) (headers []http1.Header, err error) {
+	if len(m) > 64 {
+		return nil, errors.New("are too many, the max count is 64")
+	}
+	for name, value := range m {
+		err = checkHeader(name, value)
+		if err != nil {
+			return
+		}
+		headers = append(headers, http1.Header{Name: []byte(name), Value: []byte(value)})
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return bytes.Compare(headers[i].Name, headers[j].Name) < 0
+	})
+	return
+}
+
+// checkHeader 校验字段名与值，不允许改写决定消息长度的字段
+func checkHeader(name, value string) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("'%s: %s' is invalid", name, value)
+	}
+	if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+		return fmt.Errorf("'%s' can not be changed", name)
+	}
+	return nil
+}
+
+func headerValue(m map[string]string, name string) (value string, ok bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return
+}
+
+// methodQueue 按顺序记录转发的请求，用于判断对应的响应是否有 body 以及升级是否成功
+type methodQueue struct {
+	mtx      sync.Mutex
+	requests []queuedRequest
+}
+
+type queuedRequest struct {
+	method  string
+	upgrade bool
+}
+
+// push 只区分 HEAD 与 CONNECT，其他方法的响应按照响应头确定 body 的长度，upgrade 表示是否为升级请求
+func (q *methodQueue) push(method []byte, upgrade bool) {
+	r := queuedRequest{upgrade: upgrade}
+	switch string(method) {
+	case "HEAD":
+		r.method = "HEAD"
+	case "CONNECT":
+		r.method = "CONNECT"
+	}
+	q.mtx.Lock()
+	q.requests = append(q.requests, r)
+	q.mtx.Unlock()
+}
+
+// pop 返回最早的请求的方法以及是否为升级请求，没有记录时返回空字符串
+func (q *methodQueue) pop() (method string, upgrade bool) {
+	q.mtx.Lock()
+	if len(q.requests) > 0 {
+		method = q.requests[0].method
+		upgrade = q.requests[0].upgrade
+		q.requests = q.requests[1:]
+	}
+	q.mtx.Unlock()
+	return
+}
@@ -0,0 +1,27 @@
+package client
+
+import "testing"
+
+func TestHTTPRulesInit(t *testing.T) {
+	for _, rules := range []httpRules{
+		{RequestHeaders: headerRules{Set: map[string]string{"Content-Length": "1"}}},
+		{RequestHeaders: headerRules{Remove: []string{"Transfer-Encoding"}}},
+		{RequestHeaders: headerRules{Add: map[string]string{"X-Bad Name": "1"}}},
+		{ResponseHeaders: headerRules{Add: map[string]string{"X-Injected": "1\r\nSet-Cookie: a=1"}}},
+		{RewritePaths: []pathRule{{Prefix: "api", Replacement: "/"}}},
+	} {
+		err := rules.init("")
+		if err == nil {
+			t.Fatalf("invalid rules %+v are accepted", rules)
+		}
+	}
+
+	rules := httpRules{RequestHeaders: headerRules{Set: map[string]string{"host": "example.com"}}}
+	err := rules.init("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.RequestHeaders.set) != 1 || string(rules.RequestHeaders.set[0].Value) != "example.com" {
+		t.Fatalf("the host in rules is overwritten: %q", rules.RequestHeaders.set)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// scaleInterval 是检查 tunnel 负载的间隔
+const scaleInterval = time.Second
+
+// getMaxTunnels 返回 tunnel 的最大数量，服务端声明了限制时不超过服务端的限制
+func (c *Client) getMaxTunnels() uint {
+	max := c.config.RemoteMaxConnections
+	if m := atomic.LoadUint32(&c.maxTunnels); m > 0 && uint(m) < max {
+		max = uint(m)
+	}
+	return max
+}
+
+// scaleLoop 在 tunnel 的平均 task 数量或者写入延迟超过阈值时增加 tunnel，
+// 并关闭空闲超过 RemoteIdleTimeout 的额外 tunnel
+func (c *Client) scaleLoop() {
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+	idleSince := make(map[*conn]time.Time)
+	for range ticker.C {
+		if atomic.LoadUint32(&c.closing) == 1 {
+			return
+		}
+		now := time.Now()
+		c.tunnelsRWMtx.RLock()
+		tunnels := make(map[*conn]struct{}, len(c.tunnels))
+		for t := range c.tunnels {
+			tunnels[t] = struct{}{}
+		}
+		c.tunnelsRWMtx.RUnlock()
+
+		var tasks, writeNanos, writes uint64
+		for t := range tunnels {
+			tasks += uint64(t.GetTaskCount())
+			writeNanos += atomic.SwapUint64(&t.writeNanos, 0)
+			writes += atomic.SwapUint64(&t.writes, 0)
+		}
+		busy := tasks > uint64(len(tunnels))*uint64(c.config.RemoteTasksPerConnection)
+		if !busy && c.config.RemoteWriteLatency > 0 && writes > 0 {
+			busy = time.Duration(writeNanos/writes) > c.config.RemoteWriteLatency
+		}
+
+		// 负载高时新增的 tunnel 可能暂时没有 task，只在负载不高时关闭空闲的额外 tunnel
+		for t := range idleSince {
+			if _, ok := tunnels[t]; !ok || busy {
+				delete(idleSince, t)
+			}
+		}
+		for t := range tunnels {
+			if busy || !t.extra || t.IsClosing() {
+				continue
+			}
+			if t.GetTaskCount() > 0 {
+				delete(idleSince, t)
+				continue
+			}
+			since, ok := idleSince[t]
+			if !ok {
+				idleSince[t] = now
+				continue
+			}
+			if now.Sub(since) >= c.config.RemoteIdleTimeout {
+				delete(idleSince, t)
+				// 服务端可能已经向这个 tunnel 分配了 task，通知服务端不再分配 task 后，
+				// 等 task 都结束或者服务端回复关闭信号时再关闭
+				t.Logger.Info().Msg("closing idle extra tunnel")
+				t.Shutdown()
+				t.SendCloseSignal()
+			}
+		}
+
+		if !busy || len(tunnels) == 0 || now.UnixNano() < atomic.LoadInt64(&c.growAfter) {
+			continue
+		}
+		extra := atomic.LoadInt32(&c.extraTunnels)
+		if c.config.RemoteConnections+uint(extra) >= c.getMaxTunnels() {
+			continue
+		}
+		c.Logger.Info().Uint64("tasks", tasks).Int("tunnels", len(tunnels)).Msg("adding an extra tunnel")
+		atomic.AddInt32(&c.extraTunnels, 1)
+		go c.connectExtra()
+	}
+}
+
+// connectExtra 连接一个额外的 tunnel，tunnel 断开后不再重连。
+// tunnel 断开后 ReconnectDelay 之内不再增加 tunnel，避免反复连接
+func (c *Client) connectExtra() {
+	defer func() {
+		atomic.StoreInt64(&c.growAfter, time.Now().Add(c.config.ReconnectDelay).UnixNano())
+		atomic.AddInt32(&c.extraTunnels, -1)
+	}()
+	r, wait := c.remotes.next()
+	if wait > 0 {
+		return
+	}
+	d, _ := r.getDialer()
+	if len(d.host) == 0 {
+		// remoteAPI 还没有查询过服务端地址
+		return
+	}
+	conn, err := c.initConn(d, r.version())
+	if err != nil {
+		c.Logger.Error().Err(err).Str("remote", d.host).Msg("failed to connect the extra tunnel")
+		return
+	}
+	conn.extra = true
+	conn.readLoop()
+}
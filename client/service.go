@@ -0,0 +1,270 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// service is a local service that shares the tunnels of the client.
+type service struct {
+	Local              string        `yaml:"local"`
+	UseLocalAsHTTPHost bool          `yaml:"useLocalAsHTTPHost"`
+	LocalHTTP2         bool          `yaml:"localHTTP2"`
+	LocalTimeout       time.Duration `yaml:"localTimeout"`
+	RemoteTCPPort      uint16        `yaml:"remoteTCPPort"`
+	RemoteUDPPort      uint16        `yaml:"remoteUDPPort"`
+	Subdomain          string        `yaml:"subdomain"`
+	PathPrefix         string        `yaml:"pathPrefix"`
+	HeaderName         string        `yaml:"headerName"`
+	HeaderValue        string        `yaml:"headerValue"`
+
+	LocalHealthCheckPath     string        `yaml:"localHealthCheckPath"`
+	LocalHealthCheckInterval time.Duration `yaml:"localHealthCheckInterval"`
+
+	LocalForwardedHeaders string `yaml:"localForwardedHeaders"`
+	LocalProxyProtocol    string `yaml:"localProxyProtocol"`
+
+	HTTPRules httpRules `yaml:"httpRules"`
+
+	index      uint16
+	typ        predef.ServiceType
+	localURL   *url.URL
+	remotePort uint32
+	// unhealthy 为 1 表示健康检查失败
+	unhealthy uint32
+	// forwarded 是添加到请求中的访问者地址的请求头
+	forwarded int
+	// rules 是编译后的 HTTPRules，没有规则时为 nil
+	rules *httpRules
+}
+
+// init 校验服务的配置，并解析 local url
+func (s *service) init(index int, defaultTimeout time.Duration) (err error) {
+	s.index = uint16(index)
+	s.localURL, err = url.Parse(s.Local)
+	if err != nil {
+		err = fmt.Errorf("local url '%s' of service %d is invalid, cause %s", s.Local, index, err.Error())
+		return
+	}
+	switch s.localURL.Scheme {
+	case "http", "https":
+		s.typ = predef.ServiceHTTP
+	case "tcp":
+		s.typ = predef.ServiceTCP
+	case "udp":
+		s.typ = predef.ServiceUDP
+	default:
+		err = fmt.Errorf("local url '%s' of service %d must begin with http://, https://, tcp:// or udp://", s.Local, index)
+		return
+	}
+	if s.typ != predef.ServiceHTTP && (len(s.Subdomain) > 0 || len(s.PathPrefix) > 0 || len(s.HeaderName) > 0) {
+		err = fmt.Errorf("routing rules of service %d are only available for http services", index)
+		return
+	}
+	for _, value := range []string{s.Subdomain, s.PathPrefix, s.HeaderName, s.HeaderValue} {
+		if len(value) > 255 {
+			err = fmt.Errorf("routing rule '%s' of service %d is too long", value, index)
+			return
+		}
+	}
+	if strings.ContainsAny(s.Subdomain, ".:") {
+		err = fmt.Errorf("subdomain '%s' of service %d is invalid", s.Subdomain, index)
+		return
+	}
+	if s.LocalTimeout == 0 {
+		s.LocalTimeout = defaultTimeout
+	}
+	return
+}
+
+// initLocalProtocols 校验本地服务的 HTTP/2、访问者地址等协议相关的配置
+func (s *service) initLocalProtocols() (err error) {
+	if s.LocalHTTP2 && s.localURL.Scheme != "http" {
+		err = fmt.Errorf("HTTP/2 of service %d is only available for http:// local services", s.index)
+		return
+	}
+	var ok bool
+	s.forwarded, ok = parseForwardedHeaders(s.LocalForwardedHeaders)
+	if !ok {
+		err = fmt.Errorf("forwarded headers '%s' of service %d are invalid, supported values: x-forwarded, forwarded", s.LocalForwardedHeaders, s.index)
+		return
+	}
+	if s.forwarded != 0 && s.localURL.Scheme != "http" {
+		err = fmt.Errorf("forwarded headers of service %d are only available for http:// local services", s.index)
+		return
+	}
+	switch s.LocalProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		err = fmt.Errorf("PROXY protocol '%s' of service %d must be v1 or v2", s.LocalProxyProtocol, s.index)
+		return
+	}
+	if len(s.LocalProxyProtocol) > 0 && s.typ == predef.ServiceUDP {
+		err = fmt.Errorf("PROXY protocol of service %d is not available for udp services", s.index)
+	}
+	return
+}
+
+// initHTTPRules 编译改写 http 请求与响应的规则，useLocalAsHTTPHost 是设置 Host 的规则
+func (s *service) initHTTPRules() (err error) {
+	var host string
+	if s.localURL.Scheme == "http" && s.UseLocalAsHTTPHost {
+		host = s.localURL.Host
+	}
+	err = s.HTTPRules.init(host)
+	if err != nil {
+		err = fmt.Errorf("http rules of service %d are invalid, cause %s", s.index, err.Error())
+		return
+	}
+	if s.HTTPRules.empty() {
+		return
+	}
+	if s.localURL.Scheme != "http" {
+		err = fmt.Errorf("http rules of service %d are only available for http:// local services", s.index)
+		return
+	}
+	s.rules = &s.HTTPRules
+	return
+}
+
+// initHealthCheck 校验服务的健康检查配置
+func (s *service) initHealthCheck(defaultInterval time.Duration) (err error) {
+	if s.LocalHealthCheckInterval == 0 {
+		s.LocalHealthCheckInterval = defaultInterval
+	}
+	if s.typ == predef.ServiceUDP && s.LocalHealthCheckInterval > 0 {
+		err = fmt.Errorf("health checks of service %d are not available for udp services", s.index)
+		return
+	}
+	if len(s.LocalHealthCheckPath) > 0 && (s.typ != predef.ServiceHTTP || !strings.HasPrefix(s.LocalHealthCheckPath, "/")) {
+		err = fmt.Errorf("health check path '%s' of service %d must begin with / and is only available for http services", s.LocalHealthCheckPath, s.index)
+	}
+	return
+}
+
+func (s *service) remotePortOption() uint16 {
+	switch s.typ {
+	case predef.ServiceTCP:
+		return s.RemoteTCPPort
+	case predef.ServiceUDP:
+		return s.RemoteUDPPort
+	}
+	return 0
+}
+
+func (s *service) getRemotePort() uint16 {
+	return uint16(atomic.LoadUint32(&s.remotePort))
+}
+
+func (s *service) setRemotePort(port uint16) {
+	atomic.StoreUint32(&s.remotePort, uint32(port))
+}
+
+// initServices 初始化客户端的服务，没有配置 services 时使用 -local 等选项作为唯一的服务
+func (c *Client) initServices() (err error) {
+	if len(c.config.Services) == 0 {
+		s := &service{
+			Local:              c.config.Local,
+			UseLocalAsHTTPHost: c.config.UseLocalAsHTTPHost,
+			LocalHTTP2:         c.config.LocalHTTP2,
+			LocalTimeout:       c.config.LocalTimeout,
+			RemoteTCPPort:      c.config.RemoteTCPPort,
+			RemoteUDPPort:      c.config.RemoteUDPPort,
+
+			LocalHealthCheckPath: c.config.LocalHealthCheckPath,
+
+			LocalForwardedHeaders: c.config.LocalForwardedHeaders,
+			LocalProxyProtocol:    c.config.LocalProxyProtocol,
+		}
+		err = s.init(0, c.config.LocalTimeout)
+		if err != nil {
+			err = fmt.Errorf("option -local is invalid, cause %s", err.Error())
+			return
+		}
+		err = s.initLocalProtocols()
+		if err != nil {
+			return
+		}
+		err = s.initHTTPRules()
+		if err != nil {
+			return
+		}
+		err = s.initHealthCheck(c.config.LocalHealthCheckInterval)
+		if err != nil {
+			return
+		}
+		c.services = []*service{s}
+		return
+	}
+	if len(c.config.Services) > predef.MaxServices {
+		err = fmt.Errorf("too many services, the max count of services is %d", predef.MaxServices)
+		return
+	}
+	services := make([]*service, len(c.config.Services))
+	for i := range c.config.Services {
+		s := c.config.Services[i]
+		err = s.init(i, c.config.LocalTimeout)
+		if err != nil {
+			return
+		}
+		err = s.initLocalProtocols()
+		if err != nil {
+			return
+		}
+		err = s.initHTTPRules()
+		if err != nil {
+			return
+		}
+		err = s.initHealthCheck(c.config.LocalHealthCheckInterval)
+		if err != nil {
+			return
+		}
+		services[i] = &s
+	}
+	c.services = services
+	c.withServices = true
+	return
+}
+
+func (c *Client) getService(index uint16) (s *service, err error) {
+	if int(index) >= len(c.services) {
+		err = fmt.Errorf("service %d does not exist", index)
+		return
+	}
+	s = c.services[index]
+	return
+}
+
+func (c *Client) getRemotePort(typ predef.ServiceType) uint16 {
+	for _, s := range c.services {
+		if s.typ == typ {
+			return s.getRemotePort()
+		}
+	}
+	return 0
+}
+
+// withVisitorAddrs 表示是否有服务需要访问者的地址
+func (c *Client) withVisitorAddrs() bool {
+	for _, s := range c.services {
+		if s.forwarded != 0 || len(s.LocalProxyProtocol) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withHTTP2Services 表示是否有服务支持 h2c
+func (c *Client) withHTTP2Services() bool {
+	for _, s := range c.services {
+		if s.LocalHTTP2 {
+			return true
+		}
+	}
+	return false
+}
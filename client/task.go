@@ -1,9 +1,9 @@
 package client
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
+	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/pool"
 	"github.com/isrc-cas/gt/predef"
 	"github.com/rs/zerolog"
@@ -13,205 +13,88 @@ import (
 	"time"
 )
 
-var (
-	// ErrHostIsTooLong is an error returned when host is too long
-	ErrHostIsTooLong = errors.New("host is too long")
-
-	host = []byte("Host:")
-)
-
 type httpTask struct {
-	conn     net.Conn
-	buf      []byte
-	tempBuf  *bytes.Buffer
-	Logger   zerolog.Logger
-	skipping bool
-	passing  bool
-	closing  uint32
+	conn       net.Conn
+	service    *service
+	sendWindow *connection.SendWindow
+	recvBuffer *connection.ReceiveBuffer
+	// requests 改写写入本地服务的请求，为 nil 时直接写入
+	requests *requestWriter
+	// responses 改写从本地服务读取的响应，为 nil 时直接读取
+	responses *responseReader
+	Logger    zerolog.Logger
+	closing   uint32
 }
 
-func newHTTPTask(c net.Conn) (t *httpTask) {
-	t = &httpTask{
-		conn: c,
-		buf:  pool.BytesPool.Get().([]byte),
+// newHTTPTask 创建 task，flowControl 为 false 时 sendWindow 与 recvBuffer 为 nil，数据直接写入本地服务
+func newHTTPTask(c net.Conn, flowControl bool) (t *httpTask) {
+	t = &httpTask{conn: c}
+	if flowControl {
+		t.sendWindow = connection.NewSendWindow(connection.DefaultWindowSize)
+		t.recvBuffer = connection.NewReceiveBuffer(connection.DefaultWindowSize)
 	}
 	return
 }
 
-func (t *httpTask) setHost(host string) (err error) {
-	if len(host) > 200 {
-		return ErrHostIsTooLong
+// setHTTPRules 改写 http 请求与响应，forwarded 不为 nil 时在请求中添加访问者的地址。
+// 响应总是需要解析，升级请求成功之后才不再解析请求
+func (t *httpTask) setHTTPRules(rules *httpRules, forwarded *forwardedHeaders) {
+	methods := &methodQueue{}
+	t.requests = newRequestWriter(writerFunc(t.write), rules, forwarded, methods)
+	t.requests.http2 = t.service.LocalHTTP2
+	responseRules := &headerRules{}
+	if rules != nil {
+		responseRules = &rules.ResponseHeaders
 	}
-	n := copy(t.buf, "Host: ")
-	n += copy(t.buf[n:], host)
-	n += copy(t.buf[n:], "\r\n")
-	t.tempBuf = bytes.NewBuffer(t.buf[n:][:0])
-	t.buf = t.buf[:n]
-	return
+	t.responses = newResponseReader(t.conn, responseRules, methods)
+	t.responses.messages.rawWithoutPrefix = t.service.LocalHTTP2
+	t.responses.requests = t.requests
 }
 
 func (t *httpTask) Write(p []byte) (n int, err error) {
-	if t.tempBuf == nil {
-		return t.conn.Write(p)
-	} else if t.skipping {
-		i := bytes.IndexByte(p, '\n')
-		if i < 0 {
-			return len(p), nil
-		}
-		t.skipping = false
-		t.tempBuf = nil
-		if len(p) <= i+1 {
-			return len(p), nil
-		}
-		if predef.Debug {
-			t.Logger.Debug().Bytes("data", p[i+1:]).Msg("write")
-		}
-		n, err = t.conn.Write(p[i+1:])
-		n += i + 1
-		return
-	} else if t.passing {
-		i := bytes.IndexByte(p, '\n')
-		if i < 0 {
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", p).Msg("write")
-			}
-			return t.conn.Write(p)
-		}
-		t.passing = false
-		if predef.Debug {
-			t.Logger.Debug().Bytes("data", p[:i+1]).Msg("write")
-		}
-		n, err = t.conn.Write(p[:i+1])
-		if err != nil {
-			return
-		}
-		p = p[i+1:]
-		if len(p) <= 0 {
-			return
-		}
+	if t.requests != nil {
+		return t.requests.Write(p)
 	}
+	return t.write(p)
+}
 
-	var nw int
-	var updated bool
-	if t.tempBuf != nil {
-		if len(p)+t.tempBuf.Len() < 5 {
-			nw, err = t.tempBuf.Write(p)
-			n += nw
-			return
-		}
-
-		if t.tempBuf.Len() > 0 {
-			nw, err = t.tempBuf.Write(p)
-			n += nw
-			if err != nil {
-				return
-			}
-			p = t.tempBuf.Bytes()
-			t.tempBuf.Reset()
-			updated = true
-		}
+func (t *httpTask) write(p []byte) (n int, err error) {
+	if predef.Debug {
+		t.Logger.Debug().Bytes("data", p).Msg("write")
 	}
-
-	s := 0
-	for len(p[s:]) >= 1 {
-		switch t.isGoodToWrite(p[s:]) {
-		case good:
-			i := bytes.IndexByte(p[s:], '\n')
-			if i < 0 {
-				t.passing = true
-				if predef.Debug {
-					t.Logger.Debug().Bytes("data", p[s:]).Msg("write")
-				}
-				nw, err = t.conn.Write(p[s:])
-				if !updated {
-					n += nw
-				}
-				return
-			}
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", p[s:s+i+1]).Msg("write")
-			}
-			nw, err = t.conn.Write(p[s : s+i+1])
-			if !updated {
-				n += nw
-			}
-			if err != nil {
-				return
-			}
-			s += i + 1
-		case unsure:
-			nw, err = t.tempBuf.Write(p[s:])
-			if !updated {
-				n += nw
-			}
-			return
-		case replace:
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", t.buf).Msg("write")
-			}
-			_, err = t.conn.Write(t.buf)
-			t.buf = t.buf[:cap(t.buf)]
-			if err != nil {
-				return
-			}
-			i := bytes.IndexByte(p[s:], '\n')
-			if i < 0 {
-				t.skipping = true
-				nw = len(p[s:])
-				if !updated {
-					n += nw
-				}
-				return
-			}
-			s += i + 1
-			if !updated {
-				n += i + 1
-			}
-			t.tempBuf = nil
-			if len(p[s:]) > 0 {
-				if predef.Debug {
-					t.Logger.Debug().Bytes("data", p[s:]).Msg("write")
-				}
-				nw, err = t.conn.Write(p[s:])
-				if !updated {
-					n += nw
-				}
-			}
-			return
-		}
-	}
-	return
+	return t.conn.Write(p)
 }
 
-const (
-	good = iota
-	unsure
-	replace
-)
-
-func (t *httpTask) isGoodToWrite(p []byte) int {
-	l := len(p)
-	if l > 5 {
-		l = 5
+func (t *httpTask) read(p []byte) (n int, err error) {
+	if t.responses != nil {
+		return t.responses.Read(p)
 	}
-	if bytes.Equal(p[:l], host[:l]) {
-		if l < 5 {
-			return unsure
-		}
-		return replace
-	}
-	return good
+	return t.conn.Read(p)
 }
 
 func (t *httpTask) Close() {
 	if !atomic.CompareAndSwapUint32(&t.closing, 0, 1) {
 		return
 	}
-	pool.BytesPool.Put(t.buf[:cap(t.buf)])
+	if t.sendWindow != nil {
+		t.sendWindow.Close()
+		t.recvBuffer.Close()
+	}
 	err := t.conn.Close()
 	t.Logger.Info().Err(err).Msg("task closed")
 }
 
+// writeLoop 将缓存的数据写入本地服务，并通知服务端更新窗口
+func (t *httpTask) writeLoop(id uint32, c *conn) {
+	err := t.recvBuffer.WriteTo(t, func(n uint32) error {
+		return c.SendWindowUpdate(id, n)
+	})
+	if err != nil {
+		t.Logger.Debug().Err(err).Msg("writeLoop ended")
+	}
+	t.Close()
+}
+
 func (t *httpTask) process(id uint32, c *conn) {
 	atomic.AddUint32(&c.TasksCount, 1)
 	var rErr error
@@ -244,15 +127,25 @@ func (t *httpTask) process(id uint32, c *conn) {
 	for {
 		binary.BigEndian.PutUint32(buf[0:], id)
 		binary.BigEndian.PutUint16(buf[4:], predef.Data)
-		if c.client.config.LocalTimeout > 0 {
-			dl := time.Now().Add(c.client.config.LocalTimeout)
+		if t.service.LocalTimeout > 0 {
+			dl := time.Now().Add(t.service.LocalTimeout)
 			rErr = t.conn.SetReadDeadline(dl)
 			if rErr != nil {
 				return
 			}
 		}
+		n := len(buf) - 10
+		if t.sendWindow != nil {
+			n, rErr = t.sendWindow.Available(n)
+			if rErr != nil {
+				return
+			}
+		}
 		var l int
-		l, rErr = t.conn.Read(buf[10:])
+		l, rErr = t.read(buf[10 : 10+n])
+		if t.sendWindow != nil {
+			t.sendWindow.Consume(l)
+		}
 		if l > 0 {
 			binary.BigEndian.PutUint32(buf[6:], uint32(l))
 			l += 10
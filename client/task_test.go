@@ -54,7 +54,9 @@ func Test_task_Write(t1 *testing.T) {
 	data := []byte("GET / HTTP/1.1\r\n" +
 		"Host: www.baidu.com\r\n" +
 		"User-Agent: curl/7.64.1\r\n" +
-		"Accept: */*")
+		"Accept: */*\r\n\r\n" +
+		"GET /keep-alive HTTP/1.1\r\n" +
+		"Host: www.baidu.com\r\n\r\n")
 	tests := []struct {
 		name    string
 		fields  fields
@@ -74,7 +76,9 @@ func Test_task_Write(t1 *testing.T) {
 			result: []byte("GET / HTTP/1.1\r\n" +
 				"Host: localhost\r\n" +
 				"User-Agent: curl/7.64.1\r\n" +
-				"Accept: */*"),
+				"Accept: */*\r\n\r\n" +
+				"GET /keep-alive HTTP/1.1\r\n" +
+				"Host: localhost\r\n\r\n"),
 		},
 	}
 	for _, tt := range tests {
@@ -83,11 +87,14 @@ func Test_task_Write(t1 *testing.T) {
 			for i := 1; i <= len(tt.args.p); i++ {
 				var err error
 				buffer := bytes.NewBuffer(nil)
-				t := newHTTPTask(&fakeConn{buffer})
-				err = t.setHost(tt.fields.host)
+				t := newHTTPTask(&fakeConn{buffer}, true)
+				t.service = &service{}
+				rules := &httpRules{}
+				err = rules.init(tt.fields.host)
 				if err != nil {
 					t1.Fatal(err)
 				}
+				t.setHTTPRules(rules, nil)
 				buf := make([]byte, i)
 				in := bytes.NewReader(tt.args.p)
 				for {
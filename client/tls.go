@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+// parseCertPins 解析 base64 编码的证书 SPKI 的 SHA-256 哈希
+func parseCertPins(pins []string) (result [][]byte, err error) {
+	for _, pin := range pins {
+		var hash []byte
+		hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+		if err != nil || len(hash) != sha256.Size {
+			err = fmt.Errorf("remote cert pin (-remoteCertPin option) '%s' is not a base64 encoded SHA-256 hash", pin)
+			return
+		}
+		result = append(result, hash)
+	}
+	return
+}
+
+// pinCerts 使用 pins 验证服务器证书。roots 不为 nil 时先使用 serverName 验证证书链与域名，
+// 否则只验证服务器证书的公钥，允许使用自签名证书
+func pinCerts(tlsConfig *tls.Config, pins [][]byte, roots *x509.CertPool, serverName string) {
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("no remote cert")
+		}
+		leaf := state.PeerCertificates[0]
+		if roots != nil {
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       serverName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := leaf.Verify(opts); err != nil {
+				return err
+			}
+		}
+		hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, hash[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("remote cert pin 'sha256//%s' does not match any of the pins", base64.StdEncoding.EncodeToString(hash[:]))
+	}
+}
+
+// newTLSConfig 创建连接服务端 u 的 tls 配置
+func (c *Client) newTLSConfig(u *url.URL) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{
+		PreferServerCipherSuites: true,
+	}
+	if len(c.config.RemoteCert) > 0 {
+		var cf []byte
+		cf, err = ioutil.ReadFile(c.config.RemoteCert)
+		if err != nil {
+			err = fmt.Errorf("failed to read remote cert file (-remoteCert option) '%s', cause %s", c.config.RemoteCert, err.Error())
+			return
+		}
+		roots := x509.NewCertPool()
+		ok := roots.AppendCertsFromPEM(cf)
+		if !ok {
+			err = fmt.Errorf("failed to parse remote cert file (-remoteCert option) '%s'", c.config.RemoteCert)
+			return
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if len(c.config.RemoteServerName) > 0 {
+		tlsConfig.ServerName = c.config.RemoteServerName
+	}
+	if len(c.config.RemoteCertPin) > 0 {
+		var pins [][]byte
+		pins, err = parseCertPins(c.config.RemoteCertPin)
+		if err != nil {
+			return
+		}
+		serverName := tlsConfig.ServerName
+		if len(serverName) == 0 {
+			serverName = u.Hostname()
+		}
+		pinCerts(tlsConfig, pins, tlsConfig.RootCAs, serverName)
+	} else if c.config.RemoteCertInsecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+		// 服务端只向声明了 predef.TLSTunnelProto 的连接请求客户端证书，http/1.1 兼容没有该协议的服务端
+		tlsConfig.NextProtos = []string{predef.TLSTunnelProto, "http/1.1"}
+	}
+	return
+}
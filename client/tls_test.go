@@ -0,0 +1,25 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseCertPins(t *testing.T) {
+	hash := sha256.Sum256([]byte("spki"))
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	pins, err := parseCertPins([]string{pin, "sha256//" + pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || !bytes.Equal(pins[0], hash[:]) || !bytes.Equal(pins[1], hash[:]) {
+		t.Fatalf("unexpected pins %v", pins)
+	}
+	for _, invalid := range []string{"", "not base64", base64.StdEncoding.EncodeToString(hash[:16])} {
+		if _, err := parseCertPins([]string{invalid}); err == nil {
+			t.Fatalf("pin '%s' should be invalid", invalid)
+		}
+	}
+}
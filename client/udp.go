@@ -0,0 +1,34 @@
+package client
+
+import (
+	"net"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+// udpConn 将本地 udp 服务的包转换为带长度前缀的数据流，保留包的边界
+type udpConn struct {
+	net.Conn
+	reader connection.PacketReader
+	writer connection.PacketWriter
+}
+
+func newUDPConn(c net.Conn) *udpConn {
+	uc := &udpConn{
+		Conn: c,
+	}
+	uc.reader.ReadPacket = c.Read
+	uc.writer.WritePacket = func(p []byte) (err error) {
+		_, err = c.Write(p)
+		return
+	}
+	return uc
+}
+
+func (c *udpConn) Read(p []byte) (n int, err error) {
+	return c.reader.Read(p)
+}
+
+func (c *udpConn) Write(p []byte) (n int, err error) {
+	return c.writer.Write(p)
+}
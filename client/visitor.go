@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/http1"
+)
+
+// 告诉本地服务访问者地址的请求头
+const (
+	// forwardedX 表示 X-Forwarded-For、X-Forwarded-Proto 与 X-Real-IP
+	forwardedX = 1 << iota
+	// forwardedRFC7239 表示 RFC 7239 的 Forwarded
+	forwardedRFC7239
+)
+
+// proxyV2Signature 是 PROXY protocol v2 头部的签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseForwardedHeaders 解析以逗号分隔的 localForwardedHeaders，有不支持的值时 ok 为 false
+func parseForwardedHeaders(value string) (kinds int, ok bool) {
+	for _, v := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "":
+		case "x-forwarded":
+			kinds |= forwardedX
+		case "forwarded":
+			kinds |= forwardedRFC7239
+		default:
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// parseVisitorAddr 解析访问者的地址，IPv4-mapped IPv6 地址转换为 IPv4 地址，并去掉 IPv6 的 zone
+func parseVisitorAddr(addr string) (ap netip.AddrPort, err error) {
+	ap, err = netip.ParseAddrPort(addr)
+	if err != nil {
+		return
+	}
+	ap = netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port())
+	return
+}
+
+// appendProxyHeader 追加 PROXY protocol 的头部，源地址是访问者的地址，目标地址是访问者连接的服务端地址。
+// 无法解析访问者的地址时，v1 使用 UNKNOWN，v2 使用 LOCAL
+func appendProxyHeader(buf []byte, version string, v *connection.Visitor) []byte {
+	var src, dst netip.AddrPort
+	ok := v != nil
+	if ok {
+		var err1, err2 error
+		src, err1 = parseVisitorAddr(v.RemoteAddr)
+		dst, err2 = parseVisitorAddr(v.LocalAddr)
+		ok = err1 == nil && err2 == nil
+	}
+	if ok && src.Addr().Is4() != dst.Addr().Is4() {
+		// 地址族不同时都使用 IPv6 地址
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	if version == "v1" {
+		if !ok {
+			return append(buf, "PROXY UNKNOWN\r\n"...)
+		}
+		family := "TCP4"
+		if !src.Addr().Is4() {
+			family = "TCP6"
+		}
+		return fmt.Appendf(buf, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	}
+	buf = append(buf, proxyV2Signature...)
+	if !ok {
+		return append(buf, 0x20, 0x00, 0x00, 0x00)
+	}
+	if src.Addr().Is4() {
+		buf = append(buf, 0x21, 0x11, 0x00, 12)
+	} else {
+		buf = append(buf, 0x21, 0x21, 0x00, 36)
+	}
+	buf = append(buf, src.Addr().AsSlice()...)
+	buf = append(buf, dst.Addr().AsSlice()...)
+	buf = binary.BigEndian.AppendUint16(buf, src.Port())
+	buf = binary.BigEndian.AppendUint16(buf, dst.Port())
+	return buf
+}
+
+// forwardedHeaders 是添加到每个请求中的访问者地址
+type forwardedHeaders struct {
+	kinds int
+	ip    string
+	proto string
+	// node 是 Forwarded 中 for 参数的值，IPv6 地址需要使用引号与方括号
+	node string
+}
+
+func newForwardedHeaders(kinds int, v *connection.Visitor) *forwardedHeaders {
+	f := &forwardedHeaders{kinds: kinds, proto: "http", ip: "unknown", node: "unknown"}
+	if v.TLS {
+		f.proto = "https"
+	}
+	if ap, err := parseVisitorAddr(v.RemoteAddr); err == nil {
+		f.ip = ap.Addr().String()
+		f.node = f.ip
+		if ap.Addr().Is6() {
+			f.node = strconv.Quote("[" + f.ip + "]")
+		}
+	} else if host, _, err := net.SplitHostPort(v.RemoteAddr); err == nil {
+		f.ip = host
+	}
+	return f
+}
+
+// appendHeaders 追加请求头与访问者的地址。X-Forwarded-For 与 Forwarded 在原有的值之后追加访问者的地址，
+// X-Forwarded-Proto 与 X-Real-IP 替换访问者提供的值
+func (f *forwardedHeaders) appendHeaders(buf []byte, headers []http1.Header) []byte {
+	var xff, forwarded [][]byte
+	for _, h := range headers {
+		if f.kinds&forwardedX != 0 {
+			switch {
+			case bytes.EqualFold(h.Name, []byte("X-Forwarded-For")):
+				xff = append(xff, h.Value)
+				continue
+			case bytes.EqualFold(h.Name, []byte("X-Forwarded-Proto")), bytes.EqualFold(h.Name, []byte("X-Real-IP")):
+				continue
+			}
+		}
+		if f.kinds&forwardedRFC7239 != 0 && bytes.EqualFold(h.Name, []byte("Forwarded")) {
+			forwarded = append(forwarded, h.Value)
+			continue
+		}
+		buf = appendHeader(buf, h.Name, h.Value)
+	}
+	if f.kinds&forwardedX != 0 {
+		xff = append(xff, []byte(f.ip))
+		buf = appendHeader(buf, []byte("X-Forwarded-For"), bytes.Join(xff, []byte(", ")))
+		buf = appendHeader(buf, []byte("X-Forwarded-Proto"), []byte(f.proto))
+		buf = appendHeader(buf, []byte("X-Real-IP"), []byte(f.ip))
+	}
+	if f.kinds&forwardedRFC7239 != 0 {
+		forwarded = append(forwarded, []byte("for="+f.node+";proto="+f.proto))
+		buf = appendHeader(buf, []byte("Forwarded"), bytes.Join(forwarded, []byte(", ")))
+	}
+	return buf
+}
+
+func appendHeader(buf []byte, name, value []byte) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, ": "...)
+	buf = append(buf, value...)
+	return append(buf, "\r\n"...)
+}
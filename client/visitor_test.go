@@ -0,0 +1,43 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+func TestAppendProxyHeader(t *testing.T) {
+	v4 := &connection.Visitor{RemoteAddr: "1.2.3.4:5678", LocalAddr: "10.0.0.1:443"}
+	v6 := &connection.Visitor{RemoteAddr: "[2001:db8::1]:5678", LocalAddr: "[::ffff:10.0.0.1]:443"}
+	pipe := &connection.Visitor{RemoteAddr: "pipe", LocalAddr: "pipe"}
+	tests := []struct {
+		version  string
+		visitor  *connection.Visitor
+		expected []byte
+	}{
+		{"v1", v4, []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 443\r\n")},
+		{"v1", v6, []byte("PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 5678 443\r\n")},
+		{"v1", pipe, []byte("PROXY UNKNOWN\r\n")},
+		{"v1", nil, []byte("PROXY UNKNOWN\r\n")},
+		{"v2", v4, append(append([]byte(nil), proxyV2Signature...),
+			0x21, 0x11, 0x00, 12,
+			1, 2, 3, 4,
+			10, 0, 0, 1,
+			0x16, 0x2E,
+			0x01, 0xBB)},
+		{"v2", v6, append(append([]byte(nil), proxyV2Signature...),
+			0x21, 0x21, 0x00, 36,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1,
+			0x16, 0x2E,
+			0x01, 0xBB)},
+		{"v2", nil, append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)},
+	}
+	for _, tt := range tests {
+		header := appendProxyHeader(nil, tt.version, tt.visitor)
+		if !bytes.Equal(header, tt.expected) {
+			t.Errorf("%s %+v: %q is not expected %q", tt.version, tt.visitor, header, tt.expected)
+		}
+	}
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
 	"github.com/isrc-cas/gt/server"
 	"github.com/rs/zerolog/log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-secret" {
+		hashSecret(os.Args[2:])
+		return
+	}
+
 	s, err := server.New(os.Args)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create server")
@@ -22,8 +31,55 @@ func main() {
 	osSig := make(chan os.Signal, 1)
 	signal.Notify(osSig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 
-	select {
-	case sig := <-osSig:
+	for sig := range osSig {
 		s.Logger.Info().Str("signal", sig.String()).Msg("received os signal")
+		if sig == syscall.SIGHUP {
+			err = s.ReloadUsers()
+			if err != nil {
+				s.Logger.Error().Err(err).Msg("failed to reload users")
+			}
+			err = s.ReloadCerts()
+			if err != nil {
+				s.Logger.Error().Err(err).Msg("failed to reload certs")
+			}
+			continue
+		}
+		return
+	}
+}
+
+// hashSecret 输出 secret 的哈希值，可以直接作为 users 配置中的 secret 使用
+func hashSecret(args []string) {
+	flagSet := flag.NewFlagSet("hash-secret", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s hash-secret [-algorithm bcrypt|argon2id|scrypt] [secret]\n", os.Args[0])
+		fmt.Fprintln(flagSet.Output(), "The secret is read from stdin if it is not specified.")
+		flagSet.PrintDefaults()
+	}
+	algorithm := flagSet.String("algorithm", server.HashBcrypt, "The hash algorithm, supported values: bcrypt, argon2id, scrypt")
+	_ = flagSet.Parse(args)
+
+	var secret string
+	switch flagSet.NArg() {
+	case 0:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatal().Err(err).Msg("failed to read secret from stdin")
+		}
+		secret = strings.TrimRight(line, "\r\n")
+	case 1:
+		secret = flagSet.Arg(0)
+	default:
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	if secret == "" {
+		log.Fatal().Msg("secret is empty")
+	}
+
+	hash, err := server.HashSecret(*algorithm, secret)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to hash secret")
 	}
+	fmt.Println(hash)
 }
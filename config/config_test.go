@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
@@ -108,3 +109,27 @@ func TestParseFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestStringSliceUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want StringSlice
+	}{
+		{"scalar", "remote: tcp://localhost:80", StringSlice{"tcp://localhost:80"}},
+		{"sequence", "remote:\n  - tcp://localhost:80\n  - tls://localhost:443", StringSlice{"tcp://localhost:80", "tls://localhost:443"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v struct {
+				Remote StringSlice `yaml:"remote"`
+			}
+			if err := yaml.Unmarshal([]byte(tt.yaml), &v); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v.Remote, tt.want) {
+				t.Errorf("UnmarshalYAML() got = %#v, want %#v", v.Remote, tt.want)
+			}
+		})
+	}
+}
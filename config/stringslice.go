@@ -1,6 +1,10 @@
 package config
 
-import "strings"
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
 
 // StringSlice 字符串切片，用于命令行数组解析
 type StringSlice []string
@@ -25,3 +29,18 @@ func (ss *StringSlice) Set(value string) error {
 func (ss *StringSlice) Get() interface{} {
 	return []string(*ss)
 }
+
+// UnmarshalYAML yaml.Unmarshaler 接口，兼容单个字符串的写法
+func (ss *StringSlice) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*ss = StringSlice{value.Value}
+		return nil
+	}
+	var s []string
+	err := value.Decode(&s)
+	if err != nil {
+		return err
+	}
+	*ss = s
+	return nil
+}
@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/isrc-cas/gt/bufio"
 	"github.com/isrc-cas/gt/predef"
@@ -95,6 +96,8 @@ const (
 	ReadySignal
 	// ErrorSignal is a signal used for errors
 	ErrorSignal
+	// InfoSignal is a signal used for information
+	InfoSignal
 
 	// PreservedSignal is a signal used for preserved signals
 	PreservedSignal Signal = math.MaxUint32 - 3000
@@ -105,6 +108,10 @@ var (
 	closeBytes                 = []byte{0xFF, 0xFF, 0xFF, 0xFE}
 	readyBytes                 = []byte{0xFF, 0xFF, 0xFF, 0xFD}
 	errInvalidIDAndSecretBytes = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x01}
+	errFailedToOpenTCPPort     = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x02}
+	errFailedToOpenUDPPort     = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x03}
+	errServicesMismatch        = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x04}
+	errTooManyTunnels          = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x05}
 )
 
 // Error represents a specific error signal
@@ -114,6 +121,14 @@ func (e Error) Error() string {
 	switch e {
 	case ErrInvalidIDAndSecret:
 		return "invalid id and secret"
+	case ErrFailedToOpenTCPPort:
+		return "failed to open tcp port"
+	case ErrFailedToOpenUDPPort:
+		return "failed to open udp port"
+	case ErrServicesMismatch:
+		return "services do not match the services of other connections"
+	case ErrTooManyTunnels:
+		return "too many tunnels"
 	}
 	return "unknown error"
 }
@@ -122,6 +137,44 @@ const (
 	_ Error = iota
 	// ErrInvalidIDAndSecret represents an invalid ID and secret
 	ErrInvalidIDAndSecret
+	// ErrFailedToOpenTCPPort represents the server failed to open the tcp port
+	ErrFailedToOpenTCPPort
+	// ErrFailedToOpenUDPPort represents the server failed to open the udp port
+	ErrFailedToOpenUDPPort
+	// ErrServicesMismatch represents the services are different from the ones declared by other connections
+	ErrServicesMismatch
+	// ErrTooManyTunnels represents the number of tunnels reaches the limit of the user
+	ErrTooManyTunnels
+)
+
+// Info represents a specific info signal
+type Info uint16
+
+const (
+	_ Info = iota
+	// InfoTCPPortOpened tells the client the tcp port opened by the server, followed by a 2 bytes port number
+	InfoTCPPortOpened
+	// InfoUDPPortOpened tells the client the udp port opened by the server, followed by a 2 bytes port number
+	InfoUDPPortOpened
+	// InfoServicePortOpened tells the client the port opened by the server for a service,
+	// followed by a 2 bytes service index and a 2 bytes port number
+	InfoServicePortOpened
+	// InfoMaxTunnels tells the client the max number of tunnels allowed by the server,
+	// followed by a 4 bytes number, 0 means no limit
+	InfoMaxTunnels
+	// InfoServiceHealthAccepted tells the client that the server accepts the health of services
+	InfoServiceHealthAccepted
+	// InfoServiceHealthy tells the server that the local service is healthy, followed by a 2 bytes service index
+	InfoServiceHealthy
+	// InfoServiceUnhealthy tells the server that the local service is unhealthy, followed by a 2 bytes service index
+	InfoServiceUnhealthy
+	// InfoHTTP2ServicesAccepted tells the client that the server forwards HTTP/2 requests as HTTP/2
+	// to the services supporting h2c
+	InfoHTTP2ServicesAccepted
+	// InfoServiceHTTP2 tells the server that the local service supports h2c, followed by a 2 bytes service index
+	InfoServiceHTTP2
+	// InfoVisitorAddrAccepted tells the client that the server sends the addresses of visitors with every task
+	InfoVisitorAddrAccepted
 )
 
 // SendPingSignal sends ping signal to the other side
@@ -151,3 +204,120 @@ func (c *Connection) SendErrorSignalInvalidIDAndSecret() (err error) {
 	_, err = c.Write(errInvalidIDAndSecretBytes)
 	return
 }
+
+// SendErrorSignalFailedToOpenTCPPort sends error signal to the other side
+func (c *Connection) SendErrorSignalFailedToOpenTCPPort() (err error) {
+	_, err = c.Write(errFailedToOpenTCPPort)
+	return
+}
+
+// SendErrorSignalFailedToOpenUDPPort sends error signal to the other side
+func (c *Connection) SendErrorSignalFailedToOpenUDPPort() (err error) {
+	_, err = c.Write(errFailedToOpenUDPPort)
+	return
+}
+
+// SendInfoTCPPortOpened sends the opened tcp port to the other side
+func (c *Connection) SendInfoTCPPortOpened(port uint16) (err error) {
+	return c.sendInfoPort(InfoTCPPortOpened, port)
+}
+
+// SendInfoUDPPortOpened sends the opened udp port to the other side
+func (c *Connection) SendInfoUDPPortOpened(port uint16) (err error) {
+	return c.sendInfoPort(InfoUDPPortOpened, port)
+}
+
+// SendErrorSignalServicesMismatch sends error signal to the other side
+func (c *Connection) SendErrorSignalServicesMismatch() (err error) {
+	_, err = c.Write(errServicesMismatch)
+	return
+}
+
+// SendErrorSignalTooManyTunnels sends error signal to the other side
+func (c *Connection) SendErrorSignalTooManyTunnels() (err error) {
+	_, err = c.Write(errTooManyTunnels)
+	return
+}
+
+// SendInfoServicePortOpened sends the port opened for the service to the other side
+func (c *Connection) SendInfoServicePortOpened(index uint16, port uint16) (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(InfoServicePortOpened))
+	binary.BigEndian.PutUint16(buf[6:], index)
+	binary.BigEndian.PutUint16(buf[8:], port)
+	_, err = c.Write(buf)
+	return
+}
+
+// SendInfoMaxTunnels sends the max number of tunnels allowed for the client to the other side
+func (c *Connection) SendInfoMaxTunnels(max uint32) (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(InfoMaxTunnels))
+	binary.BigEndian.PutUint32(buf[6:], max)
+	_, err = c.Write(buf)
+	return
+}
+
+// SendInfoServiceHealthAccepted tells the other side that the health of services is accepted
+func (c *Connection) SendInfoServiceHealthAccepted() (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(InfoServiceHealthAccepted))
+	_, err = c.Write(buf)
+	return
+}
+
+// SendInfoServiceHealth sends the health of the service to the other side
+func (c *Connection) SendInfoServiceHealth(index uint16, healthy bool) (err error) {
+	info := InfoServiceUnhealthy
+	if healthy {
+		info = InfoServiceHealthy
+	}
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(info))
+	binary.BigEndian.PutUint16(buf[6:], index)
+	_, err = c.Write(buf)
+	return
+}
+
+// SendInfoHTTP2ServicesAccepted tells the other side that the services supporting h2c are accepted
+func (c *Connection) SendInfoHTTP2ServicesAccepted() (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(InfoHTTP2ServicesAccepted))
+	_, err = c.Write(buf)
+	return
+}
+
+// SendInfoServiceHTTP2 tells the other side that the service supports h2c
+func (c *Connection) SendInfoServiceHTTP2(index uint16) (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(InfoServiceHTTP2))
+	binary.BigEndian.PutUint16(buf[6:], index)
+	_, err = c.Write(buf)
+	return
+}
+
+// SendInfoVisitorAddrAccepted tells the other side that the addresses of visitors are sent with every task
+func (c *Connection) SendInfoVisitorAddrAccepted() (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(InfoVisitorAddrAccepted))
+	_, err = c.Write(buf)
+	return
+}
+
+// SendWindowUpdate tells the other side that n bytes of the task have been consumed
+func (c *Connection) SendWindowUpdate(id uint32, n uint32) (err error) {
+	buf := make([]byte, 10)
+	binary.BigEndian.PutUint32(buf[0:], id)
+	binary.BigEndian.PutUint16(buf[4:], predef.WindowUpdate)
+	binary.BigEndian.PutUint32(buf[6:], n)
+	_, err = c.Write(buf)
+	return
+}
+
+func (c *Connection) sendInfoPort(info Info, port uint16) (err error) {
+	buf := []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[4:], uint16(info))
+	binary.BigEndian.PutUint16(buf[6:], port)
+	_, err = c.Write(buf)
+	return
+}
@@ -0,0 +1,190 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/isrc-cas/gt/pool"
+)
+
+// DefaultWindowSize is the initial window size of every task when flow control is enabled
+const DefaultWindowSize = 256 * 1024
+
+var (
+	// ErrWindowExceeded is returned when the other side sends more data than the window allows
+	ErrWindowExceeded = errors.New("flow control window exceeded")
+	// ErrWindowClosed is returned when waiting on a closed window
+	ErrWindowClosed = errors.New("flow control window closed")
+)
+
+// SendWindow 是 task 发送数据的窗口，对方处理完数据后通过 WindowUpdate 增大窗口
+type SendWindow struct {
+	mtx    sync.Mutex
+	cond   sync.Cond
+	size   int
+	closed bool
+}
+
+// NewSendWindow returns a SendWindow with the initial size
+func NewSendWindow(size int) *SendWindow {
+	w := &SendWindow{size: size}
+	w.cond.L = &w.mtx
+	return w
+}
+
+// Available 等待窗口大于 0，返回不超过 max 的可发送字节数
+func (w *SendWindow) Available(max int) (n int, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for w.size <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		err = ErrWindowClosed
+		return
+	}
+	n = w.size
+	if n > max {
+		n = max
+	}
+	return
+}
+
+// Consume 减小窗口
+func (w *SendWindow) Consume(n int) {
+	w.mtx.Lock()
+	w.size -= n
+	w.mtx.Unlock()
+}
+
+// Update 增大窗口，唤醒等待的发送方
+func (w *SendWindow) Update(n uint32) {
+	w.mtx.Lock()
+	w.size += int(n)
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+}
+
+// Close 关闭窗口，唤醒等待的发送方
+func (w *SendWindow) Close() {
+	w.mtx.Lock()
+	w.closed = true
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+}
+
+// ReceiveBuffer 缓存 task 收到的数据，使 tunnel 的读取不会被处理缓慢的 task 阻塞。
+// 缓存的数据不会超过窗口大小，数据写出后通过回调通知对方增大窗口。
+type ReceiveBuffer struct {
+	mtx    sync.Mutex
+	cond   sync.Cond
+	chunks [][]byte
+	size   int
+	max    int
+	closed bool
+}
+
+// NewReceiveBuffer returns a ReceiveBuffer that buffers at most max bytes
+func NewReceiveBuffer(max int) *ReceiveBuffer {
+	b := &ReceiveBuffer{max: max}
+	b.cond.L = &b.mtx
+	return b
+}
+
+// Fill 从 r 中读取 n 个字节放入缓存，超过窗口或者缓存已关闭时，数据会被丢弃
+func (b *ReceiveBuffer) Fill(r io.Reader, n int) (err error) {
+	b.mtx.Lock()
+	exceeded := b.size+n > b.max
+	if !exceeded {
+		b.size += n
+	}
+	b.mtx.Unlock()
+
+	var chunks [][]byte
+	for n > 0 {
+		chunk := pool.BytesPool.Get().([]byte)
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		_, err = io.ReadFull(r, chunk)
+		if err != nil {
+			pool.BytesPool.Put(chunk[:cap(chunk)])
+			break
+		}
+		n -= len(chunk)
+		if exceeded {
+			pool.BytesPool.Put(chunk[:cap(chunk)])
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	b.mtx.Lock()
+	if b.closed || exceeded || err != nil {
+		if !exceeded {
+			b.size -= n
+			for _, chunk := range chunks {
+				b.size -= len(chunk)
+				pool.BytesPool.Put(chunk[:cap(chunk)])
+			}
+		}
+		b.mtx.Unlock()
+		if exceeded && err == nil {
+			err = ErrWindowExceeded
+		}
+		return
+	}
+	b.chunks = append(b.chunks, chunks...)
+	b.mtx.Unlock()
+	b.cond.Broadcast()
+	return
+}
+
+// WriteTo 将缓存的数据写入 w，直到缓存被关闭并且数据全部写出。
+// 写出的数据累计到窗口的四分之一或者缓存为空时，调用 update 通知对方增大窗口。
+func (b *ReceiveBuffer) WriteTo(w io.Writer, update func(n uint32) error) (err error) {
+	var pending int
+	for {
+		b.mtx.Lock()
+		for len(b.chunks) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.chunks) == 0 {
+			b.mtx.Unlock()
+			return
+		}
+		chunk := b.chunks[0]
+		b.chunks[0] = nil
+		b.chunks = b.chunks[1:]
+		b.mtx.Unlock()
+
+		_, err = w.Write(chunk)
+		l := len(chunk)
+		pool.BytesPool.Put(chunk[:cap(chunk)])
+		if err != nil {
+			return
+		}
+
+		b.mtx.Lock()
+		b.size -= l
+		empty := b.size == 0
+		b.mtx.Unlock()
+		pending += l
+		if pending >= b.max/4 || empty {
+			err = update(uint32(pending))
+			if err != nil {
+				return
+			}
+			pending = 0
+		}
+	}
+}
+
+// Close 关闭缓存，已缓存的数据仍然会被 WriteTo 写出
+func (b *ReceiveBuffer) Close() {
+	b.mtx.Lock()
+	b.closed = true
+	b.mtx.Unlock()
+	b.cond.Broadcast()
+}
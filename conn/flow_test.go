@@ -0,0 +1,77 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendWindow(t *testing.T) {
+	w := NewSendWindow(10)
+	n, err := w.Available(100)
+	if err != nil || n != 10 {
+		t.Fatalf("n: %d, err: %v", n, err)
+	}
+	w.Consume(n)
+
+	done := make(chan int)
+	go func() {
+		n, _ := w.Available(100)
+		done <- n
+	}()
+	select {
+	case <-done:
+		t.Fatal("Available should block when the window is empty")
+	case <-time.After(100 * time.Millisecond):
+	}
+	w.Update(5)
+	if n := <-done; n != 5 {
+		t.Fatalf("n: %d", n)
+	}
+
+	w.Consume(5)
+	go func() {
+		_, err := w.Available(100)
+		done <- 0
+		if !errors.Is(err, ErrWindowClosed) {
+			t.Error("ErrWindowClosed is expected")
+		}
+	}()
+	w.Close()
+	<-done
+}
+
+func TestReceiveBuffer(t *testing.T) {
+	b := NewReceiveBuffer(8 * 1024)
+	data := bytes.Repeat([]byte("a"), 5*1024)
+	err := b.Fill(bytes.NewReader(data), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Fill(bytes.NewReader(data), len(data))
+	if !errors.Is(err, ErrWindowExceeded) {
+		t.Fatal("ErrWindowExceeded is expected")
+	}
+
+	var updated uint32
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- b.WriteTo(&out, func(n uint32) error {
+			updated += n
+			return nil
+		})
+	}()
+	b.Close()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("buffered data does not match")
+	}
+	if updated != uint32(len(data)) {
+		t.Fatalf("updated: %d", updated)
+	}
+}
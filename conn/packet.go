@@ -0,0 +1,76 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxPacketSize is the max size of a udp packet carried by the tunnel
+const MaxPacketSize = 65535
+
+// ErrPacketTooLarge is returned when the packet is larger than MaxPacketSize
+var ErrPacketTooLarge = errors.New("packet is too large")
+
+// PacketReader converts packets to a stream, each packet is prefixed with a 2 bytes length,
+// so that the boundaries of packets are preserved when the stream is split into data frames.
+type PacketReader struct {
+	// ReadPacket reads a packet into p
+	ReadPacket func(p []byte) (n int, err error)
+	buf        []byte
+	r          int
+	w          int
+}
+
+// Read reads the stream of packets into p.
+func (pr *PacketReader) Read(p []byte) (n int, err error) {
+	if pr.r >= pr.w {
+		if pr.buf == nil {
+			pr.buf = make([]byte, MaxPacketSize+2)
+		}
+		var l int
+		l, err = pr.ReadPacket(pr.buf[2:])
+		if l <= 0 {
+			return
+		}
+		binary.BigEndian.PutUint16(pr.buf, uint16(l))
+		pr.r = 0
+		pr.w = l + 2
+	}
+	n = copy(p, pr.buf[pr.r:pr.w])
+	pr.r += n
+	return
+}
+
+// PacketWriter converts a stream back to packets, it's the opposite of PacketReader.
+type PacketWriter struct {
+	// WritePacket writes a whole packet
+	WritePacket func(p []byte) (err error)
+	buf         []byte
+}
+
+// Write writes the stream of packets, WritePacket is called once a whole packet is received.
+func (pw *PacketWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if len(pw.buf) > 0 {
+		pw.buf = append(pw.buf, p...)
+		p = pw.buf
+	}
+	for len(p) >= 2 {
+		l := int(binary.BigEndian.Uint16(p))
+		if len(p) < l+2 {
+			break
+		}
+		err = pw.WritePacket(p[2 : l+2])
+		if err != nil {
+			return
+		}
+		p = p[l+2:]
+	}
+	// 缓存不完整的包，等待后续数据
+	if len(p) > 0 {
+		pw.buf = append(pw.buf[:0], p...)
+	} else {
+		pw.buf = pw.buf[:0]
+	}
+	return
+}
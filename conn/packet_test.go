@@ -0,0 +1,63 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPacketReaderAndWriter(t *testing.T) {
+	packets := [][]byte{
+		[]byte("a"),
+		bytes.Repeat([]byte("b"), 1000),
+		bytes.Repeat([]byte("c"), MaxPacketSize),
+		[]byte("d"),
+	}
+	i := 0
+	reader := &PacketReader{
+		ReadPacket: func(p []byte) (n int, err error) {
+			if i >= len(packets) {
+				return 0, io.EOF
+			}
+			n = copy(p, packets[i])
+			i++
+			return
+		},
+	}
+	stream, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 以不同的大小切分数据流，包的边界应保持不变
+	for _, size := range []int{1, 2, 3, 7, 4096, len(stream)} {
+		var result [][]byte
+		writer := &PacketWriter{
+			WritePacket: func(p []byte) error {
+				result = append(result, append([]byte(nil), p...))
+				return nil
+			},
+		}
+		for s := 0; s < len(stream); s += size {
+			e := s + size
+			if e > len(stream) {
+				e = len(stream)
+			}
+			n, err := writer.Write(stream[s:e])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != e-s {
+				t.Fatalf("%d is expected, but got %d", e-s, n)
+			}
+		}
+		if len(result) != len(packets) {
+			t.Fatalf("size %d: %d packets are expected, but got %d", size, len(packets), len(result))
+		}
+		for j := range packets {
+			if !bytes.Equal(result[j], packets[j]) {
+				t.Fatalf("size %d: packet %d does not match", size, j)
+			}
+		}
+	}
+}
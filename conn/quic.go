@@ -0,0 +1,29 @@
+package conn
+
+import (
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICConn is a net.Conn over the first stream of a QUIC connection, which carries the handshake
+// and signals of a tunnel, while the tasks of the tunnel are carried by other streams of Connection.
+type QUICConn struct {
+	*quic.Stream
+	Connection *quic.Conn
+}
+
+// LocalAddr returns the local address of the QUIC connection
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.Connection.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the QUIC connection
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.Connection.RemoteAddr()
+}
+
+// Close closes the QUIC connection and all of its streams
+func (c *QUICConn) Close() error {
+	return c.Connection.CloseWithError(0, "")
+}
@@ -0,0 +1,70 @@
+package conn
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrInvalidVisitor is returned when the addresses of the visitor are invalid
+var ErrInvalidVisitor = errors.New("invalid visitor addresses")
+
+// visitorTLS 表示服务端解密了访问者的 TLS 连接
+const visitorTLS byte = 1
+
+// Visitor is the addresses of the visitor connection of a task.
+type Visitor struct {
+	// RemoteAddr is the address of the visitor, such as '1.2.3.4:5678' or '[::1]:5678'
+	RemoteAddr string
+	// LocalAddr is the address of the server that the visitor connected to
+	LocalAddr string
+	// TLS reports whether the server terminated the TLS connection of the visitor
+	TLS bool
+}
+
+// AppendVisitor appends the encoded addresses of the visitor to buf: 1 byte flags,
+// then the remote and local addresses, each of them is prefixed with a 1 byte length.
+func AppendVisitor(buf []byte, v *Visitor) ([]byte, error) {
+	if len(v.RemoteAddr) > 255 || len(v.LocalAddr) > 255 {
+		return buf, ErrInvalidVisitor
+	}
+	var flags byte
+	if v.TLS {
+		flags |= visitorTLS
+	}
+	buf = append(buf, flags, byte(len(v.RemoteAddr)))
+	buf = append(buf, v.RemoteAddr...)
+	buf = append(buf, byte(len(v.LocalAddr)))
+	buf = append(buf, v.LocalAddr...)
+	return buf, nil
+}
+
+// ReadVisitor reads the addresses of the visitor encoded by AppendVisitor.
+func ReadVisitor(r io.Reader) (v *Visitor, err error) {
+	var flags [1]byte
+	_, err = io.ReadFull(r, flags[:])
+	if err != nil {
+		return
+	}
+	v = &Visitor{TLS: flags[0]&visitorTLS != 0}
+	v.RemoteAddr, err = readAddr(r)
+	if err != nil {
+		return
+	}
+	v.LocalAddr, err = readAddr(r)
+	return
+}
+
+func readAddr(r io.Reader) (addr string, err error) {
+	var buf [256]byte
+	_, err = io.ReadFull(r, buf[:1])
+	if err != nil {
+		return
+	}
+	l := int(buf[0])
+	_, err = io.ReadFull(r, buf[1:1+l])
+	if err != nil {
+		return
+	}
+	addr = string(buf[1 : 1+l])
+	return
+}
@@ -0,0 +1,39 @@
+package conn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVisitor(t *testing.T) {
+	visitors := []*Visitor{
+		{RemoteAddr: "1.2.3.4:5678", LocalAddr: "10.0.0.1:443", TLS: true},
+		{RemoteAddr: "[2001:db8::1]:5678", LocalAddr: "[2001:db8::2]:80"},
+		{},
+	}
+	var buf []byte
+	for _, v := range visitors {
+		var err error
+		buf, err = AppendVisitor(buf, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bytes.NewReader(buf)
+	for _, expected := range visitors {
+		v, err := ReadVisitor(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *v != *expected {
+			t.Fatalf("%+v is not expected %+v", v, expected)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes remaining", r.Len())
+	}
+	_, err := AppendVisitor(nil, &Visitor{RemoteAddr: string(make([]byte, 256))})
+	if err != ErrInvalidVisitor {
+		t.Fatalf("%v is not expected", err)
+	}
+}
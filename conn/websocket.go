@@ -0,0 +1,157 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/isrc-cas/gt/pool"
+)
+
+// WebSocketMaxMessageSize is the max size of a WebSocket message, Write splits larger data into
+// several messages and a peer that sends a larger message is disconnected
+const WebSocketMaxMessageSize = 4 * pool.MaxBufferSize
+
+// WebSocketConn is a net.Conn that carries a byte stream over binary WebSocket messages.
+//
+// Read deadlines of websocket.Conn are fatal, but the tunnels use them to send ping signals,
+// so messages are read by a goroutine and the read deadline is implemented by WebSocketConn.
+type WebSocketConn struct {
+	*websocket.Conn
+	messages  chan []byte
+	message   []byte
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	deadlineMtx     sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+// NewWebSocketConn returns a WebSocketConn that reads and writes ws
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	c := &WebSocketConn{
+		Conn:            ws,
+		messages:        make(chan []byte),
+		done:            make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	ws.SetReadLimit(WebSocketMaxMessageSize)
+	go c.readLoop()
+	return c
+}
+
+func (c *WebSocketConn) readLoop() {
+	defer close(c.messages)
+	for {
+		messageType, message, err := c.Conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				err = io.EOF
+			}
+			c.err = err
+			return
+		}
+		if messageType != websocket.BinaryMessage || len(message) == 0 {
+			continue
+		}
+		select {
+		case c.messages <- message:
+		case <-c.done:
+			c.err = net.ErrClosed
+			return
+		}
+	}
+}
+
+// Read reads data from the received messages
+func (c *WebSocketConn) Read(b []byte) (n int, err error) {
+	for len(c.message) == 0 {
+		c.deadlineMtx.Lock()
+		deadline := c.deadline
+		deadlineChanged := c.deadlineChanged
+		c.deadlineMtx.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, c.timeoutError()
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				err = c.err
+			}
+			c.message = message
+		case <-timeout:
+			err = c.timeoutError()
+		case <-deadlineChanged:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+	n = copy(b, c.message)
+	c.message = c.message[n:]
+	return
+}
+
+func (c *WebSocketConn) timeoutError() error {
+	return &net.OpError{Op: "read", Net: "websocket", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: os.ErrDeadlineExceeded}
+}
+
+// Write writes b as a binary message
+func (c *WebSocketConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		m := b
+		if len(m) > WebSocketMaxMessageSize {
+			m = m[:WebSocketMaxMessageSize]
+		}
+		err = c.WriteMessage(websocket.BinaryMessage, m)
+		if err != nil {
+			return
+		}
+		n += len(m)
+		b = b[len(m):]
+	}
+	return
+}
+
+// Close closes the underlying connection
+func (c *WebSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// SetReadDeadline sets the deadline for Read, a blocked Read is also affected
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.deadlineMtx.Unlock()
+	return nil
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *WebSocketConn) SetDeadline(t time.Time) (err error) {
+	err = c.SetReadDeadline(t)
+	if err != nil {
+		return
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,134 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketConn(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c := NewWebSocketConn(ws)
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWebSocketConn(ws)
+	defer c.Close()
+
+	// 读超时之后连接仍然可用
+	err = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(*net.OpError); !ok || !ne.Timeout() {
+		t.Fatalf("timeout error is expected, got %v", err)
+	}
+	err = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Write([]byte("hello "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(c, buf[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(c, buf[3:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+
+	// 超过 WebSocketMaxMessageSize 的数据被拆分为多个消息
+	large := make([]byte, 3*WebSocketMaxMessageSize+1)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	_, err = c.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(large))
+	_, err = io.ReadFull(c, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, large) {
+		t.Fatal("unexpected large data")
+	}
+
+	// 阻塞的 Read 受到新设置的超时影响
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = c.SetReadDeadline(time.Now())
+	}()
+	_, err = c.Read(buf)
+	if ne, ok := err.(*net.OpError); !ok || !ne.Timeout() {
+		t.Fatalf("timeout error is expected, got %v", err)
+	}
+}
+
+func TestWebSocketConnReadLimit(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			errs <- err
+			return
+		}
+		c := NewWebSocketConn(ws)
+		defer c.Close()
+		_, err = c.Read(make([]byte, 1))
+		errs <- err
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	err = ws.WriteMessage(websocket.BinaryMessage, make([]byte, WebSocketMaxMessageSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errs:
+		if err == nil {
+			t.Fatal("a message larger than WebSocketMaxMessageSize is accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a message larger than WebSocketMaxMessageSize is not rejected")
+	}
+}
@@ -0,0 +1,180 @@
+// Package http1 parses the headers and framing of HTTP/1.x messages forwarded by gt.
+package http1
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// ErrInvalidProtocol is an error returned when invalid http protocol was received
+var ErrInvalidProtocol = errors.New("invalid http protocol")
+
+// Header 是 http 请求或者响应头中的一个字段
+type Header struct {
+	Name  []byte
+	Value []byte
+}
+
+// FindHeader 返回第一个名为 name 的字段的值，字段名不区分大小写
+func FindHeader(headers []Header, name []byte) []byte {
+	for _, h := range headers {
+		if bytes.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return nil
+}
+
+// IsEmptyLine 判断包括换行符的 line 是否是 http 头结尾的空行
+func IsEmptyLine(line []byte) bool {
+	return len(line) == 1 || len(line) == 2 && line[0] == '\r'
+}
+
+// ParseHeaders 解析以空行结尾的 http 头，返回第一行与所有字段。
+// 字段名不区分大小写，obs-fold 的续行使用一个空格拼接到上一个字段
+func ParseHeaders(data []byte) (first []byte, headers []Header, err error) {
+	for len(data) > 0 {
+		var line []byte
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			line, data = data, nil
+		} else {
+			line, data = data[:i], data[i+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if first == nil {
+			if len(line) == 0 {
+				err = ErrInvalidProtocol
+				return
+			}
+			first = line
+			continue
+		}
+		if len(line) == 0 {
+			return
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				err = ErrInvalidProtocol
+				return
+			}
+			h := &headers[len(headers)-1]
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			if len(h.Value) == 0 {
+				h.Value = line
+				continue
+			}
+			// 限制容量，避免 append 覆盖后面的数据
+			h.Value = append(h.Value[:len(h.Value):len(h.Value)], ' ')
+			h.Value = append(h.Value, line...)
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || bytes.ContainsAny(line[:colon], " \t") {
+			err = ErrInvalidProtocol
+			return
+		}
+		headers = append(headers, Header{
+			Name:  line[:colon],
+			Value: bytes.TrimSpace(line[colon+1:]),
+		})
+	}
+	err = ErrInvalidProtocol
+	return
+}
+
+// BodyLength 根据 Transfer-Encoding 与 Content-Length 返回 body 的长度，length 为 -1 表示没有 Content-Length。
+// Transfer-Encoding 的最后一个编码不是 chunked 或者与 Content-Length 同时存在时返回 ErrInvalidProtocol
+func BodyLength(headers []Header) (length int64, chunked bool, err error) {
+	length = -1
+	var te []byte
+	for _, h := range headers {
+		switch {
+		case bytes.EqualFold(h.Name, []byte("Transfer-Encoding")):
+			te = h.Value
+		case bytes.EqualFold(h.Name, []byte("Content-Length")):
+			for _, v := range bytes.Split(h.Value, []byte(",")) {
+				var l int64
+				l, err = ParseDecimal(bytes.TrimSpace(v))
+				if err != nil {
+					return
+				}
+				if length >= 0 && length != l {
+					err = ErrInvalidProtocol
+					return
+				}
+				length = l
+			}
+		}
+	}
+	if te == nil {
+		return
+	}
+	if i := bytes.LastIndexByte(te, ','); i >= 0 {
+		te = te[i+1:]
+	}
+	if !bytes.EqualFold(bytes.TrimSpace(te), []byte("chunked")) || length >= 0 {
+		err = ErrInvalidProtocol
+		return
+	}
+	chunked = true
+	return
+}
+
+// ParseDecimal 解析只包含数字的非负整数，例如 Content-Length 与状态码
+func ParseDecimal(v []byte) (l int64, err error) {
+	if len(v) == 0 {
+		err = ErrInvalidProtocol
+		return
+	}
+	for _, b := range v {
+		if b < '0' || b > '9' {
+			err = ErrInvalidProtocol
+			return
+		}
+	}
+	l, err = strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		err = ErrInvalidProtocol
+	}
+	return
+}
+
+// ParseChunkSize 解析 chunk 的长度，忽略 chunk 扩展
+func ParseChunkSize(line []byte) (size int64, err error) {
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || len(line) > 16 {
+		err = ErrInvalidProtocol
+		return
+	}
+	u, err := strconv.ParseUint(string(line), 16, 63)
+	if err != nil {
+		err = ErrInvalidProtocol
+		return
+	}
+	size = int64(u)
+	return
+}
+
+// HasToken 判断以逗号分隔的 value 中是否有 token，不区分大小写
+func HasToken(value []byte, token []byte) bool {
+	for _, v := range bytes.Split(value, []byte(",")) {
+		if bytes.EqualFold(bytes.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUpgrade 判断请求之后的数据是否不再是 http 请求，例如 CONNECT 与 Upgrade
+func IsUpgrade(method []byte, headers []Header) bool {
+	return bytes.Equal(method, []byte("CONNECT")) ||
+		len(FindHeader(headers, []byte("Upgrade"))) > 0 && HasToken(FindHeader(headers, []byte("Connection")), []byte("upgrade"))
+}
@@ -13,8 +13,8 @@ const (
 	MaxSecretSize = MaxIDSize
 	// DefaultSecretSize secret 的默认长度
 	DefaultSecretSize = DefaultIDSize
-	// MaxHTTPHeaderSize max ending of host in http headers
-	MaxHTTPHeaderSize = 2 * 1024
+	// MaxHTTPHeaderSize max size of http request or response headers
+	MaxHTTPHeaderSize = 32 * 1024
 )
 
 // OP is the type of operations
@@ -25,7 +25,75 @@ const (
 	Data OP = iota
 	// Close is a close operation
 	Close
+	// ServicesData is a data operation with the index of the service,
+	// it's used as the first data operation of a task when the client declares services
+	ServicesData
+	// WindowUpdate increases the send window of a task, followed by a 4 bytes increment.
+	// It's only available in Version2
+	WindowUpdate
+	// VisitorAddr carries the addresses of the visitor connection of a task, followed by the addresses encoded by
+	// conn.AppendVisitor. It's sent before the first data operation of every task when the client sets
+	// OptionVisitorAddr
+	VisitorAddr
 )
 
-// VersionFirst 版本第一个组成部分
-const VersionFirst byte = 0xF0
+const (
+	// VersionFirst 版本第一个组成部分
+	VersionFirst byte = 0xF0
+	// Version1 协议版本 1
+	Version1 byte = 0x01
+	// Version2 协议版本 2，每个 task 使用基于窗口的流量控制
+	Version2 byte = 0x02
+)
+
+// Option is the type of the option byte sent by client in the handshake
+type Option = byte
+
+const (
+	// OptionOpenTCPPort asks the server to open a tcp port for the client,
+	// followed by a 2 bytes port number, 0 means a random port
+	OptionOpenTCPPort Option = 1 << iota
+	// OptionOpenUDPPort asks the server to open a udp port for the client,
+	// followed by a 2 bytes port number, 0 means a random port
+	OptionOpenUDPPort
+	// OptionServices declares the services of the client, followed by a 1 byte count of services,
+	// every service is encoded as: 1 byte type, 2 bytes port, then subdomain, path prefix,
+	// header name and header value, each of them is prefixed with a 1 byte length
+	OptionServices
+	// OptionMaxTunnels asks the server to tell the max number of tunnels allowed for the client,
+	// the server replies with conn.InfoMaxTunnels before the ready signal
+	OptionMaxTunnels
+	// OptionServiceHealth tells the server that the client reports the health of services,
+	// the server replies with conn.InfoServiceHealthAccepted before the ready signal
+	OptionServiceHealth
+	// OptionHTTP2Services tells the server that some http services support HTTP/2 without TLS (h2c),
+	// the server replies with conn.InfoHTTP2ServicesAccepted before the ready signal
+	OptionHTTP2Services
+	// OptionVisitorAddr asks the server to send the addresses of visitors with every task,
+	// the server replies with conn.InfoVisitorAddrAccepted before the ready signal
+	OptionVisitorAddr
+)
+
+// ServiceType is the type of services declared by client
+type ServiceType = byte
+
+const (
+	// ServiceHTTP is a http or https service
+	ServiceHTTP ServiceType = iota
+	// ServiceTCP is a tcp service
+	ServiceTCP
+	// ServiceUDP is a udp service
+	ServiceUDP
+)
+
+// MaxServices is the max number of services that a client can declare
+const MaxServices = 32
+
+// QUICProto is the ALPN protocol of tunnels over QUIC. The first stream of a QUIC connection carries
+// the handshake and signals, every task is carried by its own stream opened by the server,
+// which begins with a 4 bytes task id and a 2 bytes service index
+const QUICProto = "gt"
+
+// TLSTunnelProto is the ALPN protocol offered by tunnels over TLS with a client cert, the server requests
+// client certs only from connections offering it, so that visitors are not asked for client certs
+const TLSTunnelProto = "gt-tunnel"
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	stdbufio "bufio"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+
+// acmeManager 通过 ACME 为已注册客户端的 host 按需申请与续期证书
+type acmeManager struct {
+	manager *autocert.Manager
+	// httpHandler 处理 addr 上的 HTTP-01 验证请求，没有监听 addr 时为 nil
+	httpHandler http.Handler
+}
+
+func (s *Server) newACMEManager() (a *acmeManager) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(s.config.ACMECacheDir),
+		HostPolicy: s.acmeHostPolicy,
+		Email:      s.config.ACMEEmail,
+	}
+	if len(s.config.ACMEDirectoryURL) > 0 {
+		m.Client = &acme.Client{DirectoryURL: s.config.ACMEDirectoryURL}
+	}
+	a = &acmeManager{manager: m}
+	if len(s.config.Addr) > 0 {
+		// 调用 HTTPHandler 之后 autocert 才会使用 HTTP-01 验证
+		a.httpHandler = m.HTTPHandler(nil)
+	}
+	return
+}
+
+// acmeHostPolicy 只允许为映射到已注册客户端的 host 申请证书
+func (s *Server) acmeHostPolicy(_ context.Context, host string) error {
+	if s.hostRegistered(host) {
+		return nil
+	}
+	return fmt.Errorf("host '%s' does not belong to any registered client", host)
+}
+
+// hostRegistered 判断 host 是否为已注册 id 配置的自定义 host，或者是配置的 acmeDomain 下
+// '<id>.<domain>' 形式的 host，或者是已连接的客户端在服务中声明的 '<subdomain>.<id>.<domain>'。
+// 通配符 host 与没有声明的 subdomain 不会申请证书，
+// 否则访问者可以通过任意的子域名无限制地申请证书
+func (s *Server) hostRegistered(host string) bool {
+	registered := func(id string) bool {
+		if _, ok := s.users.Load(id); ok {
+			return true
+		}
+		_, ok := s.getClient(id)
+		return ok
+	}
+	host = normalizeHost(host)
+	if id, ok := s.hosts.lookupExact(host); ok {
+		return registered(id)
+	}
+	for _, domain := range s.config.ACMEDomains {
+		domain = "." + normalizeHost(domain)
+		if len(host) <= len(domain) || !strings.HasSuffix(host, domain) {
+			continue
+		}
+		labels := strings.Split(host[:len(host)-len(domain)], ".")
+		switch len(labels) {
+		case 1:
+			if len(labels[0]) > 0 && registered(labels[0]) {
+				return true
+			}
+		case 2:
+			// 只为已连接的客户端在服务中声明的 subdomain 申请证书
+			if len(labels[0]) == 0 {
+				continue
+			}
+			if c, ok := s.getClient(labels[1]); ok && c.declaresSubdomain(labels[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveACMEChallenge 响应 HTTP-01 验证请求
+func (c *conn) serveACMEChallenge() (err error) {
+	req, err := http.ReadRequest(stdbufio.NewReader(c.Reader))
+	if err != nil {
+		return
+	}
+	w := newResponseRecorder()
+	c.server.acme.httpHandler.ServeHTTP(w, req)
+	return w.writeResponse(c)
+}
+
+// responseRecorder 保存 http.Handler 的响应
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), code: http.StatusOK}
+}
+
+// writeResponse 将保存的响应写入 w
+func (r *responseRecorder) writeResponse(w io.Writer) error {
+	resp := &http.Response{
+		StatusCode:    r.code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header,
+		Body:          ioutil.NopCloser(&r.body),
+		ContentLength: int64(r.body.Len()),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(r.body.Len()))
+	return resp.Write(w)
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+}
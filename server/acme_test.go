@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+func TestHostRegistered(t *testing.T) {
+	s := &Server{}
+	s.config.ACMEDomains = []string{"example.com", "Example.NET."}
+	s.users.Store("id1", user{Secret: "secret1", Hosts: []string{"app.customer.com", "*.customer.com"}})
+	index, err := newHostIndex(&s.users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hosts.index.Store(index)
+	c := &client{ID: "id1", server: s}
+	c.services = []*service{
+		{index: 0, typ: predef.ServiceHTTP},
+		{index: 1, typ: predef.ServiceHTTP, subdomain: []byte("www")},
+		{index: 2, typ: predef.ServiceTCP, subdomain: []byte("tcp")},
+	}
+	s.id2Agent.Store("id1", c)
+	cases := []struct {
+		host string
+		ok   bool
+	}{
+		{"id1.example.com", true},
+		{"ID1.example.com:443", true},
+		{"www.id1.example.com", true},
+		{"WWW.id1.example.net", true},
+		{"api.id1.example.com", false},
+		{"tcp.id1.example.com", false},
+		{"www.id2.example.com", false},
+		{"id1.example.net", true},
+		{"app.customer.com", true},
+		{"id1.attacker-1.com", false},
+		{"www.id1.attacker-2.com", false},
+		{"a.b.id1.example.com", false},
+		{".id1.example.com", false},
+		{"id2.example.com", false},
+		{"example.com", false},
+		{"www.customer.com", false},
+	}
+	for _, c := range cases {
+		if ok := s.hostRegistered(c.host); ok != c.ok {
+			t.Fatalf("hostRegistered(%q) = %v; expect %v", c.host, ok, c.ok)
+		}
+	}
+}
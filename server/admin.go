@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/isrc-cas/gt/server/api"
+)
+
+// adminClients 为 api server 的 admin api 提供客户端信息
+type adminClients struct {
+	server *Server
+}
+
+func (c *client) info() (info api.ClientInfo) {
+	info.ID = c.ID
+	c.tunnelsRWMtx.RLock()
+	for t := range c.tunnels {
+		tasks := t.GetTasksCount()
+		info.Tunnels = append(info.Tunnels, api.TunnelInfo{
+			RemoteAddr:  t.RemoteAddr().String(),
+			ConnectedAt: t.connectedAt,
+			Tasks:       tasks,
+		})
+		info.Tasks += tasks
+	}
+	c.tunnelsRWMtx.RUnlock()
+	sort.Slice(info.Tunnels, func(i, j int) bool {
+		return info.Tunnels[i].ConnectedAt.Before(info.Tunnels[j].ConnectedAt)
+	})
+	info.IngressBytes = atomic.LoadUint64(&c.ingressBytes)
+	info.EgressBytes = atomic.LoadUint64(&c.egressBytes)
+	return
+}
+
+func (a adminClients) List() (clients []api.ClientInfo) {
+	a.server.id2Agent.Range(func(_, value interface{}) bool {
+		clients = append(clients, value.(*client).info())
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	return
+}
+
+func (a adminClients) Get(id string) (info api.ClientInfo, ok bool) {
+	c, ok := a.server.getClient(id)
+	if ok {
+		info = c.info()
+	}
+	return
+}
+
+func (a adminClients) Kick(id string) (ok bool) {
+	c, ok := a.server.getClient(id)
+	if ok {
+		c.close()
+	}
+	return
+}
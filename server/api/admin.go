@@ -0,0 +1,113 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TunnelInfo describes a tunnel of a client.
+type TunnelInfo struct {
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Tasks       uint32    `json:"tasks"`
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ID           string       `json:"id"`
+	Tunnels      []TunnelInfo `json:"tunnels"`
+	Tasks        uint32       `json:"tasks"`
+	IngressBytes uint64       `json:"ingressBytes"`
+	EgressBytes  uint64       `json:"egressBytes"`
+}
+
+// Clients provides the connected clients to the admin api.
+type Clients interface {
+	// List returns all the connected clients.
+	List() []ClientInfo
+	// Get returns the client with the id.
+	Get(id string) (info ClientInfo, ok bool)
+	// Kick closes all the tunnels and tasks of the client with the id.
+	Kick(id string) (ok bool)
+}
+
+// clients handles GET /clients
+func (s *Server) clients(writer http.ResponseWriter, request *http.Request) {
+	if !s.authAdmin(writer, request) {
+		return
+	}
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		s.writeJSONError(writer, http.StatusMethodNotAllowed)
+		return
+	}
+	clients := s.Clients.List()
+	if clients == nil {
+		clients = []ClientInfo{}
+	}
+	s.writeJSON(writer, http.StatusOK, clients)
+}
+
+// client handles GET /clients/{id} and DELETE /clients/{id}
+func (s *Server) client(writer http.ResponseWriter, request *http.Request) {
+	if !s.authAdmin(writer, request) {
+		return
+	}
+	id := strings.TrimPrefix(request.URL.Path, "/clients/")
+	if len(id) == 0 || strings.IndexByte(id, '/') >= 0 {
+		s.writeJSONError(writer, http.StatusNotFound)
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		info, ok := s.Clients.Get(id)
+		if !ok {
+			s.writeJSONError(writer, http.StatusNotFound)
+			return
+		}
+		s.writeJSON(writer, http.StatusOK, info)
+	case http.MethodDelete:
+		if !s.Clients.Kick(id) {
+			s.writeJSONError(writer, http.StatusNotFound)
+			return
+		}
+		s.logger.Info().Str("id", id).Str("remoteAddr", request.RemoteAddr).Msg("client kicked")
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writer.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		s.writeJSONError(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+// authAdmin 验证请求的 Authorization: Bearer <token>，未配置 token 时 admin api 不可用
+func (s *Server) authAdmin(writer http.ResponseWriter, request *http.Request) (ok bool) {
+	if len(s.AdminToken) == 0 || s.Clients == nil {
+		s.writeJSONError(writer, http.StatusNotFound)
+		return
+	}
+	auth := request.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(s.AdminToken)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeJSONError(writer, http.StatusUnauthorized)
+		return
+	}
+	return true
+}
+
+func (s *Server) writeJSON(writer http.ResponseWriter, code int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	err := json.NewEncoder(writer).Encode(v)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("failed to write json response")
+	}
+}
+
+func (s *Server) writeJSONError(writer http.ResponseWriter, code int) {
+	s.writeJSON(writer, code, map[string]string{"error": http.StatusText(code)})
+}
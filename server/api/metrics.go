@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsWriter writes metrics in the Prometheus text exposition format.
+type MetricsWriter struct {
+	buf bytes.Buffer
+}
+
+// Family writes the HELP and TYPE lines of a metric family, typ is one of counter, gauge and histogram.
+func (w *MetricsWriter) Family(name, typ, help string) {
+	w.buf.WriteString("# HELP ")
+	w.buf.WriteString(name)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	w.buf.WriteString("\n# TYPE ")
+	w.buf.WriteString(name)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(typ)
+	w.buf.WriteByte('\n')
+}
+
+// Sample writes a sample, labels are pairs of label name and label value.
+func (w *MetricsWriter) Sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 1 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(labels[i])
+			w.buf.WriteString(`="`)
+			w.buf.WriteString(labelValueReplacer.Replace(labels[i+1]))
+			w.buf.WriteByte('"')
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatFloat(value))
+	w.buf.WriteByte('\n')
+}
+
+// Histogram writes the buckets, the sum and the count of the histogram.
+func (w *MetricsWriter) Histogram(name string, h *Histogram, labels ...string) {
+	h.mtx.Lock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	sum, count := h.sum, h.count
+	h.mtx.Unlock()
+
+	// 限制容量，append 不会覆盖调用者的 labels
+	labels = labels[:len(labels):len(labels)]
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		w.Sample(name+"_bucket", float64(cumulative), append(labels, "le", formatFloat(bound))...)
+	}
+	w.Sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	w.Sample(name+"_sum", sum, labels...)
+	w.Sample(name+"_count", float64(count), labels...)
+}
+
+// Bytes returns the written metrics.
+func (w *MetricsWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Histogram counts observations in buckets with fixed upper bounds.
+type Histogram struct {
+	mtx     sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram returns a histogram with the upper bounds in increasing order.
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mtx.Lock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+	h.mtx.Unlock()
+}
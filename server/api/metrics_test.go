@@ -0,0 +1,60 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	h := NewHistogram(0.1, 1)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	w := &MetricsWriter{}
+	w.Family("gt_test_total", "counter", "Test counter.")
+	w.Sample("gt_test_total", 3)
+	w.Sample("gt_test_total", 1.5, "id", `a"b\c`, "direction", "ingress")
+	w.Family("gt_test_seconds", "histogram", "Test histogram.")
+	w.Histogram("gt_test_seconds", h)
+
+	expected := `# HELP gt_test_total Test counter.
+# TYPE gt_test_total counter
+gt_test_total 3
+gt_test_total{id="a\"b\\c",direction="ingress"} 1.5
+# HELP gt_test_seconds Test histogram.
+# TYPE gt_test_seconds histogram
+gt_test_seconds_bucket{le="0.1"} 1
+gt_test_seconds_bucket{le="1"} 2
+gt_test_seconds_bucket{le="+Inf"} 3
+gt_test_seconds_sum 2.55
+gt_test_seconds_count 3
+`
+	if string(w.Bytes()) != expected {
+		t.Fatalf("unexpected metrics:\n%s", w.Bytes())
+	}
+}
+
+func TestHistogramLabelsWithCapacity(t *testing.T) {
+	h := NewHistogram(1)
+	h.Observe(0.5)
+
+	labels := make([]string, 2, 8)
+	labels[0], labels[1] = "id", "a"
+	backing := labels[:cap(labels)]
+	backing[2], backing[3] = "other", "b"
+
+	w := &MetricsWriter{}
+	w.Histogram("gt_test_seconds", h, labels...)
+
+	expected := `gt_test_seconds_bucket{id="a",le="1"} 1
+gt_test_seconds_bucket{id="a",le="+Inf"} 1
+gt_test_seconds_sum{id="a"} 0.5
+gt_test_seconds_count{id="a"} 1
+`
+	if string(w.Bytes()) != expected {
+		t.Fatalf("unexpected metrics:\n%s", w.Bytes())
+	}
+	if backing[2] != "other" || backing[3] != "b" {
+		t.Fatalf("labels of the caller are overwritten: %q", backing)
+	}
+}
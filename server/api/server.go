@@ -24,6 +24,10 @@ type Server struct {
 	checkTunnelMtx sync.Mutex
 	RemoteAddr     string
 	RemoteSchema   string
+	// AdminToken is the bearer token of the admin api, the admin api is disabled when it is empty
+	AdminToken string
+	// Clients provides the connected clients to the admin api
+	Clients Clients
 
 	// status response cache
 	statusRespCache     http.Response
@@ -33,6 +37,7 @@ type Server struct {
 	id         atomic.Value
 	secret     atomic.Value
 	idConflict func(id string) bool
+	metrics    func(w *MetricsWriter)
 }
 
 // ID 返回 api server 生成的 id
@@ -54,7 +59,7 @@ func (s *Server) Secret() string {
 }
 
 // NewServer returns an api server instance.
-func NewServer(addr string, logger zerolog.Logger, idConflict func(id string) bool) *Server {
+func NewServer(addr string, logger zerolog.Logger, idConflict func(id string) bool, metrics func(w *MetricsWriter)) *Server {
 	mux := http.NewServeMux()
 	s := &Server{
 		Server: http.Server{
@@ -63,9 +68,13 @@ func NewServer(addr string, logger zerolog.Logger, idConflict func(id string) bo
 		},
 		logger:     logger,
 		idConflict: idConflict,
+		metrics:    metrics,
 	}
 	mux.HandleFunc("/status", s.status)
 	mux.HandleFunc("/statusResp", s.statusResp)
+	mux.HandleFunc("/metrics", s.metricsResp)
+	mux.HandleFunc("/clients", s.clients)
+	mux.HandleFunc("/clients/", s.client)
 	return s
 }
 
@@ -90,6 +99,18 @@ func (s *Server) statusResp(writer http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+func (s *Server) metricsResp(writer http.ResponseWriter, _ *http.Request) {
+	w := &MetricsWriter{}
+	if s.metrics != nil {
+		s.metrics(w)
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := writer.Write(w.Bytes())
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("failed to responses to metrics request")
+	}
+}
+
 func (s *Server) randomIDSecret() error {
 	retries := 10
 	for i := 0; i < retries; i++ {
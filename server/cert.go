@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+	"golang.org/x/crypto/acme"
+)
+
+// certPair 是一对证书与私钥文件
+type certPair struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// certIndex 根据 SNI 查找证书的索引
+type certIndex struct {
+	exact     map[string]*tls.Certificate
+	wildcards map[string]*tls.Certificate
+	// fallback 在没有 SNI 或者没有匹配的证书时使用
+	fallback *tls.Certificate
+}
+
+// certificates 保存当前生效的 certIndex，重新加载证书时整体替换
+type certificates struct {
+	index atomic.Value
+}
+
+// certPairs 按照 certFile/keyFile、config 配置文件中的 certs、certDir 的顺序返回所有的证书，
+// 第一个证书在没有匹配的证书时使用
+func (s *Server) certPairs(configCerts []certPair) (pairs []certPair, err error) {
+	if len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0 {
+		pairs = append(pairs, certPair{CertFile: s.config.CertFile, KeyFile: s.config.KeyFile})
+	}
+	pairs = append(pairs, configCerts...)
+	if len(s.config.CertDir) > 0 {
+		var certFiles []string
+		certFiles, err = filepath.Glob(filepath.Join(s.config.CertDir, "*.crt"))
+		if err != nil {
+			return
+		}
+		for _, certFile := range certFiles {
+			keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+			if _, e := os.Stat(keyFile); e != nil {
+				s.Logger.Warn().Str("certFile", certFile).Msg("key file of the cert file not found")
+				continue
+			}
+			pairs = append(pairs, certPair{CertFile: certFile, KeyFile: keyFile})
+		}
+	}
+	return
+}
+
+func (s *Server) hasCerts() bool {
+	return len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0 || len(s.config.Certs) > 0 || len(s.config.CertDir) > 0
+}
+
+// newCertIndex 加载证书并按照证书中的域名建立索引
+func newCertIndex(pairs []certPair) (index *certIndex, err error) {
+	index = &certIndex{
+		exact:     make(map[string]*tls.Certificate),
+		wildcards: make(map[string]*tls.Certificate),
+	}
+	for _, pair := range pairs {
+		crt, e := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if e != nil {
+			return nil, fmt.Errorf("invalid cert '%s' and key '%s', cause %s", pair.CertFile, pair.KeyFile, e.Error())
+		}
+		crt.Leaf, e = x509.ParseCertificate(crt.Certificate[0])
+		if e != nil {
+			return nil, fmt.Errorf("invalid cert '%s', cause %s", pair.CertFile, e.Error())
+		}
+		if index.fallback == nil {
+			index.fallback = &crt
+		}
+		names := crt.Leaf.DNSNames
+		if len(names) == 0 && len(crt.Leaf.Subject.CommonName) > 0 {
+			names = []string{crt.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			m := index.exact
+			if strings.HasPrefix(name, "*.") {
+				name = name[1:]
+				m = index.wildcards
+			}
+			// 先配置的证书优先
+			if _, ok := m[name]; !ok {
+				m[name] = &crt
+			}
+		}
+	}
+	if index.fallback == nil {
+		return nil, errors.New("no cert is found")
+	}
+	return
+}
+
+// lookup 根据 SNI 查找证书，先精确匹配再匹配通配符
+func (i *certIndex) lookup(serverName string) (crt *tls.Certificate, ok bool) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if crt, ok = i.exact[name]; ok {
+		return
+	}
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		crt, ok = i.wildcards[name[dot:]]
+	}
+	return
+}
+
+// getCertificate 根据 SNI 选择证书。启用 ACME 时，没有匹配的证书由 ACME 提供
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	index, _ := s.certs.index.Load().(*certIndex)
+	if s.acme != nil {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return s.acme.manager.GetCertificate(hello)
+			}
+		}
+	}
+	if index != nil {
+		if crt, ok := index.lookup(hello.ServerName); ok {
+			return crt, nil
+		}
+	}
+	if s.acme != nil {
+		return s.acme.manager.GetCertificate(hello)
+	}
+	if index == nil {
+		return nil, errors.New("no cert is loaded")
+	}
+	return index.fallback, nil
+}
+
+// loadCerts 加载证书，失败时保留原来的证书
+func (s *Server) loadCerts(configCerts []certPair) (err error) {
+	pairs, err := s.certPairs(configCerts)
+	if err != nil {
+		return
+	}
+	index, err := newCertIndex(pairs)
+	if err != nil {
+		return
+	}
+	s.certs.index.Store(index)
+	return
+}
+
+// ReloadCerts reloads the certs from certFile/keyFile, certs of the config file and certDir.
+// The tls listener is not restarted, new connections use the reloaded certs.
+func (s *Server) ReloadCerts() (err error) {
+	if !s.hasCerts() {
+		return
+	}
+	conf := Config{}
+	err = config.Yaml2Interface(s.config.Options.Config, &conf)
+	if err != nil {
+		return
+	}
+	err = s.loadCerts(conf.Certs)
+	if err != nil {
+		return
+	}
+	s.Logger.Info().Msg("certs reloaded")
+	return
+}
+
+// certFilesModTime 返回证书相关文件的修改时间，certDir 本身的修改时间用于发现新增或删除的证书
+func (s *Server) certFilesModTime(configCerts []certPair) (modTimes map[string]time.Time) {
+	modTimes = make(map[string]time.Time)
+	paths := []string{s.config.Options.Config, s.config.CertDir}
+	pairs, _ := s.certPairs(configCerts)
+	for _, pair := range pairs {
+		paths = append(paths, pair.CertFile, pair.KeyFile)
+	}
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+	return
+}
+
+// watchCerts 定时检查证书相关文件的修改时间，修改后重新加载证书
+func (s *Server) watchCerts() {
+	if !s.hasCerts() || s.config.CertWatch <= 0 {
+		return
+	}
+	configCerts := s.config.Certs
+	modTimes := s.certFilesModTime(configCerts)
+
+	ticker := time.NewTicker(s.config.CertWatch)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.IsClosing() {
+			return
+		}
+		if len(s.config.Options.Config) > 0 {
+			conf := Config{}
+			if err := config.Yaml2Interface(s.config.Options.Config, &conf); err == nil {
+				configCerts = conf.Certs
+			}
+		}
+		newModTimes := s.certFilesModTime(configCerts)
+		if mapsEqual(modTimes, newModTimes) {
+			continue
+		}
+		modTimes = newModTimes
+		err := s.loadCerts(configCerts)
+		if err != nil {
+			s.Logger.Error().Err(err).Msg("failed to reload certs")
+			continue
+		}
+		s.Logger.Info().Msg("certs reloaded")
+	}
+}
+
+func mapsEqual(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if !b[k].Equal(v) {
+			return false
+		}
+	}
+	return true
+}
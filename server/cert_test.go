@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, dir, name string, dnsNames ...string) certPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := certPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	err = os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestCertIndex(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestCert(t, dir, "a", "a.example.com")
+	b := writeTestCert(t, dir, "b", "*.b.example.com", "b.example.com")
+	index, err := newCertIndex([]certPair{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		serverName string
+		expect     string
+		ok         bool
+	}{
+		{"a.example.com", "a", true},
+		{"A.Example.com.", "a", true},
+		{"b.example.com", "b", true},
+		{"id1.b.example.com", "b", true},
+		{"x.id1.b.example.com", "", false},
+		{"c.example.com", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		crt, ok := index.lookup(c.serverName)
+		if ok != c.ok || ok && crt.Leaf.Subject.CommonName != c.expect {
+			t.Fatalf("lookup(%q) = %v, %v; expect %q, %v", c.serverName, crt, ok, c.expect, c.ok)
+		}
+	}
+
+	s := &Server{}
+	s.certs.index.Store(index)
+	crt, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: "c.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crt.Leaf.Subject.CommonName != "a" {
+		t.Fatal("the first cert should be the fallback")
+	}
+
+	_, err = newCertIndex(nil)
+	if err == nil {
+		t.Fatal("empty certs should fail")
+	}
+	_, err = newCertIndex([]certPair{{CertFile: a.CertFile, KeyFile: b.KeyFile}})
+	if err == nil {
+		t.Fatal("mismatched cert and key should fail")
+	}
+}
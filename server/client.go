@@ -1,9 +1,10 @@
 package server
 
 import (
-	connection "github.com/isrc-cas/gt/conn"
 	"sync"
 	"sync/atomic"
+
+	connection "github.com/isrc-cas/gt/conn"
 )
 
 type client struct {
@@ -14,13 +15,27 @@ type client struct {
 	tasksRWMtx   sync.RWMutex
 	taskIDSeed   uint32
 	closeOnce    sync.Once
+	// services 由第一个 tunnel 声明，之后的 tunnel 必须声明相同的服务
+	services       []*service
+	legacyServices bool
+	servicesMtx    sync.Mutex
+	limiter        limiter
+	ingressBytes   uint64
+	egressBytes    uint64
+	server         *Server
+	// unhealthy 的第 n 位表示客户端报告索引为 n 的服务不健康
+	unhealthy uint64
+	// http2Services 的第 n 位表示索引为 n 的服务支持 h2c
+	http2Services uint64
 }
 
 func newClient() interface{} {
 	return &client{}
 }
 
-func (c *client) init(id string) {
+func (c *client) init(server *Server, id string, limits limits) {
+	c.server = server
+	c.limiter.setLimits(limits)
 	c.tunnelsRWMtx.Lock()
 	c.ID = id
 	c.tunnels = make(map[*conn]struct{})
@@ -28,30 +43,128 @@ func (c *client) init(id string) {
 	c.tasksRWMtx.Lock()
 	c.tasks = make(map[uint32]*conn, 100)
 	c.tasksRWMtx.Unlock()
+	c.servicesMtx.Lock()
+	c.services = nil
+	c.legacyServices = false
+	c.servicesMtx.Unlock()
+	atomic.StoreUint64(&c.unhealthy, 0)
+	atomic.StoreUint64(&c.http2Services, 0)
 }
 
-func (c *client) process(task *conn) {
-	id := atomic.AddUint32(&c.taskIDSeed, 1)
+func (c *client) process(task *conn, service uint16) (err error) {
+	id, tunnel, err := c.startTask(task, service)
+	if err != nil {
+		return
+	}
+	defer c.removeTask(id)
+
+	tunnel.process(id, task, service, c.withServices())
+	return
+}
+
+// startTask 选择 tunnel 并添加 task，成功后需要调用 removeTask
+func (c *client) startTask(task *conn, service uint16) (id uint32, tunnel *conn, err error) {
+	tunnel = c.getTunnel()
+	if tunnel == nil {
+		err = ErrNoTunnel
+		return
+	}
+	if !c.isHealthy(service) {
+		err = ErrServiceUnhealthy
+		return
+	}
+	if !c.limiter.allowConnection() {
+		err = ErrConnectionRateExceeded
+		return
+	}
+
+	id = atomic.AddUint32(&c.taskIDSeed, 1)
 	if id >= connection.PreservedSignal {
 		atomic.StoreUint32(&c.taskIDSeed, 1)
 		id = 1
 	}
-	c.addTask(id, task)
-	defer c.removeTask(id)
+	if tunnel.flowControl {
+		task.sendWindow = connection.NewSendWindow(connection.DefaultWindowSize)
+		task.recvBuffer = connection.NewReceiveBuffer(connection.DefaultWindowSize)
+	}
+	task.client = c
+	if !c.addTask(id, task) {
+		err = ErrTooManyTasks
+	}
+	return
+}
+
+// addIngress 统计从访问者转发到客户端的字节数，超过限制的速率时等待
+func (c *client) addIngress(n int) {
+	atomic.AddUint64(&c.ingressBytes, uint64(n))
+	atomic.AddUint64(&c.server.metrics.ingressBytes, uint64(n))
+	c.limiter.waitIngress(n)
+}
+
+// addEgress 统计从客户端转发到访问者的字节数，速率限制由写入访问者的 task 各自等待
+func (c *client) addEgress(n int) {
+	atomic.AddUint64(&c.egressBytes, uint64(n))
+	atomic.AddUint64(&c.server.metrics.egressBytes, uint64(n))
+}
 
-	tunnel := c.getTunnel()
-	tunnel.process(id, task)
+// setHealthy 记录客户端报告的服务健康状态
+func (c *client) setHealthy(service uint16, healthy bool) {
+	if service >= 64 {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&c.unhealthy)
+		n := old &^ (1 << service)
+		if !healthy {
+			n = old | 1<<service
+		}
+		if atomic.CompareAndSwapUint64(&c.unhealthy, old, n) {
+			return
+		}
+	}
+}
+
+func (c *client) isHealthy(service uint16) bool {
+	return service >= 64 || atomic.LoadUint64(&c.unhealthy)&(1<<service) == 0
+}
+
+// setHTTP2 记录客户端报告的支持 h2c 的服务
+func (c *client) setHTTP2(service uint16) {
+	if service >= 64 {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&c.http2Services)
+		if atomic.CompareAndSwapUint64(&c.http2Services, old, old|1<<service) {
+			return
+		}
+	}
+}
+
+func (c *client) supportsHTTP2(service uint16) bool {
+	return service < 64 && atomic.LoadUint64(&c.http2Services)&(1<<service) != 0
 }
 
-func (c *client) addTunnel(conn *conn) (ok bool) {
+func (c *client) withServices() (ok bool) {
+	c.servicesMtx.Lock()
+	ok = c.services != nil && !c.legacyServices
+	c.servicesMtx.Unlock()
+	return
+}
+
+func (c *client) addTunnel(conn *conn) (ok bool, err error) {
 	c.tunnelsRWMtx.Lock()
 	defer c.tunnelsRWMtx.Unlock()
 
 	if c.tunnels == nil {
-		return false
+		return false, nil
+	}
+	max := c.limiter.getLimits().MaxTunnels
+	if max > 0 && uint32(len(c.tunnels)) >= max {
+		return false, ErrTooManyTunnels
 	}
 	c.tunnels[conn] = struct{}{}
-	return true
+	return true, nil
 }
 
 func (c *client) removeTunnel(conn *conn) {
@@ -59,6 +172,7 @@ func (c *client) removeTunnel(conn *conn) {
 	delete(c.tunnels, conn)
 	if len(c.tunnels) < 1 {
 		c.tunnels = nil
+		c.closeServices()
 		conn.server.removeClient(c.ID)
 	}
 	c.tunnelsRWMtx.Unlock()
@@ -69,6 +183,9 @@ func (c *client) getTunnel() (conn *conn) {
 	defer c.tunnelsRWMtx.RUnlock()
 	var min uint32
 	for t := range c.tunnels {
+		if t.IsClosing() {
+			continue
+		}
 		count := t.GetTasksCount()
 		if count == 0 {
 			conn = t
@@ -82,10 +199,15 @@ func (c *client) getTunnel() (conn *conn) {
 	return
 }
 
-func (c *client) addTask(id uint32, conn *conn) {
+func (c *client) addTask(id uint32, conn *conn) (ok bool) {
+	max := c.limiter.getLimits().MaxTasks
 	c.tasksRWMtx.Lock()
-	c.tasks[id] = conn
+	if max == 0 || uint32(len(c.tasks)) < max {
+		c.tasks[id] = conn
+		ok = true
+	}
 	c.tasksRWMtx.Unlock()
+	return
 }
 
 func (c *client) removeTask(id uint32) {
@@ -103,6 +225,7 @@ func (c *client) getTask(id uint32) (conn *conn, ok bool) {
 
 func (c *client) close() {
 	c.closeOnce.Do(func() {
+		c.closeServices()
 		c.tasksRWMtx.Lock()
 		for _, t := range c.tasks {
 			t.Close()
@@ -118,6 +241,7 @@ func (c *client) close() {
 }
 
 func (c *client) shutdown() {
+	c.closeServices()
 	c.tasksRWMtx.Lock()
 	for _, t := range c.tasks {
 		t.Shutdown()
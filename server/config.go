@@ -3,6 +3,9 @@ package server
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/isrc-cas/gt/config"
@@ -15,25 +18,45 @@ import (
 type Config struct {
 	Version string          // 目前未使用
 	Users   map[string]user `yaml:"users"`
+	Certs   []certPair      `yaml:"certs"`
 	Options
 }
 
 // Options is the config Options for a server.
 type Options struct {
-	Config        string `arg:"config" yaml:"-" usage:"The config file path to load"`
-	Addr          string `yaml:"addr" usage:"The address to listen on. Supports values like: '80', ':80' or '0.0.0.0:80'"`
-	TLSAddr       string `yaml:"tlsAddr" usage:"The address for tls to listen on. Supports values like: '443', ':443' or '0.0.0.0:443'"`
-	TLSMinVersion string `yaml:"tlsVersion" usage:"The tls min version, supported values: tls1.1, tls1.2, tls1.3"`
-	CertFile      string `yaml:"certFile" usage:"The path to cert file"`
-	KeyFile       string `yaml:"keyFile" usage:"The path to key file"`
+	Config        string        `arg:"config" yaml:"-" usage:"The config file path to load"`
+	Addr          string        `yaml:"addr" usage:"The address to listen on. Supports values like: '80', ':80' or '0.0.0.0:80'"`
+	TLSAddr       string        `yaml:"tlsAddr" usage:"The address for tls to listen on. Supports values like: '443', ':443' or '0.0.0.0:443'"`
+	TLSMinVersion string        `yaml:"tlsVersion" usage:"The tls min version, supported values: tls1.1, tls1.2, tls1.3"`
+	CertFile      string        `yaml:"certFile" usage:"The path to cert file"`
+	KeyFile       string        `yaml:"keyFile" usage:"The path to key file"`
+	CertDir       string        `yaml:"certDir" usage:"The directory of certs, '<name>.crt' and '<name>.key' are loaded as a pair. Certs are selected by Server Name Indication"`
+	CertWatch     time.Duration `yaml:"certWatch" usage:"The interval to check whether the certs are modified, certs are reloaded when they are modified. 0 (default) means disabled. Certs are always reloaded on SIGHUP"`
+
+	ACME             bool               `yaml:"acme" usage:"Obtain and renew certificates on demand from an ACME CA such as Let's Encrypt for hosts of registered clients that match none of the configured certs. HTTP-01 challenges are served on addr and TLS-ALPN-01 challenges on tlsAddr"`
+	ACMECacheDir     string             `yaml:"acmeCacheDir" usage:"The directory to cache the ACME account and certificates"`
+	ACMEEmail        string             `yaml:"acmeEmail" usage:"The contact email of the ACME account"`
+	ACMEDirectoryURL string             `yaml:"acmeDirectoryURL" usage:"The ACME directory URL. Let's Encrypt is used when it is empty"`
+	ACMEDomains      config.StringSlice `yaml:"acmeDomain" usage:"The base domain to obtain certificates for hosts like '<id>.<domain>' under, and '<subdomain>.<id>.<domain>' when the connected client declares the subdomain. Repeat it for multiple domains. Exact custom hosts of users are always allowed"`
+
+	TunnelClientCA     string `yaml:"tunnelClientCA" usage:"The path to the CA cert file to verify client certs of tunnels. When it is set, tunnels must connect to tlsAddr or quicAddr with a client cert signed by the CA, and the id must be the common name or one of the DNS names of the cert"`
+	TunnelClientSecret bool   `yaml:"tunnelClientSecret" usage:"Verify the secret of tunnels in addition to the client cert"`
+
+	TunnelWebSocketPath string `yaml:"tunnelWebSocketPath" usage:"The path on addr and tlsAddr to accept tunnels over WebSocket, such as '/tunnel'. Tunnels over WebSocket are disabled when it is empty"`
+	QUICAddr            string `yaml:"quicAddr" usage:"The udp address for tunnels over QUIC to listen on, it requires certs. Supports values like: '443', ':443' or '0.0.0.0:443'"`
 
 	ID             config.StringSlice `arg:"id" yaml:"-" usage:"The user id"`
 	Secret         config.StringSlice `arg:"secret" yaml:"-" usage:"The secret for user id"`
 	Users          string             `yaml:"users" usage:"The users yaml file to load"`
+	UsersWatch     time.Duration      `yaml:"usersWatch" usage:"The interval to check whether the config file and the users file are modified, users are reloaded when they are modified. 0 (default) means disabled. Users are always reloaded on SIGHUP"`
 	AuthAPI        string             `yaml:"authAPI" usage:"The API to authenticate user with id and secret"`
 	AllowAnyClient bool               `yaml:"allowAnyClient" usage:"Allow any client to connect to the server"`
 
 	HTTPMUXHeader string `yaml:"httpMUXHeader" usage:"The http multiplexing header to be used"`
+	HTTP2         bool   `yaml:"http2" usage:"Accept HTTP/2 on addr without TLS (h2c) and on tlsAddr negotiated by ALPN (h2). Every stream is routed by its authority, and forwarded as HTTP/2 to the local services declared with localHTTP2 by clients, as HTTP/1.1 to others"`
+
+	UnhealthyStatus int    `yaml:"unhealthyStatus" usage:"The http status code answered to the requests of the local services that are reported unhealthy by clients, supported values: 502, 503"`
+	UnhealthyPage   string `yaml:"unhealthyPage" usage:"The path to the html page answered to the requests of the local services that are reported unhealthy by clients"`
 
 	Timeout                        time.Duration `yaml:"timeout" usage:"The timeout of connections. Supports values like '30s', '5m'"`
 	TimeoutOnUnidirectionalTraffic bool          `yaml:"timeoutOnUnidirectionalTraffic" usage:"Timeout will happens when traffic is unidirectional"`
@@ -43,11 +66,21 @@ type Options struct {
 	APICertFile      string `yaml:"apiCertFile" usage:"The path to cert file"`
 	APIKeyFile       string `yaml:"apiKeyFile" usage:"The path to key file"`
 	APITLSMinVersion string `yaml:"apiTLSVersion" usage:"The tls min version, supported values: tls1.1, tls1.2, tls1.3"`
+	APIAdminToken    string `yaml:"apiAdminToken" json:"-" usage:"The bearer token to access the admin api of the internal api service. The admin api is disabled when it is empty"`
+
+	AddrProxyProtocol    string             `yaml:"addrProxyProtocol" usage:"Read the PROXY protocol v1 or v2 header sent by the load balancer in front of addr, supported values: accept (the header is optional), require. The header is only read from the sources in proxyProtocolTrusted"`
+	TLSAddrProxyProtocol string             `yaml:"tlsAddrProxyProtocol" usage:"Read the PROXY protocol v1 or v2 header sent by the load balancer in front of tlsAddr, supported values: accept (the header is optional), require. The header is only read from the sources in proxyProtocolTrusted"`
+	SNIAddrProxyProtocol string             `yaml:"sniAddrProxyProtocol" usage:"Read the PROXY protocol v1 or v2 header sent by the load balancer in front of sniAddr, supported values: accept (the header is optional), require. The header is only read from the sources in proxyProtocolTrusted"`
+	ProxyProtocolTrusted config.StringSlice `yaml:"proxyProtocolTrusted" usage:"The CIDRs or IPs of the load balancers trusted to send the PROXY protocol header, such as '10.0.0.0/8'. Connections from other sources are closed by listeners requiring the header"`
 
 	STUNAddr string `yaml:"stunAddr" usage:"The address to listen on for STUN service. Supports values like: '3478', ':3478' or '0.0.0.0:3478'"`
 
 	SNIAddr string `yaml:"sniAddr" usage:"The address to listen on for raw tls proxy. Host comes from Server Name Indication. Supports values like: '443', ':443' or '0.0.0.0:443'"`
 
+	TCPRange   string        `yaml:"tcpRange" usage:"The port range that clients can open for tcp forwarding. Supports values like: '10000-20000' or '10000'. tcp forwarding is disabled when it is empty"`
+	UDPRange   string        `yaml:"udpRange" usage:"The port range that clients can open for udp forwarding. Supports values like: '10000-20000' or '10000'. udp forwarding is disabled when it is empty"`
+	UDPTimeout time.Duration `yaml:"udpTimeout" usage:"The idle timeout of udp sessions. Supports values like '30s', '5m'"`
+
 	SentryDSN         string             `yaml:"sentryDSN" usage:"Sentry DSN to use"`
 	SentryLevel       config.StringSlice `yaml:"sentryLevel" usage:"Sentry levels: trace, debug, info, warn, error, fatal, panic (default [\"error\", \"fatal\", \"panic\"])"`
 	SentrySampleRate  float64            `yaml:"sentrySampleRate" usage:"Sentry sample rate for event submission: [0.0 - 1.0]"`
@@ -68,6 +101,8 @@ func defaultConfig() Config {
 		Options: Options{
 			Addr:             "80",
 			Timeout:          90 * time.Second,
+			UDPTimeout:       60 * time.Second,
+			ACMECacheDir:     "acme",
 			TLSMinVersion:    "tls1.2",
 			APITLSMinVersion: "tls1.2",
 			LogFileMaxCount:  7,
@@ -78,6 +113,8 @@ func defaultConfig() Config {
 			SentryRelease:    predef.Version,
 
 			HTTPMUXHeader: "Host",
+
+			UnhealthyStatus: http.StatusServiceUnavailable,
 		},
 	}
 }
@@ -85,12 +122,17 @@ func defaultConfig() Config {
 // user 用户权限细节
 type user struct {
 	Secret string
+	// Hosts 自定义的 host，支持 app.example.com 与 *.example.com 两种形式
+	Hosts  []string
+	limits `yaml:",inline"`
 	temp   bool
 }
 
 // users 客户端的权限管理
 type users struct {
 	sync.Map
+	// verified 缓存每个 id 验证成功的哈希 secret 的摘要
+	verified sync.Map
 }
 
 // 合并 users 配置文件和命令行的 users
@@ -111,6 +153,32 @@ func (u *users) mergeUsers(users map[string]user, id, secret []string) error {
 	return u.verify()
 }
 
+// reload 使用 newUsers 替换配置的用户，返回被删除或者 secret 被修改的 id。
+// allowAnyClient 模式下临时创建的用户只有在 secret 与新配置冲突时才会被替换。
+func (u *users) reload(newUsers *users) (changed []string) {
+	u.Range(func(idValue, userValue interface{}) bool {
+		id := idValue.(string)
+		old := userValue.(user)
+		value, ok := newUsers.Load(id)
+		if !ok {
+			if !old.temp {
+				u.Delete(id)
+				changed = append(changed, id)
+			}
+			return true
+		}
+		if value.(user).Secret != old.Secret {
+			changed = append(changed, id)
+		}
+		return true
+	})
+	newUsers.Range(func(idValue, userValue interface{}) bool {
+		u.Store(idValue, userValue)
+		return true
+	})
+	return
+}
+
 func (u *users) verify() (err error) {
 	u.Range(func(idValue, userValue interface{}) bool {
 		id := idValue.(string)
@@ -119,7 +187,14 @@ func (u *users) verify() (err error) {
 			err = fmt.Errorf("invalid id length: '%s'", id)
 		}
 
-		if len(user.Secret) < predef.MinSecretSize || len(user.Secret) > predef.MaxSecretSize {
+		if e := user.limits.verify(); e != nil {
+			err = fmt.Errorf("invalid limits of id '%s': %s", id, e)
+		}
+		if isHashedSecret(user.Secret) {
+			if e := checkSecretHash(user.Secret); e != nil {
+				err = fmt.Errorf("invalid secret hash of id '%s': %s", id, e)
+			}
+		} else if len(user.Secret) < predef.MinSecretSize || len(user.Secret) > predef.MaxSecretSize {
 			err = fmt.Errorf("invalid secret length: '%s'", user.Secret)
 		}
 		return true
@@ -141,7 +216,7 @@ func (u *users) auth(id string, secret string) (ok bool) {
 	if !ok {
 		return
 	}
-	if ud, ok := value.(user); ok && ud.Secret == secret {
+	if ud, ok := value.(user); ok && u.verifySecret(id, ud.Secret, secret) {
 		return true
 	}
 	return
@@ -151,3 +226,36 @@ func (u *users) idConflict(id string) bool {
 	_, ok := u.Load(id)
 	return ok
 }
+
+// parsePortRange 解析 tcpRange 配置，支持 'min-max' 与单个端口两种格式
+func parsePortRange(s string) (min, max uint16, err error) {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		var port uint64
+		port, err = strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+		if err != nil || port == 0 {
+			err = fmt.Errorf("invalid port range '%s'", s)
+			return
+		}
+		min = uint16(port)
+		max = min
+		return
+	}
+	minPort, err := strconv.ParseUint(strings.TrimSpace(s[:i]), 10, 16)
+	if err != nil {
+		err = fmt.Errorf("invalid port range '%s'", s)
+		return
+	}
+	maxPort, err := strconv.ParseUint(strings.TrimSpace(s[i+1:]), 10, 16)
+	if err != nil {
+		err = fmt.Errorf("invalid port range '%s'", s)
+		return
+	}
+	if minPort == 0 || minPort > maxPort {
+		err = fmt.Errorf("invalid port range '%s'", s)
+		return
+	}
+	min = uint16(minPort)
+	max = uint16(maxPort)
+	return
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		min     uint16
+		max     uint16
+		wantErr bool
+	}{
+		{"10000-20000", 10000, 20000, false},
+		{" 10000 - 20000 ", 10000, 20000, false},
+		{"10000", 10000, 10000, false},
+		{"20000-10000", 0, 0, true},
+		{"0-100", 0, 0, true},
+		{"0", 0, 0, true},
+		{"10000-", 0, 0, true},
+		{"abc", 0, 0, true},
+		{"10000-70000", 0, 0, true},
+	}
+	for _, tt := range tests {
+		min, max, err := parsePortRange(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%q: err = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if min != tt.min || max != tt.max {
+			t.Fatalf("%q: got %d-%d, expected %d-%d", tt.value, min, max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestConfigJSONHidesTokens(t *testing.T) {
+	c := defaultConfig()
+	c.APIAdminToken = "admin-token-value"
+	data, err := json.Marshal(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), c.APIAdminToken) {
+		t.Fatalf("the logged config contains the admin token: %s", data)
+	}
+}
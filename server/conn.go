@@ -1,13 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -16,6 +21,7 @@ import (
 	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/pool"
 	"github.com/isrc-cas/gt/predef"
+	"github.com/quic-go/quic-go"
 )
 
 var (
@@ -23,11 +29,33 @@ var (
 	ErrInvalidID = errors.New("invalid id")
 	// ErrIDNotFound is an error returned when id is not in the url
 	ErrIDNotFound = errors.New("id not found")
+	// ErrNoTunnel is an error returned when the client has no tunnel available
+	ErrNoTunnel = errors.New("no tunnel available")
+	// ErrServiceUnhealthy is an error returned when the client reports the local service is unhealthy
+	ErrServiceUnhealthy = errors.New("local service is unhealthy")
 )
 
 type conn struct {
 	connection.Connection
 	server *Server
+
+	// flowControl 表示 tunnel 使用 predef.Version2，streams 是 tunnel 上正在转发的 task
+	flowControl bool
+	streams     map[uint32]*conn
+	streamsMtx  sync.Mutex
+	// task 的流量控制窗口，tunnel 使用 predef.Version2 时有效
+	sendWindow *connection.SendWindow
+	recvBuffer *connection.ReceiveBuffer
+	// client 是 task 所属的客户端
+	client *client
+	// connectedAt 是 tunnel 开始握手的时间
+	connectedAt time.Time
+	// quic 是 tunnel 所在的 QUIC 连接，每个 task 使用独立的 stream
+	quic *quic.Conn
+	// visitorAddrs 表示客户端要求每个 task 携带访问者的地址
+	visitorAddrs bool
+	// visitor 是 task 对应的访问者连接，为 nil 时 task 就是访问者连接
+	visitor net.Conn
 }
 
 func newConn(c net.Conn, s *Server) *conn {
@@ -47,6 +75,34 @@ func newConn(c net.Conn, s *Server) *conn {
 }
 
 func (c *conn) handle(handleFunc func() bool) {
+	c.serve(func() (handled bool) {
+		version, err := c.Reader.Peek(2)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				c.Logger.Warn().Err(err).Msg("failed to peek version field")
+			}
+			return
+		}
+		if version[0] == predef.VersionFirst {
+			switch version[1] {
+			case predef.Version1, predef.Version2:
+				// QUIC 的 stream 自带流量控制
+				c.flowControl = version[1] == predef.Version2 && c.quic == nil
+				_, err = c.Reader.Discard(2)
+				if err != nil {
+					c.Logger.Warn().Err(err).Msg("failed to discard version field")
+					return
+				}
+				handled = c.handleTunnel()
+				return
+			}
+		}
+		handled = handleFunc()
+		return
+	})
+}
+
+func (c *conn) serve(handleFunc func() bool) {
 	startTime := time.Now()
 	reader := pool.GetReader(c.Conn)
 	c.Reader = reader
@@ -74,26 +130,93 @@ func (c *conn) handle(handleFunc func() bool) {
 		}
 	}
 
-	version, err := reader.Peek(2)
+	handled = handleFunc()
+}
+
+// Close closes the conn and its flow control windows
+func (c *conn) Close() {
+	c.Connection.Close()
+	c.closeWindows()
+}
+
+func (c *conn) closeWindows() {
+	if c.sendWindow != nil {
+		c.sendWindow.Close()
+		c.recvBuffer.Close()
+	}
+}
+
+func (c *conn) addStream(id uint32, task *conn) {
+	c.streamsMtx.Lock()
+	if c.streams == nil {
+		c.streams = make(map[uint32]*conn)
+	}
+	c.streams[id] = task
+	c.streamsMtx.Unlock()
+}
+
+func (c *conn) removeStream(id uint32) {
+	c.streamsMtx.Lock()
+	delete(c.streams, id)
+	c.streamsMtx.Unlock()
+}
+
+// closeStreams 关闭 tunnel 上所有的 task，避免 task 一直等待不会再更新的窗口
+func (c *conn) closeStreams() {
+	c.streamsMtx.Lock()
+	for _, task := range c.streams {
+		task.Close()
+	}
+	c.streamsMtx.Unlock()
+}
+
+// writeLoop 将 task 缓存的数据写入 task，并通知对方更新窗口
+func (c *conn) writeLoop(id uint32, task *conn) {
+	err := task.recvBuffer.WriteTo(egressWriter{task}, func(n uint32) error {
+		return c.SendWindowUpdate(id, n)
+	})
 	if err != nil {
-		if !errors.Is(err, io.EOF) {
-			c.Logger.Warn().Err(err).Msg("failed to peek version field")
-		}
-		return
+		c.Logger.Debug().Err(err).Uint32("id", id).Msg("writeLoop ended")
 	}
-	if version[0] == predef.VersionFirst {
-		switch version[1] {
-		case 0x01:
-			_, err = reader.Discard(2)
-			if err != nil {
-				c.Logger.Warn().Err(err).Msg("failed to discard version field")
-				return
-			}
-			handled = c.handleTunnel()
-			return
-		}
+	task.Close()
+}
+
+// egressWriter 将数据写入 task 后按客户端的出口速率等待，只阻塞当前 task
+type egressWriter struct {
+	task *conn
+}
+
+func (w egressWriter) Write(p []byte) (n int, err error) {
+	n, err = w.task.Write(p)
+	if n > 0 {
+		w.task.client.limiter.waitEgress(n)
+	}
+	return
+}
+
+// visitorAddr 返回 task 对应的访问者连接的地址
+func (c *conn) visitorAddr() *connection.Visitor {
+	visitor := c.visitor
+	if visitor == nil {
+		visitor = c.Conn
+	}
+	_, ok := visitor.(*tls.Conn)
+	return &connection.Visitor{
+		RemoteAddr: visitor.RemoteAddr().String(),
+		LocalAddr:  visitor.LocalAddr().String(),
+		TLS:        ok,
+	}
+}
+
+func (c *conn) handleForwarding(client *client, service uint16) (handled bool) {
+	defer func() {
+		atomic.AddUint64(&c.server.served, 1)
+		handled = true
+	}()
+	err := client.process(c, service)
+	if err != nil {
+		c.Logger.Debug().Str("id", client.ID).Err(err).Msg("handleForwarding")
 	}
-	handled = handleFunc()
 	return
 }
 
@@ -116,21 +239,15 @@ func (c *conn) handleSNI() (handled bool) {
 		err = ErrInvalidHTTPProtocol
 		return
 	}
-	id, err := parseIDFromHost(host)
+	client, subdomain, err := c.getClientByHost(host)
 	if err != nil {
 		return
 	}
-	if len(id) < predef.MinIDSize {
-		err = ErrInvalidID
+	service, err := client.matchHTTPService(subdomain, nil, nil)
+	if err != nil {
 		return
 	}
-	client, ok := c.server.getClient(string(id))
-	if ok {
-		client.process(c)
-	} else {
-		err = ErrIDNotFound
-	}
-
+	err = client.process(c, service)
 	return
 }
 
@@ -144,40 +261,120 @@ func (c *conn) handleHTTP() (handled bool) {
 		atomic.AddUint64(&c.server.served, 1)
 		handled = true
 	}()
-	var id []byte
-	if c.server.config.HTTPMUXHeader == "Host" {
-		host, err = peekHost(c.Reader)
-		if err != nil {
+	if c.server.config.HTTP2 && c.isHTTP2() {
+		c.serveHTTP2()
+		return
+	}
+	if c.server.acme != nil && c.server.acme.httpHandler != nil {
+		var path []byte
+		path, err = peekRequestPath(c.Reader)
+		if err == nil && bytes.HasPrefix(path, []byte(acmeChallengePathPrefix)) {
+			err = c.serveACMEChallenge()
 			return
 		}
-		if len(host) < 1 {
+		err = nil
+	}
+	if len(c.server.config.TunnelWebSocketPath) > 0 {
+		var path []byte
+		path, err = peekRequestPath(c.Reader)
+		if err == nil && c.server.isWebSocketTunnelPath(path) {
+			err = c.serveWebSocketTunnel()
+			return
+		}
+		err = nil
+	}
+	requests := newHTTPRequests(c)
+	req, err := requests.readRequest()
+	if err != nil {
+		return
+	}
+	host = req.host
+	client, service, err := c.routeHTTP(req)
+	if err != nil {
+		return
+	}
+	err = requests.serve(req, client, service)
+	return
+}
+
+// routeHTTP 根据 host 或者 HTTPMUXHeader 选择请求的客户端与服务
+func (c *conn) routeHTTP(req *httpRequest) (client *client, service uint16, err error) {
+	var subdomain []byte
+	if strings.EqualFold(c.server.config.HTTPMUXHeader, "Host") {
+		if len(req.host) < 1 {
 			err = ErrInvalidHTTPProtocol
 			return
 		}
-		id, err = parseIDFromHost(host)
+		if len(req.host) > 512 {
+			err = ErrInvalidHeaderLength
+			return
+		}
+		client, subdomain, err = c.getClientByHost(req.host)
 		if err != nil {
 			return
 		}
 	} else {
-		id, err = peekHeader(c.Reader, c.server.config.HTTPMUXHeader+":")
-		if err != nil {
+		id := req.header([]byte(c.server.config.HTTPMUXHeader))
+		if len(id) > 512 {
+			err = ErrInvalidHeaderLength
+			return
+		}
+		if len(id) < predef.MinIDSize {
+			err = ErrInvalidID
+			return
+		}
+		var ok bool
+		client, ok = c.server.getClient(string(id))
+		if !ok {
+			err = ErrIDNotFound
+			return
+		}
+	}
+	service, err = client.matchHTTPService(subdomain, func() []byte {
+		return req.path
+	}, req.header)
+	return
+}
+
+// getClientByHost 根据 host 查找客户端，优先使用 users 中配置的 hosts，
+// 否则 host 的格式为 <id>.<domain> 或 <subdomain>.<id>.<domain>
+func (c *conn) getClientByHost(host []byte) (client *client, subdomain []byte, err error) {
+	if id, ok := c.server.hosts.lookup(host); ok {
+		client, ok = c.server.getClient(id)
+		if !ok {
+			err = ErrIDNotFound
+		}
+		return
+	}
+	id, err := parseIDFromHost(host)
+	if err != nil {
+		return
+	}
+	if len(id) >= predef.MinIDSize {
+		var ok bool
+		client, ok = c.server.getClient(string(id))
+		if ok {
 			return
 		}
 	}
+	subdomain, id, err = parseSubdomainAndIDFromHost(host)
+	if err != nil {
+		err = ErrIDNotFound
+		return
+	}
 	if len(id) < predef.MinIDSize {
 		err = ErrInvalidID
 		return
 	}
 	client, ok := c.server.getClient(string(id))
-	if ok {
-		client.process(c)
-	} else {
+	if !ok {
 		err = ErrIDNotFound
 	}
 	return
 }
 
 func (c *conn) handleTunnel() (handled bool) {
+	c.connectedAt = time.Now()
 	reader := c.Reader
 
 	// 读取 id 相关
@@ -224,8 +421,13 @@ func (c *conn) handleTunnel() (handled bool) {
 		return
 	}
 
-	// 验证 id secret
-	if err := c.server.authUser(idStr, secretStr); err != nil {
+	// 验证 id secret，配置了 tunnelClientCA 时使用客户端证书验证 id
+	if err := c.authTunnel(idStr, secretStr); err != nil {
+		if errors.Is(err, ErrInvalidUser) {
+			atomic.AddUint64(&c.server.metrics.invalidUsers, 1)
+		} else {
+			atomic.AddUint64(&c.server.metrics.authAPIErrors, 1)
+		}
 		e := c.SendErrorSignalInvalidIDAndSecret()
 		c.Logger.Debug().Err(err).AnErr("respErr", e).Msg("invalid id and secret")
 		return
@@ -236,7 +438,13 @@ func (c *conn) handleTunnel() (handled bool) {
 		c.Logger.Error().Err(err).Msg("failed to read optionByte")
 		return
 	}
-	_ = optionByte
+	services, legacy, err := c.readServices(optionByte)
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("failed to read services")
+		return
+	}
+	// 在 tunnel 可以转发 task 之前设置
+	c.visitorAddrs = optionByte&predef.OptionVisitorAddr != 0
 
 	var cli *client
 	var ok bool
@@ -245,10 +453,15 @@ func (c *conn) handleTunnel() (handled bool) {
 		var exists bool
 		cli, exists = c.server.getOrCreateClient(idStr, newClient)
 		if !exists {
-			cli.init(idStr)
+			cli.init(c.server, idStr, c.server.getLimits(idStr))
 		}
 
-		ok = cli.addTunnel(c)
+		ok, err = cli.addTunnel(c)
+		if err != nil {
+			e := c.SendErrorSignalTooManyTunnels()
+			c.Logger.Error().Err(err).AnErr("respErr", e).Msg("failed to add tunnel")
+			return
+		}
 		if ok {
 			break
 		}
@@ -258,12 +471,112 @@ func (c *conn) handleTunnel() (handled bool) {
 		return
 	}
 	defer cli.removeTunnel(c)
+	services, failed, err := cli.openServices(c.server, services, legacy)
+	if err != nil {
+		var e error
+		switch {
+		case failed == nil:
+			e = c.SendErrorSignalServicesMismatch()
+		case failed.typ == predef.ServiceTCP:
+			e = c.SendErrorSignalFailedToOpenTCPPort()
+		default:
+			e = c.SendErrorSignalFailedToOpenUDPPort()
+		}
+		c.Logger.Error().Err(err).AnErr("respErr", e).Msg("failed to open services")
+		return
+	}
+	for _, svc := range services {
+		if svc.typ == predef.ServiceHTTP {
+			continue
+		}
+		switch {
+		case !legacy:
+			err = c.SendInfoServicePortOpened(svc.index, svc.openedPort)
+		case svc.typ == predef.ServiceTCP:
+			err = c.SendInfoTCPPortOpened(svc.openedPort)
+		default:
+			err = c.SendInfoUDPPortOpened(svc.openedPort)
+		}
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to send opened port")
+			return
+		}
+	}
+	if optionByte&predef.OptionMaxTunnels != 0 {
+		err = c.SendInfoMaxTunnels(cli.limiter.getLimits().MaxTunnels)
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to send max tunnels")
+			return
+		}
+	}
+	if optionByte&predef.OptionServiceHealth != 0 {
+		err = c.SendInfoServiceHealthAccepted()
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to accept the health of services")
+			return
+		}
+	}
+	if optionByte&predef.OptionHTTP2Services != 0 {
+		err = c.SendInfoHTTP2ServicesAccepted()
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to accept the services supporting h2c")
+			return
+		}
+	}
+	if c.visitorAddrs {
+		err = c.SendInfoVisitorAddrAccepted()
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("failed to accept the addresses of visitors")
+			return
+		}
+	}
 	atomic.AddUint64(&c.server.tunneling, 1)
+	c.server.metrics.handshake.Observe(time.Since(c.connectedAt).Seconds())
 	handled = true
 	c.readLoop(cli)
 	return
 }
 
+// readInfo 读取客户端发送的服务健康状态
+func (c *conn) readInfo(cli *client) (err error) {
+	peekBytes, err := c.Reader.Peek(4)
+	if err != nil {
+		return
+	}
+	info := connection.Info(binary.BigEndian.Uint16(peekBytes))
+	service := binary.BigEndian.Uint16(peekBytes[2:])
+	switch info {
+	case connection.InfoServiceHealthy, connection.InfoServiceUnhealthy, connection.InfoServiceHTTP2:
+	default:
+		err = fmt.Errorf("unknown info signal %d", info)
+		return
+	}
+	_, err = c.Reader.Discard(4)
+	if err != nil {
+		return
+	}
+	if info == connection.InfoServiceHTTP2 {
+		cli.setHTTP2(service)
+		return
+	}
+	healthy := info == connection.InfoServiceHealthy
+	if healthy != cli.isHealthy(service) {
+		c.Logger.Info().Uint16("service", service).Bool("healthy", healthy).Msg("service health changed")
+	}
+	cli.setHealthy(service, healthy)
+	return
+}
+
+func (c *conn) readPort() (port uint16, err error) {
+	peekBytes, err := c.Reader.Peek(2)
+	if err != nil {
+		return
+	}
+	port = binary.BigEndian.Uint16(peekBytes)
+	_, err = c.Reader.Discard(2)
+	return
+}
+
 func (c *conn) GetTasksCount() uint32 {
 	return atomic.LoadUint32(&c.TasksCount)
 }
@@ -275,6 +588,9 @@ func (c *conn) readLoop(cli *client) {
 			err = nil
 		}
 		c.Logger.Debug().Err(err).Msg("readLoop ended")
+		if c.flowControl {
+			c.closeStreams()
+		}
 	}()
 	err = c.SendReadySignal()
 	if err != nil {
@@ -314,7 +630,19 @@ func (c *conn) readLoop(cli *client) {
 			if predef.Debug {
 				c.Logger.Trace().Msg("readLoop read close signal")
 			}
-			return
+			// 不再分配新的 task，已经分配的 task 结束后由 process 发送关闭信号并关闭 tunnel
+			c.Shutdown()
+			if c.GetTasksCount() == 0 {
+				c.SendCloseSignal()
+				return
+			}
+			continue
+		case connection.InfoSignal:
+			err = c.readInfo(cli)
+			if err != nil {
+				return
+			}
+			continue
 		}
 		if predef.Debug {
 			c.Logger.Trace().Uint32("id", id).Msg("readLoop read id")
@@ -328,32 +656,48 @@ func (c *conn) readLoop(cli *client) {
 		if err != nil {
 			return
 		}
-		task, ok := cli.getTask(id)
-		if !ok {
-			bs, err := ioutil.ReadAll(r)
-			c.Logger.Trace().Uint16("op", op).Hex("content", bs).Err(err).Uint32("id", id).Msg("orphan resp")
-			continue
-		}
-		switch op {
-		case predef.Data:
-			if predef.Debug {
-				c.Logger.Trace().Uint32("id", id).Msg("read data op")
-			}
+		var l uint32
+		if op == predef.Data || op == predef.WindowUpdate {
 			peekBytes, err = c.Reader.Peek(4)
 			if err != nil {
 				return
 			}
-			l := uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
+			l = uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
 			_, err = c.Reader.Discard(4)
 			if err != nil {
 				return
 			}
+		}
+		task, ok := cli.getTask(id)
+		if !ok {
+			if op == predef.Data {
+				r.Reader = c.Reader
+				r.N = int64(l)
+				bs, err := ioutil.ReadAll(r)
+				c.Logger.Trace().Uint16("op", op).Hex("content", bs).Err(err).Uint32("id", id).Msg("orphan resp")
+			}
+			continue
+		}
+		switch op {
+		case predef.WindowUpdate:
+			if task.sendWindow != nil {
+				task.sendWindow.Update(l)
+			}
+		case predef.Data:
 			if predef.Debug {
-				c.Logger.Trace().Uint32("len", l).Msg("readLoop read len")
+				c.Logger.Trace().Uint32("id", id).Uint32("len", l).Msg("read data op")
 			}
 			r.Reader = c.Reader
 			r.N = int64(l)
-			if !predef.Debug {
+			if task.recvBuffer != nil {
+				err = task.recvBuffer.Fill(r, int(l))
+				if errors.Is(err, connection.ErrWindowExceeded) {
+					c.Logger.Debug().Err(err).Uint32("id", id).Msg("task exceeded the window")
+					task.Close()
+					err = nil
+					continue
+				}
+			} else if !predef.Debug {
 				_, err = r.WriteTo(task)
 			} else {
 				err = func() error {
@@ -402,19 +746,34 @@ func (c *conn) readLoop(cli *client) {
 					task.Close()
 				}
 			}
+			// 没有流量控制的 predef.Version1 tunnel 不限制出口速率，在 readLoop 中等待会阻塞 tunnel 上所有的 task
+			cli.addEgress(int(l))
 		case predef.Close:
 			if predef.Debug {
 				c.Logger.Trace().Uint32("id", id).Msg("read close op")
 			}
-			if ok {
+			if task.recvBuffer != nil {
+				task.recvBuffer.Close()
+			} else {
 				task.Close()
 			}
 		}
 	}
 }
 
-func (c *conn) process(id uint32, task *conn) {
+// process 将 task 的数据转发给 tunnel，withService 为 true 时，
+// 第一个数据帧使用 predef.ServicesData 携带服务的索引
+func (c *conn) process(id uint32, task *conn, service uint16, withService bool) {
+	if c.quic != nil {
+		c.processStream(id, task, service)
+		return
+	}
 	atomic.AddUint32(&c.TasksCount, 1)
+	if c.flowControl {
+		c.addStream(id, task)
+		defer c.removeStream(id)
+		go c.writeLoop(id, task)
+	}
 	var rErr error
 	var wErr error
 	buf := pool.BytesPool.Get().([]byte)
@@ -435,9 +794,29 @@ func (c *conn) process(id uint32, task *conn) {
 			c.Close()
 		}
 	}()
+	if c.visitorAddrs {
+		binary.BigEndian.PutUint32(buf[0:], id)
+		binary.BigEndian.PutUint16(buf[4:], predef.VisitorAddr)
+		var frame []byte
+		frame, rErr = connection.AppendVisitor(buf[:6], task.visitorAddr())
+		if rErr != nil {
+			return
+		}
+		_, wErr = c.Write(frame)
+		if wErr != nil {
+			return
+		}
+	}
 	for {
 		binary.BigEndian.PutUint32(buf[0:], id)
-		binary.BigEndian.PutUint16(buf[4:], predef.Data)
+		headerLen := 10
+		if withService {
+			binary.BigEndian.PutUint16(buf[4:], predef.ServicesData)
+			binary.BigEndian.PutUint16(buf[6:], service)
+			headerLen = 12
+		} else {
+			binary.BigEndian.PutUint16(buf[4:], predef.Data)
+		}
 		if c.server.config.Timeout > 0 {
 			dl := time.Now().Add(c.server.config.Timeout)
 			rErr = task.SetReadDeadline(dl)
@@ -445,11 +824,24 @@ func (c *conn) process(id uint32, task *conn) {
 				return
 			}
 		}
+		end := len(buf)
+		if c.flowControl {
+			var n int
+			n, rErr = task.sendWindow.Available(end - headerLen)
+			if rErr != nil {
+				return
+			}
+			end = headerLen + n
+		}
 		var l int
-		l, rErr = task.Reader.Read(buf[10:])
+		l, rErr = task.Reader.Read(buf[headerLen:end])
+		if c.flowControl {
+			task.sendWindow.Consume(l)
+		}
 		if l > 0 {
-			binary.BigEndian.PutUint32(buf[6:], uint32(l))
-			l += 10
+			binary.BigEndian.PutUint32(buf[headerLen-4:], uint32(l))
+			l += headerLen
+			withService = false
 
 			if predef.Debug {
 				c.Logger.Trace().Hex("data", buf[:l]).Msg("write")
@@ -458,6 +850,7 @@ func (c *conn) process(id uint32, task *conn) {
 			if wErr != nil {
 				return
 			}
+			task.client.addIngress(l - headerLen)
 			if c.server.config.Timeout > 0 && !c.server.config.TimeoutOnUnidirectionalTraffic {
 				dl := time.Now().Add(c.server.config.Timeout)
 				wErr = c.SetReadDeadline(dl)
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// hostIndex 自定义 host 到客户端 id 的索引
+type hostIndex struct {
+	exact     map[string]string
+	wildcards []wildcardHost
+}
+
+// wildcardHost 表示 *.example.com 形式的 host，suffix 为 .example.com
+type wildcardHost struct {
+	suffix string
+	id     string
+}
+
+// hosts 保存当前生效的 hostIndex，重新加载用户时整体替换
+type hosts struct {
+	index atomic.Value
+}
+
+// normalizeHost 去掉端口号与末尾的点并转为小写
+func normalizeHost(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// checkHost 检查配置的 host 是否合法，支持 app.example.com 与 *.example.com 两种形式
+func checkHost(host string) error {
+	h := strings.TrimPrefix(host, "*.")
+	if len(h) == 0 || strings.ContainsAny(h, "*:/ ") || strings.HasPrefix(h, ".") ||
+		strings.HasSuffix(h, ".") || strings.Contains(h, "..") {
+		return fmt.Errorf("invalid host: '%s'", host)
+	}
+	return nil
+}
+
+// newHostIndex 根据 users 的 hosts 创建索引，不同的 id 配置相同的 host 时返回错误
+func newHostIndex(u *users) (index *hostIndex, err error) {
+	index = &hostIndex{exact: make(map[string]string)}
+	wildcards := make(map[string]string)
+	u.Range(func(idValue, userValue interface{}) bool {
+		id := idValue.(string)
+		for _, host := range userValue.(user).Hosts {
+			if err = checkHost(host); err != nil {
+				return false
+			}
+			host = strings.ToLower(host)
+			m := index.exact
+			if strings.HasPrefix(host, "*.") {
+				host = host[1:]
+				m = wildcards
+			}
+			if other, ok := m[host]; ok && other != id {
+				err = fmt.Errorf("host '%s' is configured by both '%s' and '%s'", host, other, id)
+				return false
+			}
+			m[host] = id
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for suffix, id := range wildcards {
+		index.wildcards = append(index.wildcards, wildcardHost{suffix: suffix, id: id})
+	}
+	// 更长的后缀优先匹配
+	sort.Slice(index.wildcards, func(i, j int) bool {
+		return len(index.wildcards[i].suffix) > len(index.wildcards[j].suffix)
+	})
+	return
+}
+
+// lookup 根据 host 查找 id，先精确匹配再匹配通配符
+func (i *hostIndex) lookup(host string) (id string, ok bool) {
+	id, ok = i.exact[host]
+	if ok {
+		return
+	}
+	for _, w := range i.wildcards {
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.id, true
+		}
+	}
+	return
+}
+
+// lookupExact 只精确匹配已经规范化的 host，不匹配通配符
+func (h *hosts) lookupExact(host string) (id string, ok bool) {
+	index, _ := h.index.Load().(*hostIndex)
+	if index == nil {
+		return
+	}
+	id, ok = index.exact[host]
+	return
+}
+
+// lookup 根据 http 请求或者 tls 握手中的 host 查找 id
+func (h *hosts) lookup(host []byte) (id string, ok bool) {
+	index, _ := h.index.Load().(*hostIndex)
+	if index == nil || len(index.exact) == 0 && len(index.wildcards) == 0 {
+		return
+	}
+	return index.lookup(normalizeHost(string(bytes.TrimSpace(host))))
+}
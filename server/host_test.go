@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestHostIndex(t *testing.T) {
+	u := &users{}
+	u.Store("id1", user{Secret: "secret1", Hosts: []string{"app.customer.com", "*.customer.com"}})
+	u.Store("id2", user{Secret: "secret2", Hosts: []string{"*.dev.customer.com", "Other.com"}})
+	u.Store("id3", user{Secret: "secret3"})
+	index, err := newHostIndex(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hosts{}
+	h.index.Store(index)
+	cases := []struct {
+		host string
+		id   string
+		ok   bool
+	}{
+		{"app.customer.com", "id1", true},
+		{"APP.customer.com:8080", "id1", true},
+		{"www.customer.com", "id1", true},
+		{"a.b.customer.com", "id1", true},
+		{"x.dev.customer.com", "id2", true},
+		{"other.com.", "id2", true},
+		{"customer.com", "", false},
+		{"id3.example.com", "", false},
+	}
+	for _, c := range cases {
+		id, ok := h.lookup([]byte(c.host))
+		if id != c.id || ok != c.ok {
+			t.Fatalf("lookup(%q) = %q, %v; expect %q, %v", c.host, id, ok, c.id, c.ok)
+		}
+	}
+
+	u.Store("id3", user{Secret: "secret3", Hosts: []string{"APP.customer.com"}})
+	_, err = newHostIndex(u)
+	if err == nil {
+		t.Fatal("host conflict should fail")
+	}
+	for _, host := range []string{"*", "*.", "a.*.com", "a..com", "a.com:80", ".a.com"} {
+		u.Store("id3", user{Secret: "secret3", Hosts: []string{host}})
+		_, err = newHostIndex(u)
+		if err == nil {
+			t.Fatalf("invalid host %q should fail", host)
+		}
+	}
+}
@@ -2,65 +2,156 @@ package server
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/http1"
 	"github.com/isrc-cas/gt/predef"
 	"io"
+	"net/http"
+	"strconv"
 )
 
 var (
 	// ErrInvalidHeaderLength is an error returned when invalid header length was received
 	ErrInvalidHeaderLength = errors.New("invalid header length of http protocol")
 	// ErrInvalidHTTPProtocol is an error returned when invalid http protocol was received
-	ErrInvalidHTTPProtocol = errors.New("invalid http protocol")
+	ErrInvalidHTTPProtocol = http1.ErrInvalidProtocol
 	// ErrInvalidHost is an error returned when host value is invalid
 	ErrInvalidHost = errors.New("invalid host value")
 )
 
-const (
-	headerHostPrefix = "Host: "
-	endOfHeaders     = 0x0D0A0D0A
-)
+// httpRequest 是解析后的 http 请求头，除了 obs-fold 的字段之外都引用 readHTTPHeaders 读取的数据
+type httpRequest struct {
+	method []byte
+	target []byte
+	// path 是请求的路径，absolute-form 的 target 中只保留路径部分
+	path []byte
+	// host 优先使用 absolute-form 的 target 中的 authority，否则使用 Host 字段
+	host    []byte
+	headers []http1.Header
+	// contentLength 为 -1 表示请求没有 Content-Length
+	contentLength int64
+	chunked       bool
+	// upgrade 表示请求之后的数据不再是 http 请求，例如 CONNECT 与 Upgrade
+	upgrade bool
+}
 
-func peekHost(reader *bufio.Reader) (value []byte, err error) {
-	return peekHeader(reader, headerHostPrefix)
+func (r *httpRequest) header(name []byte) []byte {
+	return http1.FindHeader(r.headers, name)
 }
 
-func peekHeader(reader *bufio.Reader, target string) (value []byte, err error) {
+// readHTTPHeaders 读取一个完整的 http 请求头，包括结尾的空行，忽略请求之前的空行。
+// 数据追加到 buf[:0]，超过 predef.MaxHTTPHeaderSize 时返回 ErrInvalidHeaderLength
+func readHTTPHeaders(reader *bufio.Reader, buf []byte) (data []byte, err error) {
+	data = buf[:0]
+	lineStart := 0
 	for {
-		n := reader.Buffered()
-		var headers []byte
-		headers, err = reader.Peek(n)
+		var line []byte
+		line, err = reader.ReadSlice('\n')
+		if len(data)+len(line) > predef.MaxHTTPHeaderSize {
+			err = ErrInvalidHeaderLength
+			return
+		}
+		data = append(data, line...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
 		if err != nil {
-			return nil, err
+			if errors.Is(err, io.EOF) && len(data) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return
 		}
-		s := 0
-		targetLen := len(target)
-		for i, b := range headers {
-			if b == '\n' {
-				if i-s >= targetLen {
-					if bytes.Equal(headers[s:s+targetLen], []byte(target)) {
-						line := bytes.TrimSpace(headers[s+targetLen : i])
-						hl := len(line)
-						if hl < 1 || hl > 512 {
-							return nil, ErrInvalidHeaderLength
-						}
-						value = make([]byte, hl)
-						copy(value, line)
-						return value, nil
-					}
-				}
-				if i >= 3 && binary.BigEndian.Uint32(headers[i-3:i+1]) == endOfHeaders {
-					return nil, io.EOF
-				}
-				if len(headers) > i {
-					s = i + 1
+		if http1.IsEmptyLine(data[lineStart:]) {
+			if lineStart == 0 {
+				data = data[:0]
+				continue
+			}
+			return
+		}
+		lineStart = len(data)
+	}
+}
+
+// parseHTTPRequest 解析 readHTTPHeaders 读取的请求头
+func parseHTTPRequest(data []byte) (req *httpRequest, err error) {
+	line, headers, err := http1.ParseHeaders(data)
+	if err != nil {
+		return
+	}
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || !bytes.HasPrefix(fields[2], []byte("HTTP/1.")) || len(fields[2]) != 8 {
+		err = ErrInvalidHTTPProtocol
+		return
+	}
+	req = &httpRequest{
+		method:  fields[0],
+		target:  fields[1],
+		path:    fields[1],
+		headers: headers,
+	}
+	var authority []byte
+	if req.target[0] != '/' && req.target[0] != '*' {
+		if i := bytes.Index(req.target, []byte("://")); i > 0 {
+			// absolute-form，例如 http://id.example.com/path
+			authority = req.target[i+3:]
+			req.path = []byte("/")
+			if j := bytes.IndexAny(authority, "/?#"); j >= 0 {
+				if authority[j] == '/' {
+					req.path = authority[j:]
+				} else {
+					req.path = append(req.path, authority[j:]...)
 				}
+				authority = authority[:j]
+			}
+			if j := bytes.LastIndexByte(authority, '@'); j >= 0 {
+				authority = authority[j+1:]
+			}
+		}
+	}
+	for _, h := range headers {
+		if !bytes.EqualFold(h.Name, []byte("Host")) {
+			continue
+		}
+		if req.host != nil {
+			err = ErrInvalidHost
+			return
+		}
+		req.host = h.Value
+	}
+	if len(authority) > 0 {
+		req.host = authority
+	}
+	req.contentLength, req.chunked, err = http1.BodyLength(headers)
+	if err != nil {
+		return
+	}
+	req.upgrade = http1.IsUpgrade(req.method, headers)
+	return
+}
+
+// peekRequestPath 读取 http 请求行中的 path
+func peekRequestPath(reader *bufio.Reader) (path []byte, err error) {
+	for {
+		n := reader.Buffered()
+		var line []byte
+		line, err = reader.Peek(n)
+		if err != nil {
+			return
+		}
+		i := bytes.IndexByte(line, '\n')
+		if i >= 0 {
+			fields := bytes.Fields(line[:i])
+			if len(fields) != 3 {
+				err = ErrInvalidHTTPProtocol
+				return
 			}
+			path = fields[1]
+			return
 		}
 		if n > predef.MaxHTTPHeaderSize {
-			return nil, ErrInvalidHTTPProtocol
+			err = ErrInvalidHTTPProtocol
+			return
 		}
 		_, err = reader.Peek(n + 1)
 		if err != nil {
@@ -86,3 +177,42 @@ func parseIDFromHost(host []byte) (id []byte, err error) {
 	id = host[:i]
 	return
 }
+
+func parseSubdomainAndIDFromHost(host []byte) (subdomain, id []byte, err error) {
+	i := bytes.IndexByte(host, '.')
+	if i <= 0 {
+		err = ErrInvalidHost
+		return
+	}
+	id, err = parseIDFromHost(host[i+1:])
+	if err != nil {
+		return
+	}
+	subdomain = host[:i]
+	return
+}
+
+// writeUnhealthyPage 回复本地服务不健康时的页面，没有配置 unhealthyPage 时只回复状态码
+func (s *Server) writeUnhealthyPage(w io.Writer) {
+	code := s.config.UnhealthyStatus
+	if len(s.unhealthyPage) == 0 {
+		writeHTTPError(w, code)
+		return
+	}
+	resp := "HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(s.unhealthyPage)) + "\r\n" +
+		"Connection: close\r\n\r\n"
+	_, _ = io.WriteString(w, resp)
+	_, _ = w.Write(s.unhealthyPage)
+}
+
+// writeHTTPError 向访问者返回只有状态码的 http 响应
+func writeHTTPError(w io.Writer, code int) {
+	resp := "HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n"
+	if code == http.StatusTooManyRequests {
+		resp += "Retry-After: 1\r\n"
+	}
+	resp += "Content-Length: 0\r\nConnection: close\r\n\r\n"
+	_, _ = io.WriteString(w, resp)
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/http1"
+	"github.com/isrc-cas/gt/pool"
+	"golang.org/x/net/http2"
+)
+
+// http2Preface 是 h2c 连接开始时的 preface
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// isHTTP2 判断访问者的连接是否是 HTTP/2：TLS 连接通过 ALPN 协商了 h2，或者连接以 h2c 的 preface 开始
+func (c *conn) isHTTP2() bool {
+	if tc, ok := c.Conn.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		return true
+	}
+	// 逐步读取，避免较短的 HTTP/1.x 请求等待不会到来的数据
+	n := 1
+	for {
+		b, err := c.Reader.Peek(n)
+		if err != nil || !bytes.Equal(b, []byte(http2Preface[:n])) {
+			return false
+		}
+		if n == len(http2Preface) {
+			return true
+		}
+		n = c.Reader.Buffered()
+		if n > len(http2Preface) {
+			n = len(http2Preface)
+		} else if n <= len(b) {
+			n = len(b) + 1
+		}
+	}
+}
+
+// serveHTTP2 处理 HTTP/2 连接，每个 stream 根据 :authority 选择客户端与服务
+func (c *conn) serveHTTP2() {
+	h := newHTTP2Handler(c)
+	defer h.closeIdleConnections()
+	// 读超时由 http2.Server 管理
+	err := c.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	var nc net.Conn = &readerConn{Conn: c.Conn, reader: c.Reader}
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		nc = &tlsReaderConn{readerConn: readerConn{Conn: c.Conn, reader: c.Reader}, tls: tc}
+	}
+	server := &http2.Server{IdleTimeout: c.server.config.Timeout}
+	server.ServeConn(nc, &http2.ServeConnOpts{Handler: h})
+}
+
+// tlsReaderConn 通过 reader 读取 TLS 连接，并保留 TLS 的连接状态
+type tlsReaderConn struct {
+	readerConn
+	tls *tls.Conn
+}
+
+func (c *tlsReaderConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+type http2Route struct {
+	client  *client
+	service uint16
+}
+
+// http2Handler 将 HTTP/2 连接上的 stream 转发给客户端。服务支持 h2c 时以 HTTP/2 转发，
+// 多个 stream 共享同一个 task，否则以 HTTP/1.1 转发，每个 task 同时只转发一个 stream
+type http2Handler struct {
+	conn *conn
+	// hosts 与 routes 将客户端与服务映射为 transport 使用的 host，使连接池按照客户端与服务区分连接
+	mtx    sync.Mutex
+	hosts  map[http2Route]string
+	routes map[string]http2Route
+	h1     *http.Transport
+	h2     *http2.Transport
+}
+
+func newHTTP2Handler(c *conn) (h *http2Handler) {
+	h = &http2Handler{
+		conn:   c,
+		hosts:  make(map[http2Route]string),
+		routes: make(map[string]http2Route),
+	}
+	h.h1 = &http.Transport{
+		DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+			return h.dial(addr)
+		},
+		DisableCompression: true,
+		IdleConnTimeout:    c.server.config.Timeout,
+	}
+	h.h2 = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(_ context.Context, _, addr string, _ *tls.Config) (net.Conn, error) {
+			return h.dial(addr)
+		},
+		DisableCompression: true,
+	}
+	return
+}
+
+func (h *http2Handler) closeIdleConnections() {
+	h.h1.CloseIdleConnections()
+	h.h2.CloseIdleConnections()
+}
+
+func (h *http2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &httpRequest{
+		method: []byte(r.Method),
+		target: []byte(r.RequestURI),
+		path:   []byte(r.URL.RequestURI()),
+		host:   []byte(r.Host),
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			req.headers = append(req.headers, http1.Header{Name: []byte(name), Value: []byte(value)})
+		}
+	}
+	client, service, err := h.conn.routeHTTP(req)
+	if err != nil {
+		h.conn.Logger.Error().Str("host", r.Host).Err(err).Msg("serveHTTP2")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	var transport http.RoundTripper = h.h1
+	if client.supportsHTTP2(service) {
+		transport = h.h2
+	}
+	host := h.routeHost(http2Route{client: client, service: service})
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = host
+			// 与 HTTP/1.x 的请求相同，不添加 X-Forwarded-For
+			out.Header["X-Forwarded-For"] = nil
+		},
+		Transport: transport,
+		// 立即发送响应的数据，gRPC 与 server-sent events 等流式的响应需要
+		FlushInterval: -1,
+		ErrorHandler:  h.handleError,
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// routeHost 返回客户端与服务对应的 host
+func (h *http2Handler) routeHost(route http2Route) string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	host, ok := h.hosts[route]
+	if !ok {
+		host = "route-" + strconv.Itoa(len(h.hosts))
+		h.hosts[route] = host
+		h.routes[host] = route
+	}
+	return host
+}
+
+func (h *http2Handler) dial(addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	h.mtx.Lock()
+	route, ok := h.routes[host]
+	h.mtx.Unlock()
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return h.conn.dialTask(route.client, route.service)
+}
+
+func (h *http2Handler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	h.conn.Logger.Debug().Str("host", r.Host).Err(err).Msg("http2 stream")
+	code := http.StatusBadGateway
+	switch {
+	case errors.Is(err, ErrServiceUnhealthy):
+		code = h.conn.server.config.UnhealthyStatus
+		if page := h.conn.server.unhealthyPage; len(page) > 0 {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(code)
+			_, _ = w.Write(page)
+			return
+		}
+	case errors.Is(err, ErrConnectionRateExceeded):
+		code = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", "1")
+	case errors.Is(err, ErrTooManyTasks):
+		code = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(code)
+}
+
+// dialTask 在客户端上打开 task 并返回连接，连接的另一端作为 task 转发给客户端
+func (c *conn) dialTask(cli *client, service uint16) (net.Conn, error) {
+	local, remote := net.Pipe()
+	task := &conn{
+		Connection: connection.Connection{
+			Conn:         remote,
+			Logger:       c.Logger,
+			Reader:       pool.GetReader(remote),
+			WriteTimeout: c.WriteTimeout,
+		},
+		server:  c.server,
+		visitor: c.Conn,
+	}
+	id, tunnel, err := cli.startTask(task, service)
+	if err != nil {
+		_ = local.Close()
+		task.Close()
+		pool.PutReader(task.Reader)
+		return nil, err
+	}
+	go func() {
+		defer func() {
+			cli.removeTask(id)
+			task.Close()
+			pool.PutReader(task.Reader)
+		}()
+		tunnel.process(id, task, service, cli.withServices())
+	}()
+	return local, nil
+}
@@ -4,86 +4,157 @@ import (
 	"bytes"
 	"errors"
 	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/predef"
 	"github.com/isrc-cas/gt/util"
 	"io"
 	"strings"
 	"testing"
 )
 
-const headerTargetPrefix = "Target-ID:"
+func readRequest(text string) (*httpRequest, error) {
+	data, err := readHTTPHeaders(bufio.NewReader(strings.NewReader(text)), nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseHTTPRequest(data)
+}
 
-func TestPeekHostReader(t *testing.T) {
-	text := "GET / HTTP/1.1\r\n" +
-		"Host: localhost\r\n" +
+func TestReadHTTPRequest(t *testing.T) {
+	text := "\r\nGET / HTTP/1.1\r\n" +
+		"host: localhost\r\n" +
+		"TARGET-ID: target.localhost\r\n" +
 		"User-Agent: curl/7.64.1\r\n" +
-		"Accept: */*"
-	host, err := peekHost(bufio.NewReader(strings.NewReader(text)))
+		"Accept: */*\r\n\r\n"
+	req, err := readRequest(text)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(host) < 1 || string(host) != "localhost" {
-		t.Fatal()
+	if string(req.host) != "localhost" {
+		t.Fatalf("invalid host '%s'", req.host)
+	}
+	if string(req.header([]byte("Target-ID"))) != "target.localhost" {
+		t.Fatalf("invalid target '%s'", req.header([]byte("Target-ID")))
+	}
+	if req.contentLength != -1 || req.chunked || req.upgrade {
+		t.Fatalf("invalid request %#v", req)
 	}
-	t.Logf("host: %s", host)
 }
 
-func TestPeekTargetReader(t *testing.T) {
+func TestReadHTTPRequestObsFold(t *testing.T) {
 	text := "GET / HTTP/1.1\r\n" +
-		"Host: localhost\r\n" +
-		"Target-ID: target.localhost\r\n" +
-		"User-Agent: curl/7.64.1\r\n" +
-		"Accept: */*"
-	target, err := peekHeader(bufio.NewReader(strings.NewReader(text)), headerTargetPrefix)
+		"Host:\r\n" +
+		" localhost\r\n" +
+		"X-Folded: a\r\n" +
+		"\tb \r\n" +
+		"  c\r\n" +
+		"X-Next: d\r\n\r\n"
+	req, err := readRequest(text)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(target) < 1 || string(target) != "target.localhost" {
-		t.Fatal()
+	if string(req.host) != "localhost" {
+		t.Fatalf("invalid host '%s'", req.host)
+	}
+	if string(req.header([]byte("x-folded"))) != "a b c" {
+		t.Fatalf("invalid folded value '%s'", req.header([]byte("x-folded")))
+	}
+	if string(req.header([]byte("x-next"))) != "d" {
+		t.Fatalf("invalid value '%s'", req.header([]byte("x-next")))
 	}
-	t.Logf("target: %s", target)
 }
 
-func TestPeekHostReaderError(t *testing.T) {
-	text := "GET / HTTP/1.1\r\n" +
-		"Host: \r\n" +
-		"User-Agent: curl/7.64.1\r\n" +
-		"Accept: */*"
-	host, err := peekHost(bufio.NewReader(strings.NewReader(text)))
-	if err == nil {
-		t.Fatal()
+func TestReadHTTPRequestAbsoluteForm(t *testing.T) {
+	text := "GET http://user@id.example.com:8080/api?q=1 HTTP/1.1\r\n" +
+		"Host: other.example.com\r\n\r\n"
+	req, err := readRequest(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.host) != "id.example.com:8080" || string(req.path) != "/api?q=1" {
+		t.Fatalf("invalid host '%s' or path '%s'", req.host, req.path)
+	}
+	req, err = readRequest("GET http://id.example.com?q=1 HTTP/1.1\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.host) != "id.example.com" || string(req.path) != "/?q=1" {
+		t.Fatalf("invalid host '%s' or path '%s'", req.host, req.path)
 	}
-	t.Logf("host: %s", host)
 }
 
-func TestPeekHostReaderNoHost(t *testing.T) {
-	text := "GET / HTTP/1.1\r\n" +
-		"User-Agent: curl/7.64.1\r\n" +
-		"Accept: */*"
-	value, err := peekHost(bufio.NewReader(strings.NewReader(text)))
-	if err == nil {
-		t.Fatal()
+func TestReadHTTPRequestBody(t *testing.T) {
+	req, err := readRequest("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
 	}
-	t.Logf("value: %s, err: %s", value, err)
-	value, err = peekHeader(bufio.NewReader(strings.NewReader(text)), headerTargetPrefix)
-	if err == nil {
-		t.Fatal()
+	if req.contentLength != 10 || req.chunked {
+		t.Fatalf("invalid request %#v", req)
+	}
+	req, err = readRequest("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.chunked {
+		t.Fatalf("invalid request %#v", req)
+	}
+	req, err = readRequest("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.upgrade {
+		t.Fatalf("invalid request %#v", req)
 	}
-	t.Logf("value: %s, err: %s", value, err)
 }
 
-func TestPeekHostReaderInvalidHeaders(t *testing.T) {
-	text := util.RandomString(17 * 1024)
-	host, err := peekHost(bufio.NewReaderSize(strings.NewReader(text), 20*1024))
-	if err == nil || !errors.Is(err, ErrInvalidHTTPProtocol) {
-		t.Fatal()
-	}
-	t.Logf("host: %s, err: %s", host, err)
-	text = "GET / HTTP/1.1\r\n\r\n" + text
-	host, err = peekHost(bufio.NewReaderSize(strings.NewReader(text), 20*1024))
-	if err == nil || !errors.Is(err, io.EOF) {
-		t.Fatal()
-	}
-	t.Logf("host: %s, err: %s", host, err)
+func TestReadHTTPRequestError(t *testing.T) {
+	for _, text := range []string{
+		"GET /\r\n\r\n",
+		"GET / HTTP/2.0\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost : localhost\r\n\r\n",
+		"GET / HTTP/1.1\r\n folded\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 1\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+	} {
+		_, err := readRequest(text)
+		if err == nil {
+			t.Fatalf("%q should returns error", text)
+		}
+	}
+}
+
+func TestReadHTTPRequestInvalidHeaders(t *testing.T) {
+	text := util.RandomString(predef.MaxHTTPHeaderSize + 1)
+	_, err := readRequest(text)
+	if !errors.Is(err, ErrInvalidHeaderLength) {
+		t.Fatal(err)
+	}
+	_, err = readRequest("GET / HTTP/1.1\r\nHost: localhost\r\n")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPResponses(t *testing.T) {
+	var r httpResponses
+	for _, head := range []bool{false, true, false, false, false} {
+		r.addRequest(head)
+	}
+	responses := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\nTrailer: 1\r\n\r\n" +
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n\r\nuntil closed"
+	// 逐个字节写入，验证响应被拆分时的解析
+	for i := 0; i < len(responses); i++ {
+		r.feed([]byte{responses[i]})
+	}
+	if r.completed != 4 || r.done() || r.state != responseUntracked {
+		t.Fatalf("invalid state: completed %d, state %d", r.completed, r.state)
+	}
 }
 
 func TestParseTokenFromHost(t *testing.T) {
@@ -107,6 +178,37 @@ func TestParseTokenFromHost(t *testing.T) {
 	t.Logf("%s", id)
 }
 
+func TestParseSubdomainAndIDFromHost(t *testing.T) {
+	_, _, err := parseSubdomainAndIDFromHost([]byte("abc.id.com"))
+	if err == nil {
+		t.Fatal("host without subdomain should returns error")
+	}
+	subdomain, id, err := parseSubdomainAndIDFromHost([]byte("api.abc.id.com"))
+	if err != nil {
+		t.Fatal("valid host should not returns error", err)
+	}
+	if string(subdomain) != "api" || string(id) != "abc" {
+		t.Fatalf("invalid subdomain '%s' or id '%s'", subdomain, id)
+	}
+}
+
+func TestPeekRequestPath(t *testing.T) {
+	text := "GET /api/users?id=1 HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Accept: */*"
+	path, err := peekRequestPath(bufio.NewReader(strings.NewReader(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(path) != "/api/users?id=1" {
+		t.Fatalf("invalid path '%s'", path)
+	}
+	_, err = peekRequestPath(bufio.NewReader(strings.NewReader("GET /\r\n")))
+	if err == nil {
+		t.Fatal("invalid request line should returns error")
+	}
+}
+
 func BenchmarkParseTokenFromHost(b *testing.B) {
 	host := []byte("abc.id.com")
 	var id []byte
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTooManyTunnels is returned when the number of tunnels of the client reaches the limit
+	ErrTooManyTunnels = errors.New("too many tunnels")
+	// ErrTooManyTasks is returned when the number of concurrent tasks of the client reaches the limit
+	ErrTooManyTasks = errors.New("too many tasks")
+	// ErrConnectionRateExceeded is returned when the client accepts new connections too fast
+	ErrConnectionRateExceeded = errors.New("connection rate exceeded")
+)
+
+// limits 用户的资源限制，0 表示不限制
+type limits struct {
+	// MaxTasks 同时转发的连接数
+	MaxTasks uint32 `yaml:"maxTasks"`
+	// MaxTunnels 客户端与服务端之间的连接数
+	MaxTunnels uint32 `yaml:"maxTunnels"`
+	// IngressRate 每秒从访问者转发到客户端的字节数
+	IngressRate uint64 `yaml:"ingressRate"`
+	// EgressRate 每秒从客户端转发到访问者的字节数，不限制 predef.Version1 的 tunnel
+	EgressRate uint64 `yaml:"egressRate"`
+	// ConnectionRate 每秒新建的连接数
+	ConnectionRate float64 `yaml:"connectionRate"`
+}
+
+func (l limits) verify() error {
+	if l.ConnectionRate < 0 {
+		return fmt.Errorf("invalid connectionRate: %v", l.ConnectionRate)
+	}
+	return nil
+}
+
+// tokenBucket 令牌桶，rate 为 0 时不限制
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate, burst float64) {
+	if b.rate == rate && b.burst == burst {
+		return
+	}
+	b.rate = rate
+	b.burst = burst
+	b.tokens = burst
+	b.last = time.Time{}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// reserve 取走 n 个令牌，令牌不足时允许透支，返回需要等待的时间
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow 令牌足够时取走 1 个令牌并返回 true
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limiter 一个客户端所有 tunnel 与 task 共享的限制
+type limiter struct {
+	mtx        sync.Mutex
+	limits     limits
+	ingress    tokenBucket
+	egress     tokenBucket
+	connection tokenBucket
+}
+
+func (l *limiter) setLimits(limits limits) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.limits = limits
+	// 流量允许 1 秒的突发
+	l.ingress.setRate(float64(limits.IngressRate), float64(limits.IngressRate))
+	l.egress.setRate(float64(limits.EgressRate), float64(limits.EgressRate))
+	burst := limits.ConnectionRate
+	if burst < 1 {
+		burst = 1
+	}
+	l.connection.setRate(limits.ConnectionRate, burst)
+}
+
+func (l *limiter) getLimits() (limits limits) {
+	l.mtx.Lock()
+	limits = l.limits
+	l.mtx.Unlock()
+	return
+}
+
+func (l *limiter) allowConnection() (ok bool) {
+	l.mtx.Lock()
+	ok = l.connection.allow(time.Now())
+	l.mtx.Unlock()
+	return
+}
+
+// waitIngress 转发 n 字节访问者的数据后调用，超过速率时等待
+func (l *limiter) waitIngress(n int) {
+	l.mtx.Lock()
+	d := l.ingress.reserve(float64(n), time.Now())
+	l.mtx.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// waitEgress 转发 n 字节客户端的数据后调用，超过速率时等待
+func (l *limiter) waitEgress(n int) {
+	l.mtx.Lock()
+	d := l.egress.reserve(float64(n), time.Now())
+	l.mtx.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := tokenBucket{}
+	if d := b.reserve(1<<20, now); d != 0 {
+		t.Fatal("unlimited bucket should not wait", d)
+	}
+
+	b.setRate(100, 100)
+	if d := b.reserve(100, now); d != 0 {
+		t.Fatal("burst should not wait", d)
+	}
+	if d := b.reserve(50, now); d != 500*time.Millisecond {
+		t.Fatal("unexpected wait", d)
+	}
+	if d := b.reserve(50, now.Add(time.Second)); d != 0 {
+		t.Fatal("refilled bucket should not wait", d)
+	}
+
+	b.setRate(1, 1)
+	if !b.allow(now) {
+		t.Fatal("first connection should be allowed")
+	}
+	if b.allow(now) {
+		t.Fatal("second connection should be rejected")
+	}
+	if !b.allow(now.Add(time.Second)) {
+		t.Fatal("connection should be allowed after refill")
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	u := make(map[string]user)
+	err := config.Yaml2Interface("./testdata/limits.yaml", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := limits{
+		MaxTasks:       2,
+		MaxTunnels:     1,
+		IngressRate:    1024,
+		EgressRate:     2048,
+		ConnectionRate: 0.5,
+	}
+	if u["id1"].limits != expected {
+		t.Fatalf("unexpected limits %+v", u["id1"].limits)
+	}
+
+	c := newClient().(*client)
+	c.init(&Server{}, "id1", expected)
+	ok, err := c.addTunnel(&conn{})
+	if !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	_, err = c.addTunnel(&conn{})
+	if err != ErrTooManyTunnels {
+		t.Fatal("unexpected error", err)
+	}
+	if !c.addTask(1, &conn{}) || !c.addTask(2, &conn{}) {
+		t.Fatal("failed to add task")
+	}
+	if c.addTask(3, &conn{}) {
+		t.Fatal("too many tasks should be rejected")
+	}
+	c.removeTask(1)
+	if !c.addTask(3, &conn{}) {
+		t.Fatal("failed to add task after removing one")
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/isrc-cas/gt/server/api"
+)
+
+// metrics 服务端的统计，通过 api server 的 /metrics 以 Prometheus 格式输出
+type metrics struct {
+	ingressBytes uint64
+	egressBytes  uint64
+	// 认证失败的次数
+	invalidUsers  uint64
+	authAPIErrors uint64
+	// tunnel 握手的耗时，单位为秒
+	handshake *api.Histogram
+}
+
+func newMetrics() metrics {
+	return metrics{
+		handshake: api.NewHistogram(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5),
+	}
+}
+
+type clientMetrics struct {
+	id           string
+	tunnels      int
+	tasks        int
+	ingressBytes uint64
+	egressBytes  uint64
+}
+
+func (c *client) metrics() (m clientMetrics) {
+	m.id = c.ID
+	c.tunnelsRWMtx.RLock()
+	m.tunnels = len(c.tunnels)
+	c.tunnelsRWMtx.RUnlock()
+	c.tasksRWMtx.RLock()
+	m.tasks = len(c.tasks)
+	c.tasksRWMtx.RUnlock()
+	m.ingressBytes = atomic.LoadUint64(&c.ingressBytes)
+	m.egressBytes = atomic.LoadUint64(&c.egressBytes)
+	return
+}
+
+func (s *Server) writeMetrics(w *api.MetricsWriter) {
+	w.Family("gt_connections_accepted_total", "counter", "Number of accepted connections.")
+	w.Sample("gt_connections_accepted_total", float64(s.GetAccepted()))
+	w.Family("gt_connections_served_total", "counter", "Number of served connections.")
+	w.Sample("gt_connections_served_total", float64(s.GetServed()))
+	w.Family("gt_connections_failed_total", "counter", "Number of failed connections.")
+	w.Sample("gt_connections_failed_total", float64(s.GetFailed()))
+	w.Family("gt_tunnels_total", "counter", "Number of established tunnels.")
+	w.Sample("gt_tunnels_total", float64(s.GetTunneling()))
+
+	w.Family("gt_bytes_total", "counter", "Number of forwarded bytes, ingress is from visitors to clients.")
+	w.Sample("gt_bytes_total", float64(atomic.LoadUint64(&s.metrics.ingressBytes)), "direction", "ingress")
+	w.Sample("gt_bytes_total", float64(atomic.LoadUint64(&s.metrics.egressBytes)), "direction", "egress")
+
+	w.Family("gt_auth_failures_total", "counter", "Number of tunnels failed to authenticate.")
+	w.Sample("gt_auth_failures_total", float64(atomic.LoadUint64(&s.metrics.invalidUsers)), "reason", "invalid_user")
+	w.Sample("gt_auth_failures_total", float64(atomic.LoadUint64(&s.metrics.authAPIErrors)), "reason", "auth_api_error")
+
+	w.Family("gt_tunnel_handshake_seconds", "histogram", "Latency of tunnel handshakes.")
+	w.Histogram("gt_tunnel_handshake_seconds", s.metrics.handshake)
+
+	if s.turnServer != nil {
+		w.Family("gt_turn_allocations", "gauge", "Number of active TURN allocations.")
+		w.Sample("gt_turn_allocations", float64(s.turnServer.AllocationCount()))
+	}
+
+	var clients []clientMetrics
+	s.id2Agent.Range(func(_, value interface{}) bool {
+		clients = append(clients, value.(*client).metrics())
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	w.Family("gt_client_tunnels", "gauge", "Number of tunnels of the client.")
+	for _, c := range clients {
+		w.Sample("gt_client_tunnels", float64(c.tunnels), "id", c.id)
+	}
+	w.Family("gt_client_tasks", "gauge", "Number of active tasks of the client.")
+	for _, c := range clients {
+		w.Sample("gt_client_tasks", float64(c.tasks), "id", c.id)
+	}
+	w.Family("gt_client_bytes_total", "counter", "Number of bytes forwarded for the client, ingress is from visitors to the client.")
+	for _, c := range clients {
+		w.Sample("gt_client_bytes_total", float64(c.ingressBytes), "id", c.id, "direction", "ingress")
+		w.Sample("gt_client_bytes_total", float64(c.egressBytes), "id", c.id, "direction", "egress")
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+var (
+	// ErrClientCertRequired is returned when a tunnel does not present a client cert signed by the tunnel client CA.
+	ErrClientCertRequired = errors.New("client cert required")
+	// ErrClientCertMismatch is returned when the id of a tunnel is not the one in its client cert.
+	ErrClientCertMismatch = errors.New("id does not match the client cert")
+)
+
+// loadCertPool 加载 PEM 格式的 CA 证书
+func loadCertPool(file string) (pool *x509.CertPool, err error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no cert found in '%s'", file)
+	}
+	return
+}
+
+// authClientCert 验证 tunnel 的客户端证书，id 必须是证书的 CN 或者 SAN 中的 DNS 名称
+func (c *conn) authClientCert(id string) error {
+	raw := c.Conn
+	if ws, ok := raw.(*webSocketConn); ok {
+		raw = ws.raw
+	}
+	var state tls.ConnectionState
+	switch raw := raw.(type) {
+	case *tls.Conn:
+		state = raw.ConnectionState()
+	case *connection.QUICConn:
+		state = raw.Connection.ConnectionState().TLS
+	default:
+		return ErrClientCertRequired
+	}
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ErrClientCertRequired
+	}
+	for _, name := range clientCertIDs(state.VerifiedChains[0][0]) {
+		if name == id {
+			return nil
+		}
+	}
+	return ErrClientCertMismatch
+}
+
+// authTunnel 验证 tunnel 的身份，配置了 tunnelClientCA 时只有开启 tunnelClientSecret 才验证 secret
+func (c *conn) authTunnel(id, secret string) error {
+	if c.server.tunnelClientCAs == nil {
+		return c.server.authUser(id, secret)
+	}
+	if err := c.authClientCert(id); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidUser, err.Error())
+	}
+	if c.server.config.TunnelClientSecret {
+		return c.server.authUser(id, secret)
+	}
+	return nil
+}
+
+// clientCertIDs 返回客户端证书可以使用的 id
+func clientCertIDs(cert *x509.Certificate) (ids []string) {
+	if len(cert.Subject.CommonName) > 0 {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
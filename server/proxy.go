@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidProxyProtocol is returned when the PROXY protocol header is invalid or missing
+	ErrInvalidProxyProtocol = errors.New("invalid proxy protocol header")
+	// ErrUntrustedProxyProtocol is returned when a connection of a listener requiring the PROXY protocol
+	// header comes from an untrusted source
+	ErrUntrustedProxyProtocol = errors.New("untrusted proxy protocol source")
+)
+
+// 监听地址读取 PROXY protocol 头部的方式
+const (
+	// proxyProtocolAccept 表示头部是可选的
+	proxyProtocolAccept = "accept"
+	// proxyProtocolRequire 表示头部是必须的，没有头部或者来源不受信任的连接会被关闭
+	proxyProtocolRequire = "require"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1 头部最长 107 字节，包括 "PROXY " 与 CRLF
+const proxyV1MaxLength = 107
+
+// parseTrustedPrefixes 解析受信任的 CIDR，也支持单个 IP
+func parseTrustedPrefixes(values []string) (prefixes []netip.Prefix, err error) {
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		prefix, e := netip.ParsePrefix(v)
+		if e != nil {
+			addr, e := netip.ParseAddr(v)
+			if e != nil {
+				err = fmt.Errorf("invalid CIDR '%s'", v)
+				return
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+// proxyListener 读取负载均衡器在连接开始时发送的 PROXY protocol 头部，连接的地址替换为头部中的地址
+type proxyListener struct {
+	net.Listener
+	required bool
+	trusted  []netip.Prefix
+	timeout  time.Duration
+}
+
+// Accept 不读取头部，避免慢速的连接阻塞 acceptLoop
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, listener: l}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn 在第一次读取数据或者获取地址时读取 PROXY protocol 头部。
+// newConn 记录日志时会获取地址，所以头部在 serve 设置超时之前读取
+type proxyConn struct {
+	net.Conn
+	listener *proxyListener
+	once     sync.Once
+	err      error
+	remote   net.Addr
+	local    net.Addr
+	// prefix 是判断是否有头部时读取的数据，之后的 Read 先返回这些数据
+	prefix []byte
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.local = c.Conn.LocalAddr()
+		c.err = c.readHeader()
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (n int, err error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.prefix) > 0 {
+		n = copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr returns the source address in the PROXY protocol header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// LocalAddr returns the destination address in the PROXY protocol header
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	return c.local
+}
+
+func (c *proxyConn) readHeader() (err error) {
+	if !c.listener.isTrusted(c.remote) {
+		if c.listener.required {
+			return ErrUntrustedProxyProtocol
+		}
+		// 不受信任的来源发送的头部不会被解析
+		return nil
+	}
+	if c.listener.timeout > 0 {
+		err = c.Conn.SetReadDeadline(time.Now().Add(c.listener.timeout))
+		if err != nil {
+			return
+		}
+		defer func() {
+			e := c.Conn.SetReadDeadline(time.Time{})
+			if err == nil {
+				err = e
+			}
+		}()
+	}
+
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(c.Conn, buf[:1])
+	if err != nil {
+		return
+	}
+	switch buf[0] {
+	case 'P':
+		// 可选的头部与以 P 开头的 http 方法共用前缀
+		_, err = io.ReadFull(c.Conn, buf[1:6])
+		if err != nil {
+			return
+		}
+		if string(buf[:6]) == "PROXY " {
+			return c.readV1()
+		}
+		c.prefix = buf[:6]
+	case proxyV2Signature[0]:
+		_, err = io.ReadFull(c.Conn, buf[1:16])
+		if err != nil {
+			return
+		}
+		if bytes.Equal(buf[:12], proxyV2Signature) {
+			return c.readV2(buf[12:16])
+		}
+		c.prefix = buf
+	default:
+		c.prefix = buf[:1]
+	}
+	if c.listener.required {
+		return ErrInvalidProxyProtocol
+	}
+	return nil
+}
+
+// readV1 读取 "PROXY " 之后的 v1 头部，例如 "TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func (c *proxyConn) readV1() (err error) {
+	line := make([]byte, 0, proxyV1MaxLength-len("PROXY "))
+	var b [1]byte
+	for {
+		if len(line) == cap(line) {
+			return ErrInvalidProxyProtocol
+		}
+		// 逐字节读取，避免读取头部之后的数据
+		_, err = io.ReadFull(c.Conn, b[:])
+		if err != nil {
+			return
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return ErrInvalidProxyProtocol
+	}
+	fields := strings.Split(string(line[:len(line)-1]), " ")
+	if fields[0] == "UNKNOWN" {
+		// 保留连接的地址
+		return nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return ErrInvalidProxyProtocol
+	}
+	src, err := parseProxyAddrPort(fields[1], fields[3])
+	if err != nil {
+		return
+	}
+	dst, err := parseProxyAddrPort(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+	if src.Addr().Is4() != (fields[0] == "TCP4") || dst.Addr().Is4() != (fields[0] == "TCP4") {
+		return ErrInvalidProxyProtocol
+	}
+	c.remote = net.TCPAddrFromAddrPort(src)
+	c.local = net.TCPAddrFromAddrPort(dst)
+	return
+}
+
+func parseProxyAddrPort(addr, port string) (ap netip.AddrPort, err error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || ip.Zone() != "" {
+		err = ErrInvalidProxyProtocol
+		return
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		err = ErrInvalidProxyProtocol
+		return
+	}
+	ap = netip.AddrPortFrom(ip, uint16(p))
+	return
+}
+
+// readV2 读取签名之后的 v2 头部，header 是版本与命令、地址族与协议、地址的长度
+func (c *proxyConn) readV2(header []byte) (err error) {
+	if header[0]>>4 != 2 {
+		return ErrInvalidProxyProtocol
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	_, err = io.ReadFull(c.Conn, data)
+	if err != nil {
+		return
+	}
+	switch header[0] & 0x0F {
+	case 0x00:
+		// LOCAL 命令是负载均衡器自己的连接，例如健康检查，保留连接的地址
+		return nil
+	case 0x01:
+	default:
+		return ErrInvalidProxyProtocol
+	}
+	var src, dst netip.AddrPort
+	switch header[1] >> 4 {
+	case 0x1:
+		if len(data) < 12 {
+			return ErrInvalidProxyProtocol
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[0:4])), binary.BigEndian.Uint16(data[8:]))
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[4:8])), binary.BigEndian.Uint16(data[10:]))
+	case 0x2:
+		if len(data) < 36 {
+			return ErrInvalidProxyProtocol
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[0:16])), binary.BigEndian.Uint16(data[32:]))
+		dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[16:32])), binary.BigEndian.Uint16(data[34:]))
+	default:
+		// AF_UNSPEC 与 AF_UNIX 保留连接的地址，忽略地址之后的 TLV
+		return nil
+	}
+	c.remote = net.TCPAddrFromAddrPort(src)
+	c.local = net.TCPAddrFromAddrPort(dst)
+	return
+}
+
+// proxyProtocolListener 根据监听地址的 PROXY protocol 选项包装 l，选项为空时返回 l
+func (s *Server) proxyProtocolListener(l net.Listener, mode string) net.Listener {
+	if len(mode) == 0 {
+		return l
+	}
+	return &proxyListener{
+		Listener: l,
+		required: mode == proxyProtocolRequire,
+		trusted:  s.proxyProtocolTrusted,
+		timeout:  s.config.Timeout,
+	}
+}
+
+// verifyProxyProtocol 检查监听地址的 PROXY protocol 选项，并解析受信任的 CIDR
+func (s *Server) verifyProxyProtocol() (err error) {
+	var enabled bool
+	for _, o := range []struct {
+		name  string
+		value string
+	}{
+		{"addrProxyProtocol", s.config.AddrProxyProtocol},
+		{"tlsAddrProxyProtocol", s.config.TLSAddrProxyProtocol},
+		{"sniAddrProxyProtocol", s.config.SNIAddrProxyProtocol},
+	} {
+		switch o.value {
+		case "":
+		case proxyProtocolAccept, proxyProtocolRequire:
+			enabled = true
+		default:
+			return fmt.Errorf("option '%s' is '%s', supported values: accept, require", o.name, o.value)
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	if len(s.config.ProxyProtocolTrusted) == 0 {
+		return errors.New("the PROXY protocol options require option 'proxyProtocolTrusted'")
+	}
+	s.proxyProtocolTrusted, err = parseTrustedPrefixes(s.config.ProxyProtocolTrusted)
+	if err != nil {
+		err = fmt.Errorf("%s, please check option 'proxyProtocolTrusted'", err.Error())
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestProxyListener(t *testing.T) {
+	v2 := func(cmd, family byte, addrs ...byte) string {
+		return string(append(append(append([]byte(nil), proxyV2Signature...), cmd, family, 0, byte(len(addrs))), addrs...))
+	}
+	tests := []struct {
+		name     string
+		required bool
+		trusted  string
+		data     string
+		remote   string
+		local    string
+		rest     string
+		err      error
+	}{
+		{"v1 tcp4", true, "127.0.0.0/8", "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\nGET / HTTP/1.1\r\n",
+			"203.0.113.7:56324", "192.0.2.1:443", "GET / HTTP/1.1\r\n", nil},
+		{"v1 tcp6", true, "127.0.0.1", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nhello",
+			"[2001:db8::1]:56324", "[2001:db8::2]:443", "hello", nil},
+		{"v1 unknown", true, "127.0.0.1", "PROXY UNKNOWN\r\nhello", "", "", "hello", nil},
+		{"v1 invalid", true, "127.0.0.1", "PROXY TCP4 2001:db8::1 192.0.2.1 56324 443\r\nhello", "", "", "", ErrInvalidProxyProtocol},
+		{"v2 tcp4", true, "127.0.0.1", v2(0x21, 0x11, 203, 0, 113, 7, 192, 0, 2, 1, 0xDC, 0x04, 0x01, 0xBB) + "hello",
+			"203.0.113.7:56324", "192.0.2.1:443", "hello", nil},
+		{"v2 tcp6", true, "127.0.0.1", v2(0x21, 0x21,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0xDC, 0x04, 0x01, 0xBB) + "hello",
+			"[2001:db8::1]:56324", "[2001:db8::2]:443", "hello", nil},
+		{"v2 local", true, "127.0.0.1", v2(0x20, 0x00) + "hello", "", "", "hello", nil},
+		{"accept without header", false, "127.0.0.1", "PUT / HTTP/1.1\r\n", "", "", "PUT / HTTP/1.1\r\n", nil},
+		{"accept tls", false, "127.0.0.1", "\x16\x03\x01", "", "", "\x16\x03\x01", nil},
+		{"require without header", true, "127.0.0.1", "GET / HTTP/1.1\r\n", "", "", "", ErrInvalidProxyProtocol},
+		{"accept untrusted", false, "10.0.0.0/8", "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", "", "",
+			"PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", nil},
+		{"require untrusted", true, "10.0.0.0/8", "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", "", "", "", ErrUntrustedProxyProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseTrustedPrefixes([]string{tt.trusted})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			pl := &proxyListener{Listener: l, required: tt.required, trusted: trusted, timeout: 5 * time.Second}
+
+			visitor, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer visitor.Close()
+			_, err = io.WriteString(visitor, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			remote, local := tt.remote, tt.local
+			if len(remote) == 0 {
+				remote, local = visitor.LocalAddr().String(), visitor.RemoteAddr().String()
+			}
+			if c.RemoteAddr().String() != remote || c.LocalAddr().String() != local {
+				t.Fatalf("addresses %s %s are not expected %s %s", c.RemoteAddr(), c.LocalAddr(), remote, local)
+			}
+			buf := make([]byte, len(tt.rest))
+			if tt.err != nil {
+				buf = make([]byte, 1)
+			}
+			_, err = io.ReadFull(c, buf)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v is not expected %v", err, tt.err)
+			}
+			if err == nil && string(buf) != tt.rest {
+				t.Fatalf("%q is not expected %q", buf, tt.rest)
+			}
+		})
+	}
+}
+
+func TestParseTrustedPrefixes(t *testing.T) {
+	prefixes, err := parseTrustedPrefixes([]string{"10.1.2.3/8", "::ffff:192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	for i, prefix := range prefixes {
+		if prefix != expected[i] {
+			t.Fatalf("%v is not expected %v", prefixes, expected)
+		}
+	}
+	_, err = parseTrustedPrefixes([]string{"example.com"})
+	if err == nil {
+		t.Fatal("invalid CIDR is accepted")
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/pool"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/quic-go/quic-go"
+)
+
+func (s *Server) quicListen() (err error) {
+	s.Logger.Info().Str("quicAddr", s.config.QUICAddr).Msg("Listening QUIC")
+	tlsConfig := &tls.Config{
+		GetCertificate: s.getCertificate,
+		NextProtos:     []string{predef.QUICProto},
+	}
+	if s.tunnelClientCAs != nil {
+		tlsConfig.ClientCAs = s.tunnelClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	packetConn, err := net.ListenPacket("udp", s.config.QUICAddr)
+	if err != nil {
+		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'quicAddr'", s.config.QUICAddr, err.Error())
+		return
+	}
+	// 关闭 listener 时不影响已经建立的连接，优雅退出时 tunnel 还需要继续转发
+	transport := &quic.Transport{Conn: packetConn}
+	l, err := transport.Listen(tlsConfig, &quic.Config{MaxIdleTimeout: s.config.Timeout})
+	if err != nil {
+		packetConn.Close()
+		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'quicAddr'", s.config.QUICAddr, err.Error())
+		return
+	}
+	s.quicTransport = transport
+	s.quicListener = l
+	go s.quicAcceptLoop(l)
+	return
+}
+
+func (s *Server) quicAcceptLoop(l *quic.Listener) {
+	var err error
+	defer func() {
+		if !predef.Debug {
+			if e := recover(); e != nil {
+				s.Logger.Error().Msgf("recovered panic: %#v\n%s", e, debug.Stack())
+			}
+		}
+		if errors.Is(err, quic.ErrServerClosed) {
+			err = nil
+		}
+		s.Logger.Info().Str("addr", l.Addr().String()).Err(err).Msg("quicAcceptLoop ended")
+	}()
+	s.Logger.Info().Str("addr", l.Addr().String()).Msg("quicAcceptLoop started")
+	for {
+		var qc *quic.Conn
+		qc, err = l.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&s.accepted, 1)
+		go s.handleQUIC(qc)
+	}
+}
+
+// handleQUIC 使用 QUIC 连接的第一个 stream 处理 tunnel 的握手与信号
+func (s *Server) handleQUIC(qc *quic.Conn) {
+	ctx := context.Background()
+	if s.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.Timeout)
+		defer cancel()
+	}
+	stream, err := qc.AcceptStream(ctx)
+	if err != nil {
+		atomic.AddUint64(&s.failed, 1)
+		s.Logger.Warn().Err(err).Str("ip", qc.RemoteAddr().String()).Msg("failed to accept the first quic stream")
+		_ = qc.CloseWithError(0, "")
+		return
+	}
+	c := newConn(&connection.QUICConn{Stream: stream, Connection: qc}, s)
+	c.quic = qc
+	c.handle(func() bool {
+		c.Logger.Warn().Msg("invalid tunnel over quic")
+		return false
+	})
+}
+
+// processStream 在新的 QUIC stream 上转发 task，stream 以 4 字节的 task id 与 2 字节的服务索引开始
+func (c *conn) processStream(id uint32, task *conn, service uint16) {
+	atomic.AddUint32(&c.TasksCount, 1)
+	defer func() {
+		if atomic.AddUint32(&c.TasksCount, ^uint32(0)) == 0 && c.IsClosing() {
+			c.SendCloseSignal()
+			c.Close()
+		}
+	}()
+
+	ctx := context.Background()
+	if c.server.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.server.config.Timeout)
+		defer cancel()
+	}
+	stream, err := c.quic.OpenStreamSync(ctx)
+	if err != nil {
+		c.Logger.Debug().Err(err).Uint32("id", id).Msg("failed to open quic stream")
+		return
+	}
+	go c.streamWriteLoop(id, task, stream)
+
+	var rErr error
+	var wErr error
+	buf := pool.BytesPool.Get().([]byte)
+	defer func() {
+		pool.BytesPool.Put(buf)
+		if errors.Is(rErr, io.EOF) {
+			rErr = nil
+		}
+		if rErr != nil || wErr != nil {
+			c.Logger.Debug().AnErr("read err", rErr).AnErr("write err", wErr).Uint32("id", id).Msg("processStream err")
+		}
+		if wErr != nil {
+			stream.CancelWrite(0)
+		} else {
+			_ = stream.Close()
+		}
+	}()
+	binary.BigEndian.PutUint32(buf[0:], id)
+	binary.BigEndian.PutUint16(buf[4:], service)
+	header := buf[:6]
+	if c.visitorAddrs {
+		header, rErr = connection.AppendVisitor(header, task.visitorAddr())
+		if rErr != nil {
+			return
+		}
+	}
+	_, wErr = stream.Write(header)
+	if wErr != nil {
+		return
+	}
+	for {
+		if c.server.config.Timeout > 0 {
+			dl := time.Now().Add(c.server.config.Timeout)
+			rErr = task.SetReadDeadline(dl)
+			if rErr != nil {
+				return
+			}
+		}
+		var l int
+		l, rErr = task.Reader.Read(buf)
+		if l > 0 {
+			if predef.Debug {
+				c.Logger.Trace().Uint32("id", id).Hex("data", buf[:l]).Msg("write stream")
+			}
+			_, wErr = stream.Write(buf[:l])
+			if wErr != nil {
+				return
+			}
+			task.client.addIngress(l)
+		}
+		if rErr != nil {
+			return
+		}
+	}
+}
+
+// streamWriteLoop 将 stream 的数据写入 task，stream 结束时关闭 task
+func (c *conn) streamWriteLoop(id uint32, task *conn, stream *quic.Stream) {
+	var err error
+	buf := pool.BytesPool.Get().([]byte)
+	defer func() {
+		pool.BytesPool.Put(buf)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		if err != nil {
+			c.Logger.Debug().Err(err).Uint32("id", id).Msg("streamWriteLoop ended")
+		}
+		stream.CancelRead(0)
+		task.Close()
+	}()
+	for {
+		if c.server.config.Timeout > 0 {
+			dl := time.Now().Add(c.server.config.Timeout)
+			err = stream.SetReadDeadline(dl)
+			if err != nil {
+				return
+			}
+		}
+		var l int
+		l, err = stream.Read(buf)
+		if l > 0 {
+			_, we := task.Write(buf[:l])
+			if we != nil {
+				err = we
+				return
+			}
+			if c.server.config.Timeout > 0 && !c.server.config.TimeoutOnUnidirectionalTraffic {
+				dl := time.Now().Add(c.server.config.Timeout)
+				we = task.SetReadDeadline(dl)
+				if we != nil {
+					err = we
+					return
+				}
+			}
+			task.client.addEgress(l)
+			task.client.limiter.waitEgress(l)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
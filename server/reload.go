@@ -0,0 +1,113 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+)
+
+// usersLoader 保证同一时间只有一个 goroutine 重新加载用户
+type usersLoader struct {
+	sync.Mutex
+}
+
+// loadUsers 按照 config 配置文件、users 配置文件、命令行的顺序合并用户，后者覆盖前者
+func (s *Server) loadUsers(configUsers map[string]user) (result *users, err error) {
+	result = &users{}
+	err = result.mergeUsers(configUsers, nil, nil)
+	if err != nil {
+		return
+	}
+	fileUsers := make(map[string]user)
+	err = config.Yaml2Interface(s.config.Options.Users, fileUsers)
+	if err != nil {
+		return
+	}
+	err = result.mergeUsers(fileUsers, s.config.ID, s.config.Secret)
+	return
+}
+
+// ReloadUsers reloads the users from the config file, the users file and the command line.
+// Clients whose id was removed or whose secret was changed are disconnected, other tunnels are untouched.
+// Custom hosts and limits of users take effect immediately.
+func (s *Server) ReloadUsers() (err error) {
+	s.usersLoader.Lock()
+	defer s.usersLoader.Unlock()
+
+	conf := Config{}
+	err = config.Yaml2Interface(s.config.Options.Config, &conf)
+	if err != nil {
+		return
+	}
+	newUsers, err := s.loadUsers(conf.Users)
+	if err != nil {
+		return
+	}
+	hostIndex, err := newHostIndex(newUsers)
+	if err != nil {
+		return
+	}
+
+	changed := s.users.reload(newUsers)
+	s.hosts.index.Store(hostIndex)
+	for _, id := range changed {
+		if c, ok := s.getClient(id); ok {
+			c.close()
+		}
+	}
+	newUsers.Range(func(idValue, userValue interface{}) bool {
+		if c, ok := s.getClient(idValue.(string)); ok {
+			c.limiter.setLimits(userValue.(user).limits)
+		}
+		return true
+	})
+	s.Logger.Info().Strs("changed", changed).Msg("users reloaded")
+	return
+}
+
+// watchUsers 定时检查 config 配置文件与 users 配置文件的修改时间，修改后重新加载用户
+func (s *Server) watchUsers() {
+	var paths []string
+	for _, path := range []string{s.config.Options.Config, s.config.Options.Users} {
+		if len(path) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 || s.config.UsersWatch <= 0 {
+		return
+	}
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+
+	ticker := time.NewTicker(s.config.UsersWatch)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.IsClosing() {
+			return
+		}
+		modified := false
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil {
+				s.Logger.Warn().Err(err).Str("path", path).Msg("failed to check users file")
+				continue
+			}
+			if !fi.ModTime().Equal(modTimes[path]) {
+				modTimes[path] = fi.ModTime()
+				modified = true
+			}
+		}
+		if modified {
+			err := s.ReloadUsers()
+			if err != nil {
+				s.Logger.Error().Err(err).Msg("failed to reload users")
+			}
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/bufio"
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/http1"
+	"github.com/isrc-cas/gt/pool"
+	"github.com/isrc-cas/gt/predef"
+)
+
+const (
+	chunkNone = iota
+	chunkSize
+	chunkTrailer
+)
+
+// httpRequests 逐个解析访问者连接上的 http 请求并转发。keep-alive 连接上的每个请求都重新选择客户端与服务，
+// 选择的结果变化时等待之前的响应完成，然后使用新的 task 转发之后的请求
+type httpRequests struct {
+	conn   *conn
+	reader *bufio.Reader
+	header []byte
+	line   []byte
+	// unread 是已经读取但还没有转发的数据
+	unread []byte
+	// remaining 是当前请求的 body 或者 chunk 剩余的字节数
+	remaining int64
+	chunk     int
+	// raw 表示连接已经升级，之后的数据不再按照 http 请求解析
+	raw bool
+
+	client  *client
+	service uint16
+	task    *httpTask
+	// pending 是需要使用新的 task 转发的请求
+	pending *httpRequest
+	// err 是选择客户端与服务失败的原因
+	err error
+}
+
+func newHTTPRequests(c *conn) *httpRequests {
+	return &httpRequests{conn: c, reader: c.Reader}
+}
+
+func (r *httpRequests) readRequest() (req *httpRequest, err error) {
+	r.header, err = readHTTPHeaders(r.reader, r.header)
+	if err != nil {
+		return
+	}
+	return parseHTTPRequest(r.header)
+}
+
+// serve 将请求转发给客户端，直到访问者的连接结束或者出错
+func (r *httpRequests) serve(req *httpRequest, client *client, service uint16) (err error) {
+	r.client = client
+	r.service = service
+	r.pending = req
+	for r.pending != nil {
+		r.task = &httpTask{
+			Conn:     r.conn.Conn,
+			conn:     r.conn,
+			closed:   make(chan struct{}),
+			progress: make(chan struct{}, 1),
+		}
+		task := &conn{
+			Connection: connection.Connection{
+				Conn:         r.task,
+				Logger:       r.conn.Logger,
+				Reader:       pool.GetReader(r),
+				WriteTimeout: r.conn.WriteTimeout,
+			},
+			server:  r.conn.server,
+			visitor: r.conn.Conn,
+		}
+		r.start(r.pending)
+		r.pending = nil
+		err = r.client.process(task, r.service)
+		switch err {
+		case ErrServiceUnhealthy:
+			r.conn.server.writeUnhealthyPage(r.conn)
+		case ErrConnectionRateExceeded:
+			writeHTTPError(r.conn, http.StatusTooManyRequests)
+		case ErrTooManyTasks:
+			writeHTTPError(r.conn, http.StatusServiceUnavailable)
+		}
+		// 访问者的连接在 handleHTTP 结束后关闭，这里只需要结束 task 的 writeLoop
+		task.closeWindows()
+		pool.PutReader(task.Reader)
+		if err != nil {
+			return
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return
+}
+
+// start 开始转发请求，转发的数据依次是请求头与 body
+func (r *httpRequests) start(req *httpRequest) {
+	r.unread = r.header
+	r.remaining = 0
+	r.chunk = chunkNone
+	if req.chunked {
+		r.chunk = chunkSize
+	} else if req.contentLength > 0 {
+		r.remaining = req.contentLength
+	}
+	r.raw = req.upgrade
+	r.task.responses.addRequest(bytes.Equal(req.method, []byte(http.MethodHead)))
+}
+
+func (r *httpRequests) Read(p []byte) (n int, err error) {
+	for {
+		if len(r.unread) > 0 {
+			n = copy(p, r.unread)
+			r.unread = r.unread[n:]
+			return
+		}
+		if r.raw {
+			return r.reader.Read(p)
+		}
+		if r.remaining > 0 {
+			if int64(len(p)) > r.remaining {
+				p = p[:r.remaining]
+			}
+			n, err = r.reader.Read(p)
+			r.remaining -= int64(n)
+			return
+		}
+		if r.chunk != chunkNone {
+			err = r.readChunkLine()
+		} else {
+			err = r.next()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readChunkLine 读取 chunk 的长度或者 trailer 的一行
+func (r *httpRequests) readChunkLine() (err error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = ErrInvalidHTTPProtocol
+		}
+		return
+	}
+	r.line = append(r.line[:0], line...)
+	r.unread = r.line
+	if r.chunk == chunkTrailer {
+		if http1.IsEmptyLine(line) {
+			r.chunk = chunkNone
+		}
+		return
+	}
+	size, err := http1.ParseChunkSize(line)
+	if err != nil {
+		return
+	}
+	if size == 0 {
+		r.chunk = chunkTrailer
+		return
+	}
+	// chunk 的数据以 CRLF 结尾
+	r.remaining = size + 2
+	return
+}
+
+// next 读取下一个请求，需要转发给其他客户端或者服务时等待之前的响应完成后返回 io.EOF 结束当前的 task
+func (r *httpRequests) next() (err error) {
+	req, err := r.readRequest()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return
+		}
+	} else {
+		var client *client
+		var service uint16
+		client, service, err = r.conn.routeHTTP(req)
+		if err == nil && client == r.client && service == r.service {
+			r.start(req)
+			return
+		}
+		if err == nil {
+			r.client = client
+			r.service = service
+			r.pending = req
+		}
+	}
+	r.err = err
+	err = r.task.waitResponses(r.conn.server.config.Timeout)
+	if err != nil {
+		r.pending = nil
+		return
+	}
+	r.task.detach()
+	return io.EOF
+}
+
+// httpTask 是访问者连接上转发给同一个客户端与服务的一组请求。
+// 切换客户端或者服务之后，关闭 task 与写入 task 都不再影响访问者的连接
+type httpTask struct {
+	net.Conn
+	conn      *conn
+	detached  uint32
+	closed    chan struct{}
+	closeOnce sync.Once
+	// progress 在写入响应时通知 waitResponses
+	progress  chan struct{}
+	responses httpResponses
+}
+
+func (t *httpTask) Write(b []byte) (n int, err error) {
+	if atomic.LoadUint32(&t.detached) == 1 {
+		// 与写入已经关闭的连接相同，readLoop 只关闭 task 而不是 tunnel
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: net.ErrClosed}
+	}
+	n, err = t.Conn.Write(b)
+	t.responses.feed(b[:n])
+	select {
+	case t.progress <- struct{}{}:
+	default:
+	}
+	return
+}
+
+func (t *httpTask) Close() error {
+	if atomic.LoadUint32(&t.detached) == 1 {
+		return nil
+	}
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	t.conn.Close()
+	return nil
+}
+
+func (t *httpTask) detach() {
+	atomic.StoreUint32(&t.detached, 1)
+}
+
+// waitResponses 等待所有请求的响应完成，timeout 大于 0 时超过 timeout 没有收到响应数据返回 os.ErrDeadlineExceeded
+func (t *httpTask) waitResponses(timeout time.Duration) error {
+	var expired <-chan time.Time
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for !t.responses.done() {
+		select {
+		case <-t.progress:
+			if timer != nil {
+				timer.Reset(timeout)
+			}
+		case <-t.closed:
+			return net.ErrClosed
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		}
+	}
+	return nil
+}
+
+const (
+	responseHeader = iota
+	responseBody
+	responseChunkSize
+	responseChunkData
+	responseTrailer
+	// responseUntracked 表示无法确定响应的结束位置，例如以关闭连接结束的响应与升级后的连接
+	responseUntracked
+)
+
+// httpResponses 解析客户端返回的 http 响应，记录已经完成的响应数量
+type httpResponses struct {
+	mtx sync.Mutex
+	// heads 依次保存等待响应的请求是否是 HEAD 请求
+	heads     []bool
+	requests  uint32
+	completed uint32
+
+	// 以下字段只在写入响应时使用
+	state     int
+	header    []byte
+	line      []byte
+	remaining int64
+}
+
+func (r *httpResponses) addRequest(head bool) {
+	r.mtx.Lock()
+	r.heads = append(r.heads, head)
+	r.mtx.Unlock()
+	atomic.AddUint32(&r.requests, 1)
+}
+
+func (r *httpResponses) popRequest() (head bool) {
+	r.mtx.Lock()
+	if len(r.heads) > 0 {
+		head = r.heads[0]
+		r.heads = r.heads[1:]
+	}
+	r.mtx.Unlock()
+	return
+}
+
+func (r *httpResponses) done() bool {
+	return atomic.LoadUint32(&r.completed) == atomic.LoadUint32(&r.requests)
+}
+
+func (r *httpResponses) complete() {
+	r.state = responseHeader
+	atomic.AddUint32(&r.completed, 1)
+}
+
+func (r *httpResponses) feed(b []byte) {
+	for len(b) > 0 {
+		switch r.state {
+		case responseBody, responseChunkData:
+			n := int64(len(b))
+			if n > r.remaining {
+				n = r.remaining
+			}
+			b = b[n:]
+			r.remaining -= n
+			if r.remaining > 0 {
+				continue
+			}
+			if r.state == responseBody {
+				r.complete()
+			} else {
+				r.state = responseChunkSize
+			}
+		case responseHeader:
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				i = len(b) - 1
+			}
+			r.header = append(r.header, b[:i+1]...)
+			b = b[i+1:]
+			if len(r.header) > predef.MaxHTTPHeaderSize {
+				r.state = responseUntracked
+				continue
+			}
+			end := len(r.header) - 1
+			if r.header[end] != '\n' {
+				continue
+			}
+			start := bytes.LastIndexByte(r.header[:end], '\n') + 1
+			if !http1.IsEmptyLine(r.header[start:]) {
+				continue
+			}
+			// 忽略响应之前的空行
+			if start > 0 {
+				r.parseHeader()
+			}
+			r.header = r.header[:0]
+		case responseChunkSize, responseTrailer:
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				i = len(b) - 1
+			}
+			r.line = append(r.line, b[:i+1]...)
+			b = b[i+1:]
+			if len(r.line) > predef.MaxHTTPHeaderSize {
+				r.state = responseUntracked
+				continue
+			}
+			if r.line[len(r.line)-1] != '\n' {
+				continue
+			}
+			line := r.line
+			r.line = r.line[:0]
+			if r.state == responseTrailer {
+				if http1.IsEmptyLine(line) {
+					r.complete()
+				}
+				continue
+			}
+			size, err := http1.ParseChunkSize(line)
+			switch {
+			case err != nil:
+				r.state = responseUntracked
+			case size == 0:
+				r.state = responseTrailer
+			default:
+				r.remaining = size + 2
+				r.state = responseChunkData
+			}
+		default:
+			return
+		}
+	}
+}
+
+// parseHeader 根据响应头确定 body 的长度，1xx 的响应之后还有最终的响应
+func (r *httpResponses) parseHeader() {
+	line, headers, err := http1.ParseHeaders(r.header)
+	if err != nil {
+		r.state = responseUntracked
+		return
+	}
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/1.")) || len(fields[1]) != 3 {
+		r.state = responseUntracked
+		return
+	}
+	code, err := http1.ParseDecimal(fields[1])
+	if err != nil {
+		r.state = responseUntracked
+		return
+	}
+	if code < 200 {
+		if code == http.StatusSwitchingProtocols {
+			r.state = responseUntracked
+		}
+		return
+	}
+	head := r.popRequest()
+	if head || code == http.StatusNoContent || code == http.StatusNotModified {
+		r.complete()
+		return
+	}
+	length, chunked, err := http1.BodyLength(headers)
+	switch {
+	case err != nil || !chunked && length < 0:
+		r.state = responseUntracked
+	case chunked:
+		r.state = responseChunkSize
+	case length == 0:
+		r.complete()
+	default:
+		r.remaining = length
+		r.state = responseBody
+	}
+}
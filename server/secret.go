@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// supported hash algorithms of secrets
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+	HashScrypt   = "scrypt"
+)
+
+const (
+	argon2idPrefix = "$argon2id$"
+	scryptPrefix   = "$scrypt$"
+
+	argon2idTime    = 3
+	argon2idMemory  = 64 * 1024
+	argon2idThreads = 4
+	scryptLogN      = 15
+	scryptR         = 8
+	scryptP         = 1
+	saltSize        = 16
+	hashSize        = 32
+)
+
+// ErrInvalidSecretHash is returned when the hashed secret can not be parsed
+var ErrInvalidSecretHash = errors.New("invalid secret hash")
+
+// isHashedSecret 根据前缀判断 secret 是否是哈希值
+func isHashedSecret(secret string) bool {
+	return strings.HasPrefix(secret, "$2a$") ||
+		strings.HasPrefix(secret, "$2b$") ||
+		strings.HasPrefix(secret, "$2y$") ||
+		strings.HasPrefix(secret, argon2idPrefix) ||
+		strings.HasPrefix(secret, scryptPrefix)
+}
+
+// verifySecret 验证 secret 与配置的 expected 是否匹配，expected 可以是哈希值或者明文
+func verifySecret(expected, secret string) bool {
+	switch {
+	case strings.HasPrefix(expected, "$2a$"), strings.HasPrefix(expected, "$2b$"), strings.HasPrefix(expected, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(expected), []byte(secret)) == nil
+	case strings.HasPrefix(expected, argon2idPrefix):
+		ok, err := verifyArgon2id(expected, secret)
+		return err == nil && ok
+	case strings.HasPrefix(expected, scryptPrefix):
+		ok, err := verifyScrypt(expected, secret)
+		return err == nil && ok
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) == 1
+}
+
+// hashChecks 限制同时计算哈希的数量，避免大量错误 secret 的握手耗尽 CPU，
+// 等待超过 hashCheckTimeout 的验证直接失败，避免握手无限制地堆积
+var hashChecks = make(chan struct{}, runtime.NumCPU())
+
+const hashCheckTimeout = 3 * time.Second
+
+// digestKey 是每个进程随机生成的 HMAC key，缓存中只保存 secret 的摘要，生成失败时不缓存
+var digestKey = newDigestKey()
+
+func newDigestKey() []byte {
+	key := make([]byte, sha256.Size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// secretDigest 返回 secret 在 digestKey 下的 HMAC-SHA256 摘要
+func secretDigest(secret string) []byte {
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write([]byte(secret))
+	return mac.Sum(nil)
+}
+
+// verified 是验证成功的哈希值与对应 secret 的摘要
+type verified struct {
+	hash   string
+	digest []byte
+}
+
+// verifySecret 验证 id 的 secret，哈希值验证成功后缓存 secret 的摘要，相同的 secret 再次验证时不需要计算哈希
+func (u *users) verifySecret(id, expected, secret string) bool {
+	if !isHashedSecret(expected) {
+		return verifySecret(expected, secret)
+	}
+	var digest []byte
+	if digestKey != nil {
+		digest = secretDigest(secret)
+		if value, ok := u.verified.Load(id); ok {
+			v := value.(verified)
+			if v.hash == expected && hmac.Equal(v.digest, digest) {
+				return true
+			}
+		}
+	}
+	timer := time.NewTimer(hashCheckTimeout)
+	select {
+	case hashChecks <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		return false
+	}
+	ok := verifySecret(expected, secret)
+	<-hashChecks
+	if ok && digest != nil {
+		u.verified.Store(id, verified{hash: expected, digest: digest})
+	}
+	return ok
+}
+
+// HashSecret hashes the secret with the algorithm, the result can be used as the secret in the users file
+func HashSecret(algorithm, secret string) (hash string, err error) {
+	switch algorithm {
+	case HashBcrypt:
+		var b []byte
+		b, err = bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		hash = string(b)
+	case HashArgon2id:
+		var salt []byte
+		salt, err = newSalt()
+		if err != nil {
+			return
+		}
+		key := argon2.IDKey([]byte(secret), salt, argon2idTime, argon2idMemory, argon2idThreads, hashSize)
+		hash = fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+			argon2idMemory, argon2idTime, argon2idThreads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	case HashScrypt:
+		var salt []byte
+		salt, err = newSalt()
+		if err != nil {
+			return
+		}
+		var key []byte
+		key, err = scrypt.Key([]byte(secret), salt, 1<<scryptLogN, scryptR, scryptP, hashSize)
+		if err != nil {
+			return
+		}
+		hash = fmt.Sprintf("%sln=%d,r=%d,p=%d$%s$%s", scryptPrefix, scryptLogN, scryptR, scryptP,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	default:
+		err = fmt.Errorf("unsupported hash algorithm '%s', supported values: %s, %s, %s",
+			algorithm, HashBcrypt, HashArgon2id, HashScrypt)
+	}
+	return
+}
+
+func newSalt() (salt []byte, err error) {
+	salt = make([]byte, saltSize)
+	_, err = rand.Read(salt)
+	return
+}
+
+// checkSecretHash 检查哈希值的格式是否正确
+func checkSecretHash(hash string) (err error) {
+	switch {
+	case strings.HasPrefix(hash, argon2idPrefix):
+		_, err = parseArgon2id(hash)
+	case strings.HasPrefix(hash, scryptPrefix):
+		_, err = parseScrypt(hash)
+	default:
+		_, err = bcrypt.Cost([]byte(hash))
+	}
+	return
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2id 解析格式为 $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> 的哈希值
+func parseArgon2id(hash string) (h argon2idHash, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		err = ErrInvalidSecretHash
+		return
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		err = ErrInvalidSecretHash
+		return
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil || h.time == 0 || h.threads == 0 {
+		err = ErrInvalidSecretHash
+		return
+	}
+	h.salt, h.key, err = decodeSaltAndKey(parts[4], parts[5])
+	return
+}
+
+func verifyArgon2id(expected, secret string) (ok bool, err error) {
+	h, err := parseArgon2id(expected)
+	if err != nil {
+		return
+	}
+	actual := argon2.IDKey([]byte(secret), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	ok = subtle.ConstantTimeCompare(actual, h.key) == 1
+	return
+}
+
+type scryptHash struct {
+	logN int
+	r    int
+	p    int
+	salt []byte
+	key  []byte
+}
+
+// parseScrypt 解析格式为 $scrypt$ln=15,r=8,p=1$<salt>$<hash> 的哈希值
+func parseScrypt(hash string) (h scryptHash, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		err = ErrInvalidSecretHash
+		return
+	}
+	_, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &h.logN, &h.r, &h.p)
+	if err != nil || h.logN < 1 || h.logN > 30 || h.r < 1 || h.p < 1 {
+		err = ErrInvalidSecretHash
+		return
+	}
+	h.salt, h.key, err = decodeSaltAndKey(parts[3], parts[4])
+	return
+}
+
+func verifyScrypt(expected, secret string) (ok bool, err error) {
+	h, err := parseScrypt(expected)
+	if err != nil {
+		return
+	}
+	actual, err := scrypt.Key([]byte(secret), h.salt, 1<<h.logN, h.r, h.p, len(h.key))
+	if err != nil {
+		return
+	}
+	ok = subtle.ConstantTimeCompare(actual, h.key) == 1
+	return
+}
+
+func decodeSaltAndKey(encodedSalt, encodedKey string) (salt, key []byte, err error) {
+	salt, err = base64.RawStdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		err = ErrInvalidSecretHash
+		return
+	}
+	key, err = base64.RawStdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) == 0 {
+		err = ErrInvalidSecretHash
+		return
+	}
+	return
+}
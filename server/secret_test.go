@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHashSecret(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id, HashScrypt} {
+		hash, err := HashSecret(algorithm, "secret1")
+		if err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if !isHashedSecret(hash) {
+			t.Fatal(algorithm, "hash is not detected", hash)
+		}
+		if err = checkSecretHash(hash); err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if !verifySecret(hash, "secret1") {
+			t.Fatal(algorithm, "failed to verify secret")
+		}
+		if verifySecret(hash, "secret2") {
+			t.Fatal(algorithm, "verified wrong secret")
+		}
+	}
+
+	_, err := HashSecret("md5", "secret1")
+	if err == nil {
+		t.Fatal("unsupported algorithm should fail")
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	if !verifySecret("secret1", "secret1") {
+		t.Fatal("failed to verify plaintext secret")
+	}
+	if verifySecret("secret1", "secret") || verifySecret("secret1", "secret11") {
+		t.Fatal("verified wrong plaintext secret")
+	}
+	for _, hash := range []string{
+		"$argon2id$v=19$m=65536,t=3,p=4$invalid",
+		"$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$a2V5",
+		"$scrypt$ln=15,r=8,p=1$c2FsdA",
+		"$scrypt$ln=99,r=8,p=1$c2FsdA$a2V5",
+		"$2a$10$invalid",
+	} {
+		if checkSecretHash(hash) == nil {
+			t.Fatal("invalid hash passed the check", hash)
+		}
+		if verifySecret(hash, "secret1") {
+			t.Fatal("verified secret with invalid hash", hash)
+		}
+	}
+}
+
+func TestVerifiedSecretCache(t *testing.T) {
+	hash, err := HashSecret(HashBcrypt, "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &users{}
+	if u.verifySecret("id1", hash, "secret2") {
+		t.Fatal("verified wrong secret")
+	}
+	if _, ok := u.verified.Load("id1"); ok {
+		t.Fatal("wrong secret should not be cached")
+	}
+	if !u.verifySecret("id1", hash, "secret1") {
+		t.Fatal("failed to verify secret")
+	}
+	value, ok := u.verified.Load("id1")
+	if !ok {
+		t.Fatal("verified secret is not cached")
+	}
+	v := value.(verified)
+	if bytes.Contains(v.digest, []byte("secret1")) || !bytes.Equal(v.digest, secretDigest("secret1")) {
+		t.Fatalf("unexpected cached digest %x", v.digest)
+	}
+
+	// 缓存命中时不需要等待计算哈希
+	for i := 0; i < cap(hashChecks); i++ {
+		hashChecks <- struct{}{}
+	}
+	if !u.verifySecret("id1", hash, "secret1") {
+		t.Fatal("failed to verify secret with cache")
+	}
+	start := time.Now()
+	if u.verifySecret("id1", hash, "secret2") {
+		t.Fatal("verified wrong secret with cache")
+	}
+	if d := time.Since(start); d < hashCheckTimeout {
+		t.Fatalf("wrong secret is rejected after %s without waiting for a hash check", d)
+	}
+	for i := 0; i < cap(hashChecks); i++ {
+		<-hashChecks
+	}
+
+	// hash 修改后缓存不再有效
+	newHash, err := HashSecret(HashBcrypt, "secret3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.verifySecret("id1", newHash, "secret1") {
+		t.Fatal("verified old secret with the new hash")
+	}
+}
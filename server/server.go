@@ -3,11 +3,13 @@ package server
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"runtime/debug"
 	"strconv"
@@ -23,26 +25,48 @@ import (
 	"github.com/isrc-cas/gt/server/sync"
 	"github.com/pion/logging"
 	"github.com/pion/turn/v2"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
 )
 
 // Server is a network agent server.
 type Server struct {
-	config       Config
-	users        users
-	Logger       logger.Logger
-	id2Agent     sync.Map
-	closing      uint32
-	tlsListener  net.Listener
-	listener     net.Listener
-	sniListener  net.Listener
-	accepted     uint64
-	served       uint64
-	failed       uint64
-	tunneling    uint64
-	apiServer    *api.Server
-	authUser     func(id string, secret string) error
-	removeClient func(id string)
-	turnServer   *turn.Server
+	config      Config
+	users       users
+	hosts       hosts
+	usersLoader usersLoader
+	Logger      logger.Logger
+	id2Agent    sync.Map
+	closing     uint32
+	tlsListener net.Listener
+	listener    net.Listener
+	sniListener net.Listener
+	// quicListener 接受 QUIC tunnel，quicTransport 在所有连接关闭后关闭
+	quicListener  *quic.Listener
+	quicTransport *quic.Transport
+	accepted      uint64
+	served        uint64
+	failed        uint64
+	tunneling     uint64
+	metrics       metrics
+	apiServer     *api.Server
+	authUser      func(id string, secret string) error
+	removeClient  func(id string)
+	turnServer    *turn.Server
+	acme          *acmeManager
+	certs         certificates
+	tcpPortMin    uint16
+	tcpPortMax    uint16
+	udpPortMin    uint16
+	udpPortMax    uint16
+
+	// tunnelClientCAs 用于验证 tunnel 的客户端证书，为 nil 时不验证
+	tunnelClientCAs *x509.CertPool
+	// unhealthyPage 是本地服务不健康时回复的页面
+	unhealthyPage []byte
+	// proxyProtocolTrusted 是允许发送 PROXY protocol 头部的来源
+	proxyProtocolTrusted []netip.Prefix
 }
 
 // New parses the command line args and creates a Server.
@@ -75,24 +99,50 @@ func New(args []string) (s *Server, err error) {
 	}
 
 	s = &Server{
-		config: conf,
-		Logger: l,
+		config:  conf,
+		Logger:  l,
+		metrics: newMetrics(),
 	}
 	return
 }
 
 func (s *Server) tlsListen() (err error) {
 	s.Logger.Info().Str("addr", s.config.TLSAddr).Msg("Listening TLS")
-	var tlsConfig *tls.Config
-	tlsConfig, err = newTLSConfig(s.config.CertFile, s.config.KeyFile, s.config.TLSMinVersion)
-	if err != nil {
-		return
+	// 根据 SNI 选择证书，重新加载证书时不需要重新监听
+	tlsConfig := &tls.Config{GetCertificate: s.getCertificate}
+	if s.config.HTTP2 {
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	if s.acme != nil {
+		// 处理 TLS-ALPN-01 验证
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+	setTLSMinVersion(tlsConfig, s.config.TLSMinVersion)
+	if s.tunnelClientCAs != nil {
+		// 只向声明了 predef.TLSTunnelProto 的 tunnel 请求客户端证书，访问者的浏览器不会弹出证书选择框。
+		// tunnel 是否提供了客户端证书在握手时检查
+		tunnelConfig := tlsConfig.Clone()
+		tunnelConfig.ClientCAs = s.tunnelClientCAs
+		tunnelConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == predef.TLSTunnelProto {
+					return tunnelConfig, nil
+				}
+			}
+			return nil, nil
+		}
 	}
-	l, err := tls.Listen("tcp", s.config.TLSAddr, tlsConfig)
+	// PROXY protocol 的头部在 TLS 握手之前
+	l, err := net.Listen("tcp", s.config.TLSAddr)
 	if err != nil {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'tlsAddr'", s.config.TLSAddr, err.Error())
 		return
 	}
+	l = tls.NewListener(s.proxyProtocolListener(l, s.config.TLSAddrProxyProtocol), tlsConfig)
 	s.tlsListener = l
 	go s.acceptLoop(l, func(c *conn) {
 		c.handle(c.handleHTTP)
@@ -107,6 +157,7 @@ func (s *Server) listen() (err error) {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'addr'", s.config.Addr, err.Error())
 		return
 	}
+	l = s.proxyProtocolListener(l, s.config.AddrProxyProtocol)
 	s.listener = l
 	go s.acceptLoop(l, func(c *conn) {
 		c.handle(c.handleHTTP)
@@ -121,6 +172,7 @@ func (s *Server) sniListen() (err error) {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'sniAddr'", s.config.SNIAddr, err.Error())
 		return
 	}
+	l = s.proxyProtocolListener(l, s.config.SNIAddrProxyProtocol)
 	s.sniListener = l
 	go s.acceptLoop(l, func(c *conn) {
 		c.handle(c.handleSNI)
@@ -169,8 +221,10 @@ func (s *Server) acceptLoop(l net.Listener, handle func(*conn)) {
 			return
 		}
 		atomic.AddUint64(&s.accepted, 1)
-		c := newConn(conn, s)
-		go handle(c)
+		// newConn 可能需要读取 PROXY protocol 头部才能获取地址
+		go func(conn net.Conn) {
+			handle(newConn(conn, s))
+		}(conn)
 	}
 }
 
@@ -178,22 +232,57 @@ func (s *Server) acceptLoop(l net.Listener, handle func(*conn)) {
 func (s *Server) Start() (err error) {
 	s.Logger.Info().Interface("config", &s.config).Msg(predef.Version)
 
-	err = s.users.mergeUsers(s.config.Users, nil, nil)
+	users, err := s.loadUsers(s.config.Users)
 	if err != nil {
 		return
 	}
-	users := make(map[string]user)
-	err = config.Yaml2Interface(s.config.Options.Users, users)
+	hostIndex, err := newHostIndex(users)
 	if err != nil {
 		return
 	}
-	err = s.users.mergeUsers(users, s.config.ID, s.config.Secret)
+	s.users.reload(users)
+	s.hosts.index.Store(hostIndex)
+
+	if len(s.config.HTTPMUXHeader) <= 0 {
+		err = fmt.Errorf("HTTP multiplexing header (-httpMUXHeader option) '%s' is invalid", s.config.HTTPMUXHeader)
+		return
+	}
+
+	if s.config.UnhealthyStatus != http.StatusBadGateway && s.config.UnhealthyStatus != http.StatusServiceUnavailable {
+		err = fmt.Errorf("unhealthy status (-unhealthyStatus option) '%d' must be 502 or 503", s.config.UnhealthyStatus)
+		return
+	}
+	if len(s.config.UnhealthyPage) > 0 {
+		s.unhealthyPage, err = os.ReadFile(s.config.UnhealthyPage)
+		if err != nil {
+			err = fmt.Errorf("failed to read unhealthy page (-unhealthyPage option) '%s', cause %s", s.config.UnhealthyPage, err.Error())
+			return
+		}
+	}
+
+	err = s.verifyProxyProtocol()
 	if err != nil {
 		return
 	}
 
-	if len(s.config.HTTPMUXHeader) <= 0 {
-		err = fmt.Errorf("HTTP multiplexing header (-httpMUXHeader option) '%s' is invalid", s.config.HTTPMUXHeader)
+	if len(s.config.TCPRange) > 0 {
+		s.tcpPortMin, s.tcpPortMax, err = parsePortRange(s.config.TCPRange)
+		if err != nil {
+			err = fmt.Errorf("%s, please check option 'tcpRange'", err.Error())
+			return
+		}
+	}
+
+	if len(s.config.UDPRange) > 0 {
+		s.udpPortMin, s.udpPortMax, err = parsePortRange(s.config.UDPRange)
+		if err != nil {
+			err = fmt.Errorf("%s, please check option 'udpRange'", err.Error())
+			return
+		}
+	}
+
+	if len(s.config.TunnelWebSocketPath) > 0 && !strings.HasPrefix(s.config.TunnelWebSocketPath, "/") {
+		err = fmt.Errorf("tunnel websocket path (-tunnelWebSocketPath option) '%s' must begin with /", s.config.TunnelWebSocketPath)
 		return
 	}
 
@@ -215,12 +304,39 @@ func (s *Server) Start() (err error) {
 		if strings.IndexByte(s.config.APIAddr, ':') == -1 {
 			s.config.APIAddr = ":" + s.config.APIAddr
 		}
-		apiServer := api.NewServer(s.config.APIAddr, s.Logger.With().Str("scope", "api").Logger(), s.users.idConflict)
+		apiServer := api.NewServer(s.config.APIAddr, s.Logger.With().Str("scope", "api").Logger(), s.users.idConflict, s.writeMetrics)
+		apiServer.AdminToken = s.config.APIAdminToken
+		apiServer.Clients = adminClients{server: s}
 		s.apiServer = apiServer
 	}
 
 	var listening bool
-	if len(s.config.TLSAddr) > 0 && len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0 {
+	if s.config.ACME {
+		if len(s.config.TLSAddr) == 0 && len(s.config.Addr) == 0 {
+			err = errors.New("option 'acme' requires option 'tlsAddr' or 'addr'")
+			return
+		}
+		s.acme = s.newACMEManager()
+	}
+	if s.hasCerts() {
+		err = s.loadCerts(s.config.Certs)
+		if err != nil {
+			return
+		}
+		go s.watchCerts()
+	}
+	if len(s.config.TunnelClientCA) > 0 {
+		if (len(s.config.TLSAddr) == 0 && len(s.config.QUICAddr) == 0) || !(s.hasCerts() || s.acme != nil) {
+			err = errors.New("option 'tunnelClientCA' requires option 'tlsAddr' or 'quicAddr' with certs")
+			return
+		}
+		s.tunnelClientCAs, err = loadCertPool(s.config.TunnelClientCA)
+		if err != nil {
+			err = fmt.Errorf("failed to load tunnel client CA (-tunnelClientCA option) '%s', cause %s", s.config.TunnelClientCA, err.Error())
+			return
+		}
+	}
+	if len(s.config.TLSAddr) > 0 && (s.hasCerts() || s.acme != nil) {
 		if strings.IndexByte(s.config.TLSAddr, ':') == -1 {
 			s.config.TLSAddr = ":" + s.config.TLSAddr
 		}
@@ -254,6 +370,19 @@ func (s *Server) Start() (err error) {
 		err = errors.New("no services is providing, please check the config")
 		return
 	}
+	if len(s.config.QUICAddr) > 0 {
+		if !(s.hasCerts() || s.acme != nil) {
+			err = errors.New("option 'quicAddr' requires certs")
+			return
+		}
+		if strings.IndexByte(s.config.QUICAddr, ':') == -1 {
+			s.config.QUICAddr = ":" + s.config.QUICAddr
+		}
+		err = s.quicListen()
+		if err != nil {
+			return
+		}
+	}
 
 	if len(s.config.STUNAddr) > 0 {
 		err = s.startSTUNServer()
@@ -268,6 +397,10 @@ func (s *Server) Start() (err error) {
 			return
 		}
 	}
+
+	if len(s.config.AuthAPI) == 0 {
+		go s.watchUsers()
+	}
 	return
 }
 
@@ -307,7 +440,13 @@ func (s *Server) startSTUNServer() (err error) {
 		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
 			value, ok := s.users.Load(username)
 			if ok {
-				key = []byte(value.(string))
+				secret := value.(user).Secret
+				if !isHashedSecret(secret) {
+					return []byte(secret), true
+				}
+				// 哈希过的 secret 无法用作 key，内存中也不保存明文的 secret
+				stunLogger.Warn().Str("id", username).Msg("the secret is hashed, TURN is unavailable")
+				return nil, false
 			}
 			return
 		},
@@ -333,6 +472,11 @@ func newTLSConfig(cert, key, tlsMinVersion string) (tlsConfig *tls.Config, err e
 	}
 	tlsConfig = &tls.Config{}
 	tlsConfig.Certificates = []tls.Certificate{crt}
+	setTLSMinVersion(tlsConfig, tlsMinVersion)
+	return
+}
+
+func setTLSMinVersion(tlsConfig *tls.Config, tlsMinVersion string) {
 	switch strings.ToLower(tlsMinVersion) {
 	case "tls1.1":
 		tlsConfig.MinVersion = tls.VersionTLS11
@@ -351,7 +495,6 @@ func newTLSConfig(cert, key, tlsMinVersion string) (tlsConfig *tls.Config, err e
 	case "tls1.3":
 		tlsConfig.MinVersion = tls.VersionTLS13
 	}
-	return
 }
 
 func (s *Server) startAPIServer() (err error) {
@@ -444,12 +587,18 @@ func (s *Server) Close() {
 	if s.sniListener != nil {
 		event.AnErr("sniListener", s.sniListener.Close())
 	}
+	if s.quicListener != nil {
+		event.AnErr("quicListener", s.quicListener.Close())
+	}
 	s.id2Agent.Range(func(key, value interface{}) bool {
 		if c, ok := value.(*client); ok && c != nil {
 			c.close()
 		}
 		return true
 	})
+	if s.quicTransport != nil {
+		event.AnErr("quicTransport", s.quicTransport.Close())
+	}
 	event.Msg("server stopped")
 }
 
@@ -480,6 +629,9 @@ func (s *Server) Shutdown() {
 	if s.sniListener != nil {
 		event.AnErr("sniListener", s.sniListener.Close())
 	}
+	if s.quicListener != nil {
+		event.AnErr("quicListener", s.quicListener.Close())
+	}
 	for {
 		accepted := s.GetAccepted()
 		served := s.GetServed()
@@ -515,6 +667,9 @@ func (s *Server) Shutdown() {
 		}
 		return true
 	})
+	if s.quicTransport != nil {
+		event.AnErr("quicTransport", s.quicTransport.Close())
+	}
 	event.Msg("server stopped")
 }
 
@@ -524,6 +679,14 @@ func (s *Server) getOrCreateClient(id string, fn func() interface{}) (result *cl
 	return
 }
 
+// getLimits 返回用户配置的限制，没有配置时不限制
+func (s *Server) getLimits(id string) (l limits) {
+	if value, ok := s.users.Load(id); ok {
+		l = value.(user).limits
+	}
+	return
+}
+
 func (s *Server) getClient(id string) (c *client, ok bool) {
 	value, ok := s.id2Agent.Load(id)
 	if ok {
@@ -600,7 +763,7 @@ func (s *Server) authUserOrCreateUser(id, secret string) (err error) {
 			temp:   true,
 		}
 	})
-	if loaded && secret != value.(user).Secret {
+	if loaded && !s.users.verifySecret(id, value.(user).Secret, secret) {
 		err = ErrInvalidUser
 	}
 	return
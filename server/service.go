@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+var (
+	// ErrTCPForwardingDisabled is returned when the tcpRange option is not configured
+	ErrTCPForwardingDisabled = errors.New("tcp forwarding is disabled, please check option 'tcpRange'")
+	// ErrUDPForwardingDisabled is returned when the udpRange option is not configured
+	ErrUDPForwardingDisabled = errors.New("udp forwarding is disabled, please check option 'udpRange'")
+	// ErrServicesMismatch is returned when the services are different from the ones of other tunnels
+	ErrServicesMismatch = errors.New("services do not match the services of other tunnels")
+	// ErrServiceNotFound is returned when no service matches the request
+	ErrServiceNotFound = errors.New("service not found")
+)
+
+// service 是客户端在握手时声明的服务
+type service struct {
+	index       uint16
+	typ         predef.ServiceType
+	port        uint16
+	subdomain   []byte
+	pathPrefix  []byte
+	headerName  []byte
+	headerValue []byte
+
+	openedPort  uint16
+	tcpListener net.Listener
+	udpConn     net.PacketConn
+	udpSessions map[string]*udpSession
+	udpMtx      sync.Mutex
+}
+
+func (s *service) equal(o *service) bool {
+	return s.typ == o.typ &&
+		s.port == o.port &&
+		bytes.Equal(s.subdomain, o.subdomain) &&
+		bytes.Equal(s.pathPrefix, o.pathPrefix) &&
+		bytes.Equal(s.headerName, o.headerName) &&
+		bytes.Equal(s.headerValue, o.headerValue)
+}
+
+// readServices 读取客户端在握手时声明的服务。
+// legacy 表示客户端使用 OptionOpenTCPPort 或 OptionOpenUDPPort 声明服务，此时不使用 predef.ServicesData。
+func (c *conn) readServices(option predef.Option) (services []*service, legacy bool, err error) {
+	if option&predef.OptionServices == 0 {
+		legacy = true
+		if option&predef.OptionOpenTCPPort != 0 {
+			var port uint16
+			port, err = c.readPort()
+			if err != nil {
+				return
+			}
+			services = append(services, &service{typ: predef.ServiceTCP, port: port})
+		}
+		if option&predef.OptionOpenUDPPort != 0 {
+			var port uint16
+			port, err = c.readPort()
+			if err != nil {
+				return
+			}
+			services = append(services, &service{typ: predef.ServiceUDP, port: port})
+		}
+		for i, svc := range services {
+			svc.index = uint16(i)
+		}
+		return
+	}
+
+	count, err := c.Reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if count < 1 || count > predef.MaxServices {
+		err = fmt.Errorf("invalid count of services: %d", count)
+		return
+	}
+	services = make([]*service, count)
+	for i := range services {
+		svc := &service{index: uint16(i)}
+		svc.typ, err = c.Reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if svc.typ > predef.ServiceUDP {
+			err = fmt.Errorf("invalid type of service: %d", svc.typ)
+			return
+		}
+		svc.port, err = c.readPort()
+		if err != nil {
+			return
+		}
+		for _, field := range []*[]byte{&svc.subdomain, &svc.pathPrefix, &svc.headerName, &svc.headerValue} {
+			*field, err = c.readString()
+			if err != nil {
+				return
+			}
+		}
+		services[i] = svc
+	}
+	return
+}
+
+func (c *conn) readString() (value []byte, err error) {
+	l, err := c.Reader.ReadByte()
+	if err != nil || l == 0 {
+		return
+	}
+	peekBytes, err := c.Reader.Peek(int(l))
+	if err != nil {
+		return
+	}
+	value = make([]byte, l)
+	copy(value, peekBytes)
+	_, err = c.Reader.Discard(int(l))
+	return
+}
+
+// openServices 打开服务需要的端口，客户端的多个 tunnel 共享同一组服务。
+// 打开失败时，failed 为打开失败的服务。
+func (c *client) openServices(s *Server, services []*service, legacy bool) (result []*service, failed *service, err error) {
+	c.servicesMtx.Lock()
+	defer c.servicesMtx.Unlock()
+	if c.services != nil {
+		if len(c.services) != len(services) || c.legacyServices != legacy {
+			err = ErrServicesMismatch
+			return
+		}
+		for i, svc := range services {
+			if !svc.equal(c.services[i]) {
+				err = ErrServicesMismatch
+				return
+			}
+		}
+		result = c.services
+		return
+	}
+
+	for _, svc := range services {
+		switch svc.typ {
+		case predef.ServiceTCP:
+			err = svc.openTCP(s, c)
+		case predef.ServiceUDP:
+			err = svc.openUDP(s, c)
+		}
+		if err != nil {
+			failed = svc
+			for _, svc := range services {
+				svc.close()
+			}
+			return
+		}
+	}
+	if services == nil {
+		services = []*service{}
+	}
+	c.services = services
+	c.legacyServices = legacy
+	result = services
+	return
+}
+
+func (c *client) closeServices() {
+	c.servicesMtx.Lock()
+	for _, svc := range c.services {
+		svc.close()
+	}
+	c.services = nil
+	c.servicesMtx.Unlock()
+}
+
+// declaresSubdomain 判断客户端是否声明了 subdomain 的 http 服务
+func (c *client) declaresSubdomain(subdomain string) bool {
+	c.servicesMtx.Lock()
+	defer c.servicesMtx.Unlock()
+	for _, svc := range c.services {
+		if svc.typ == predef.ServiceHTTP && len(svc.subdomain) > 0 && bytes.EqualFold(svc.subdomain, []byte(subdomain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHTTPService 按照 subdomain、path 前缀、header 的顺序匹配 http 服务，
+// 所有规则都匹配的第一个服务被选中，都不匹配时选择第一个没有规则的服务。
+func (c *client) matchHTTPService(subdomain []byte, path func() []byte, header func(name []byte) []byte) (index uint16, err error) {
+	c.servicesMtx.Lock()
+	services := c.services
+	legacy := c.legacyServices
+	c.servicesMtx.Unlock()
+	if legacy {
+		return
+	}
+
+	var defaultService *service
+	for _, svc := range services {
+		if svc.typ != predef.ServiceHTTP {
+			continue
+		}
+		if len(svc.subdomain) == 0 && len(svc.pathPrefix) == 0 && len(svc.headerName) == 0 {
+			if defaultService == nil {
+				defaultService = svc
+			}
+			continue
+		}
+		if len(svc.subdomain) > 0 && !bytes.EqualFold(svc.subdomain, subdomain) {
+			continue
+		}
+		if len(svc.pathPrefix) > 0 && (path == nil || !bytes.HasPrefix(path(), svc.pathPrefix)) {
+			continue
+		}
+		if len(svc.headerName) > 0 && (header == nil || !bytes.Equal(header(svc.headerName), svc.headerValue)) {
+			continue
+		}
+		index = svc.index
+		return
+	}
+	if defaultService == nil {
+		err = ErrServiceNotFound
+		return
+	}
+	index = defaultService.index
+	return
+}
+
+// openTCP 打开 tcp 端口，port 为 0 时从 tcpRange 中随机选择
+func (s *service) openTCP(server *Server, c *client) (err error) {
+	if server.tcpPortMin == 0 {
+		err = ErrTCPForwardingDisabled
+		return
+	}
+	var l net.Listener
+	s.openedPort, err = listenInRange(server.tcpPortMin, server.tcpPortMax, s.port, func(port uint16) (err error) {
+		l, err = net.Listen("tcp", net.JoinHostPort("", strconv.FormatUint(uint64(port), 10)))
+		return
+	})
+	if err != nil {
+		return
+	}
+	s.tcpListener = l
+	server.Logger.Info().Str("id", c.ID).Uint16("service", s.index).Uint16("port", s.openedPort).Msg("tcp port opened")
+	go server.acceptLoop(l, func(conn *conn) {
+		conn.serve(func() bool {
+			return conn.handleForwarding(c, s.index)
+		})
+	})
+	return
+}
+
+func (s *service) close() {
+	if s.tcpListener != nil {
+		_ = s.tcpListener.Close()
+	}
+	s.closeUDP()
+}
+
+// listenInRange 在 [min, max] 范围内监听 port，port 为 0 时随机选择
+func listenInRange(min, max, port uint16, listen func(port uint16) error) (result uint16, err error) {
+	if port != 0 {
+		if port < min || port > max {
+			err = fmt.Errorf("port %d is out of range %d-%d", port, min, max)
+			return
+		}
+		err = listen(port)
+		result = port
+		return
+	}
+	n := int(max-min) + 1
+	for i := 0; i < 10; i++ {
+		result = min + uint16(rand.Intn(n))
+		err = listen(result)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+// udpSession 表示来自同一个地址的 udp 包组成的会话，实现了 net.Conn 接口。
+// 收到的包被转换成带长度前缀的数据流，从而可以复用 tcp 的转发逻辑，并保留包的边界。
+type udpSession struct {
+	pc           net.PacketConn
+	addr         net.Addr
+	reader       connection.PacketReader
+	writer       connection.PacketWriter
+	packets      chan []byte
+	done         chan struct{}
+	closeOnce    sync.Once
+	idleTimeout  time.Duration
+	lastActive   int64
+	readDeadline atomic.Value
+}
+
+func newUDPSession(pc net.PacketConn, addr net.Addr, idleTimeout time.Duration) *udpSession {
+	s := &udpSession{
+		pc:          pc,
+		addr:        addr,
+		packets:     make(chan []byte, 64),
+		done:        make(chan struct{}),
+		idleTimeout: idleTimeout,
+		lastActive:  time.Now().UnixNano(),
+	}
+	s.readDeadline.Store(time.Time{})
+	s.reader.ReadPacket = s.readPacket
+	s.writer.WritePacket = s.writePacket
+	return s
+}
+
+// deliver 投递一个从 addr 收到的包，会话繁忙时丢弃该包
+func (s *udpSession) deliver(packet []byte) (ok bool) {
+	select {
+	case s.packets <- packet:
+		ok = true
+	case <-s.done:
+	default:
+	}
+	return
+}
+
+func (s *udpSession) readPacket(p []byte) (n int, err error) {
+	for {
+		now := time.Now()
+		wait := time.Duration(atomic.LoadInt64(&s.lastActive) + int64(s.idleTimeout) - now.UnixNano())
+		if s.idleTimeout > 0 && wait <= 0 {
+			err = os.ErrDeadlineExceeded
+			return
+		}
+		dl := s.readDeadline.Load().(time.Time)
+		if !dl.IsZero() {
+			if !dl.After(now) {
+				err = os.ErrDeadlineExceeded
+				return
+			}
+			if s.idleTimeout <= 0 || dl.Sub(now) < wait {
+				wait = dl.Sub(now)
+			}
+		} else if s.idleTimeout <= 0 {
+			wait = time.Hour
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case packet := <-s.packets:
+			timer.Stop()
+			atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+			n = copy(p, packet)
+			return
+		case <-s.done:
+			timer.Stop()
+			err = io.EOF
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *udpSession) writePacket(p []byte) (err error) {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+	_, err = s.pc.WriteTo(p, s.addr)
+	return
+}
+
+func (s *udpSession) Read(p []byte) (n int, err error) {
+	return s.reader.Read(p)
+}
+
+func (s *udpSession) Write(p []byte) (n int, err error) {
+	return s.writer.Write(p)
+}
+
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(t)
+	return nil
+}
+
+func (s *udpSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// openUDP 打开 udp 端口，port 为 0 时从 udpRange 中随机选择
+func (s *service) openUDP(server *Server, c *client) (err error) {
+	if server.udpPortMin == 0 {
+		err = ErrUDPForwardingDisabled
+		return
+	}
+	var pc net.PacketConn
+	s.openedPort, err = listenInRange(server.udpPortMin, server.udpPortMax, s.port, func(port uint16) (err error) {
+		pc, err = net.ListenPacket("udp", net.JoinHostPort("", strconv.FormatUint(uint64(port), 10)))
+		return
+	})
+	if err != nil {
+		return
+	}
+	s.udpMtx.Lock()
+	s.udpConn = pc
+	s.udpSessions = make(map[string]*udpSession)
+	s.udpMtx.Unlock()
+	server.Logger.Info().Str("id", c.ID).Uint16("service", s.index).Uint16("port", s.openedPort).Msg("udp port opened")
+	go s.udpReadLoop(server, c, pc)
+	return
+}
+
+func (s *service) udpReadLoop(server *Server, c *client, pc net.PacketConn) {
+	var err error
+	defer func() {
+		if errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+		server.Logger.Info().Str("addr", pc.LocalAddr().String()).Err(err).Msg("udpReadLoop ended")
+	}()
+	server.Logger.Info().Str("addr", pc.LocalAddr().String()).Msg("udpReadLoop started")
+	buf := make([]byte, connection.MaxPacketSize)
+	for {
+		var n int
+		var addr net.Addr
+		n, addr, err = pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := addr.String()
+		s.udpMtx.Lock()
+		if s.udpConn != pc {
+			s.udpMtx.Unlock()
+			return
+		}
+		session, ok := s.udpSessions[key]
+		if !ok {
+			session = newUDPSession(pc, addr, server.config.UDPTimeout)
+			s.udpSessions[key] = session
+		}
+		s.udpMtx.Unlock()
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		if !session.deliver(packet) {
+			server.Logger.Debug().Str("addr", key).Int("len", n).Msg("udp packet dropped")
+		}
+		if !ok {
+			atomic.AddUint64(&server.accepted, 1)
+			nc := newConn(session, server)
+			go func() {
+				defer s.removeUDPSession(key, session)
+				nc.serve(func() bool {
+					return nc.handleForwarding(c, s.index)
+				})
+			}()
+		}
+	}
+}
+
+func (s *service) removeUDPSession(key string, session *udpSession) {
+	s.udpMtx.Lock()
+	if s.udpSessions[key] == session {
+		delete(s.udpSessions, key)
+	}
+	s.udpMtx.Unlock()
+}
+
+func (s *service) closeUDP() {
+	s.udpMtx.Lock()
+	if s.udpConn != nil {
+		_ = s.udpConn.Close()
+		s.udpConn = nil
+		for _, session := range s.udpSessions {
+			_ = session.Close()
+		}
+		s.udpSessions = nil
+	}
+	s.udpMtx.Unlock()
+}
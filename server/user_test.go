@@ -1,6 +1,8 @@
 package server
 
 import (
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/isrc-cas/gt/config"
@@ -54,3 +56,39 @@ func TestUser(t *testing.T) {
 		return true
 	})
 }
+
+func TestUsersReload(t *testing.T) {
+	current := users{}
+	current.Store("id1", user{Secret: "secret1"})
+	current.Store("id2", user{Secret: "secret2"})
+	current.Store("id3", user{Secret: "secret3"})
+	current.Store("temp", user{Secret: "temp", temp: true})
+
+	newUsers := &users{}
+	newUsers.Store("id1", user{Secret: "secret1"})
+	newUsers.Store("id2", user{Secret: "secret2-rotated"})
+	newUsers.Store("id4", user{Secret: "secret4"})
+
+	changed := current.reload(newUsers)
+	sort.Strings(changed)
+	if !reflect.DeepEqual(changed, []string{"id2", "id3"}) {
+		t.Fatalf("unexpected changed ids: %v", changed)
+	}
+	expected := map[string]string{
+		"id1":  "secret1",
+		"id2":  "secret2-rotated",
+		"id4":  "secret4",
+		"temp": "temp",
+	}
+	count := 0
+	current.Range(func(key, value interface{}) bool {
+		count++
+		if expected[key.(string)] != value.(user).Secret {
+			t.Fatalf("unexpected secret of %q", key)
+		}
+		return true
+	})
+	if count != len(expected) {
+		t.Fatalf("unexpected count of users: %d", count)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	stdbufio "bufio"
+
+	"github.com/gorilla/websocket"
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+// isWebSocketTunnelPath 判断请求的 path 是否是 tunnelWebSocketPath
+func (s *Server) isWebSocketTunnelPath(path []byte) bool {
+	if i := bytes.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return string(path) == s.config.TunnelWebSocketPath
+}
+
+// serveWebSocketTunnel 升级为 WebSocket 后将其作为 tunnel 处理
+func (c *conn) serveWebSocketTunnel() (err error) {
+	// websocket.Upgrader 会将 reader 重置为读取 rc，rc 必须包含 c.Reader 中已经缓冲的数据
+	rc := &readerConn{Conn: c.Conn, reader: c.Reader}
+	reader := stdbufio.NewReader(rc)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	w := &hijackResponseRecorder{
+		responseRecorder: newResponseRecorder(),
+		conn:             rc,
+		reader:           reader,
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		if !w.hijacked {
+			_ = w.writeResponse(c)
+		}
+		return
+	}
+	// WebSocketConn 自己实现读超时，底层连接不再需要
+	err = c.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	tunnel := newConn(&webSocketConn{
+		WebSocketConn: connection.NewWebSocketConn(ws),
+		raw:           c.Conn,
+	}, c.server)
+	tunnel.handle(func() bool {
+		tunnel.Logger.Warn().Msg("invalid tunnel over websocket")
+		return false
+	})
+	return
+}
+
+// webSocketConn 是通过 WebSocket 连接的 tunnel，raw 是原始连接，用于验证客户端证书
+type webSocketConn struct {
+	*connection.WebSocketConn
+	raw net.Conn
+}
+
+// readerConn 通过 reader 读取 Conn
+type readerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// hijackResponseRecorder 在升级失败时保存响应，升级成功时交出连接
+type hijackResponseRecorder struct {
+	*responseRecorder
+	conn     net.Conn
+	reader   *stdbufio.Reader
+	hijacked bool
+}
+
+func (r *hijackResponseRecorder) Hijack() (net.Conn, *stdbufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, errors.New("connection has been hijacked")
+	}
+	r.hijacked = true
+	return r.conn, stdbufio.NewReadWriter(r.reader, stdbufio.NewWriter(r.conn)), nil
+}
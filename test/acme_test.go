@@ -0,0 +1,92 @@
+package test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/isrc-cas/gt/test/internal/acmetest"
+	"github.com/isrc-cas/gt/util"
+)
+
+func testACME(t *testing.T, challengeType string) {
+	httpServer := setupNamedHTTPServer(t, "acme")
+	defer httpServer.Close()
+
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	host := id + ".example.com"
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+
+	ca := acmetest.NewCAServer(t).ChallengeTypes(challengeType).Start()
+	switch challengeType {
+	case "http-01":
+		ca.Resolve(host, serverAddr)
+	case "tls-alpn-01":
+		ca.Resolve(host, tlsAddr)
+	}
+
+	local := "http://" + httpServer.Addr().String()
+	s, c, _ := setupServerAndClient(t, local, []string{
+		"server",
+		"-addr", serverAddr,
+		"-tlsAddr", tlsAddr,
+		"-acme",
+		"-acmeDomain", "example.com",
+		"-acmeCacheDir", t.TempDir(),
+		"-acmeDirectoryURL", ca.URL(),
+		"-id", id,
+		"-secret", secret,
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", local,
+		"-remote", serverAddr,
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	tlsConfig := &tls.Config{RootCAs: ca.Roots()}
+	httpClient := setupHTTPClient(tlsAddr, tlsConfig)
+	resp, err := httpClient.Get("https://" + host + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "acme /path" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// 没有注册的 id 不会申请证书
+	conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: ca.Roots(), ServerName: "unknown.example.com"})
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("certificate should not be issued for unknown hosts")
+	}
+
+	// 已注册的 id 在其它域名下也不会申请证书
+	conn, err = tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: ca.Roots(), ServerName: id + ".attacker.com"})
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("certificate should not be issued for foreign domains")
+	}
+}
+
+func TestACMEHTTP01(t *testing.T) {
+	t.Parallel()
+	testACME(t, "http-01")
+}
+
+func TestACMETLSALPN01(t *testing.T) {
+	t.Parallel()
+	testACME(t, "tls-alpn-01")
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/server/api"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestAdminAPI(t *testing.T) {
+	t.Parallel()
+	httpServer := setupNamedHTTPServer(t, "admin")
+	defer httpServer.Close()
+
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	token := "admin-token"
+	apiAddr := net.JoinHostPort("localhost", util.RandomPort())
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	local := "http://" + httpServer.Addr().String()
+	s, c, _ := setupServerAndClient(t, local, []string{
+		"server",
+		"-addr", serverAddr,
+		"-apiAddr", apiAddr,
+		"-apiAdminToken", token,
+		"-id", id,
+		"-secret", secret,
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", local,
+		"-remote", serverAddr,
+		"-remoteConnections", "2",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	do := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+apiAddr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("GET", "/clients", "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", resp.StatusCode)
+	}
+	resp = do("GET", "/clients", "wrong-token")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", resp.StatusCode)
+	}
+
+	// 等待所有的 tunnel 连接上
+	var clients []api.ClientInfo
+	for i := 0; i < 50; i++ {
+		resp = do("GET", "/clients", token)
+		clients = nil
+		err := json.NewDecoder(resp.Body).Decode(&clients)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clients) == 1 && len(clients[0].Tunnels) == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(clients) != 1 || clients[0].ID != id || len(clients[0].Tunnels) != 2 {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+	if clients[0].Tunnels[0].ConnectedAt.IsZero() || clients[0].Tunnels[0].RemoteAddr == "" {
+		t.Fatalf("unexpected tunnel %+v", clients[0].Tunnels[0])
+	}
+
+	resp = do("GET", "/clients/"+id, token)
+	var info api.ClientInfo
+	err := json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != id {
+		t.Fatalf("unexpected client %+v", info)
+	}
+	resp = do("GET", "/clients/unknown", token)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("unexpected status code", resp.StatusCode)
+	}
+
+	closed := make(chan struct{}, 2)
+	c.OnTunnelClose.Store(func() {
+		closed <- struct{}{}
+	})
+	resp = do("DELETE", "/clients/"+id, token)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal("unexpected status code", resp.StatusCode)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel should be closed after the client is kicked")
+	}
+}
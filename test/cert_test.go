@@ -0,0 +1,111 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func writeCert(t *testing.T, dir, name, commonName string, dnsNames ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func peerCommonName(t *testing.T, addr, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertSelectionAndReload(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "a", "a-1", "*.a.example.com")
+	writeCert(t, dir, "b", "b-1", "*.b.example.com")
+
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", "",
+		"-tlsAddr", tlsAddr,
+		"-certDir", dir,
+		"-certWatch", "0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for serverName, expect := range map[string]string{
+		"id1.a.example.com": "a-1",
+		"id1.b.example.com": "b-1",
+		"id1.c.example.com": "a-1",
+	} {
+		if cn := peerCommonName(t, tlsAddr, serverName); cn != expect {
+			t.Fatalf("%s: unexpected cert %s, expected %s", serverName, cn, expect)
+		}
+	}
+
+	writeCert(t, dir, "b", "b-2", "*.b.example.com")
+	writeCert(t, dir, "c", "c-1", "*.c.example.com")
+	err = s.ReloadCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serverName, expect := range map[string]string{
+		"id1.a.example.com": "a-1",
+		"id1.b.example.com": "b-2",
+		"id1.c.example.com": "c-1",
+	} {
+		if cn := peerCommonName(t, tlsAddr, serverName); cn != expect {
+			t.Fatalf("%s: unexpected cert %s after reload, expected %s", serverName, cn, expect)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+const (
+	failoverID     = "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	failoverSecret = "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+)
+
+func startFailoverServer(t *testing.T, addr string) *server.Server {
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-id", failoverID,
+		"-secret", failoverSecret,
+		"-timeout", "10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRemoteFailover(t *testing.T) {
+	t.Parallel()
+	l := setupNamedHTTPServer(t, "failover")
+	defer l.Close()
+
+	id := failoverID
+	secret := failoverSecret
+	get := func(addr string) {
+		httpClient := setupHTTPClient(addr, nil)
+		resp, err := httpClient.Get("http://" + id + ".example.com/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "failover /test" {
+			t.Fatalf("%s: unexpected response %d %q", addr, resp.StatusCode, body)
+		}
+	}
+
+	// primary 优先级更高，但是还没有启动
+	primaryAddr := net.JoinHostPort("localhost", util.RandomPort())
+	backupAddr := net.JoinHostPort("localhost", util.RandomPort())
+	backup := startFailoverServer(t, backupAddr)
+	defer backup.Close()
+
+	c, err := client.New([]string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", "http://" + l.Addr().String(),
+		"-remote", primaryAddr,
+		"-remote", backupAddr,
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "1s",
+		"-reconnectMaxDelay", "2s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.WaitUntilReady(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(backupAddr)
+
+	// backup 停止后切换到已经恢复的 primary
+	primary := startFailoverServer(t, primaryAddr)
+	defer primary.Close()
+	backup.Close()
+	for i := 0; ; i++ {
+		time.Sleep(time.Second)
+		if primary.GetTunneling() > 0 {
+			break
+		}
+		if i > 10 {
+			t.Fatal("client did not fail over to the primary server")
+		}
+	}
+	get(primaryAddr)
+}
+
+func TestRemoteAndRemoteAPI(t *testing.T) {
+	t.Parallel()
+	l := setupNamedHTTPServer(t, "failover")
+	defer l.Close()
+
+	primaryAddr := net.JoinHostPort("localhost", util.RandomPort())
+	apiAddr := net.JoinHostPort("localhost", util.RandomPort())
+	primary := startFailoverServer(t, primaryAddr)
+	defer primary.Close()
+	backup := startFailoverServer(t, apiAddr)
+	defer backup.Close()
+
+	var queries int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		_, _ = w.Write([]byte(`{"serverAddress":"tcp://` + apiAddr + `"}`))
+	}))
+	defer api.Close()
+
+	c, err := client.New([]string{
+		"client",
+		"-id", failoverID,
+		"-secret", failoverSecret,
+		"-local", "http://" + l.Addr().String(),
+		"-remote", primaryAddr,
+		"-remoteAPI", api.URL,
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "1s",
+		"-reconnectMaxDelay", "2s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.WaitUntilReady(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary.GetTunneling() == 0 {
+		t.Fatal("client should connect to the remote first")
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Fatalf("remote api should not be queried while the remote is up, queried %d times", n)
+	}
+
+	// remote 停止后使用 remoteAPI 返回的服务端
+	primary.Close()
+	for i := 0; ; i++ {
+		time.Sleep(time.Second)
+		if backup.GetTunneling() > 0 {
+			break
+		}
+		if i > 10 {
+			t.Fatal("client did not fail over to the server from remote api")
+		}
+	}
+	if atomic.LoadInt32(&queries) == 0 {
+		t.Fatal("remote api should be queried after the remote fails")
+	}
+}
+
+func TestRemoteFailoverOnRejection(t *testing.T) {
+	t.Parallel()
+	l := setupNamedHTTPServer(t, "failover")
+	defer l.Close()
+
+	// primary 模拟负载均衡器后面不可用的服务端，接受 tcp 连接后直接断开
+	primary, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	go func() {
+		for {
+			conn, err := primary.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	primaryAddr := primary.Addr().String()
+	backupAddr := net.JoinHostPort("localhost", util.RandomPort())
+	backup := startFailoverServer(t, backupAddr)
+	defer backup.Close()
+
+	c, err := client.New([]string{
+		"client",
+		"-id", failoverID,
+		"-secret", failoverSecret,
+		"-local", "http://" + l.Addr().String(),
+		"-remote", primaryAddr,
+		"-remote", backupAddr,
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "1s",
+		"-reconnectMaxDelay", "2s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.WaitUntilReady(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.GetTunneling() == 0 {
+		t.Fatal("client did not fail over to the backup server")
+	}
+}
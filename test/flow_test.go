@@ -0,0 +1,103 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+// setupSlowAndEchoServer 第一个字节为 's' 的连接不再读取数据，其它连接回显数据
+func setupSlowAndEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1)
+				_, err := io.ReadFull(conn, b)
+				if err != nil {
+					return
+				}
+				if b[0] == 's' {
+					time.Sleep(10 * time.Second)
+					return
+				}
+				_, _ = conn.Write(b)
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSlowTaskDoesNotBlockTunnel(t *testing.T) {
+	t.Parallel()
+	l := setupSlowAndEchoServer(t)
+	defer l.Close()
+
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	port := util.RandomPort()
+	s, c, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-tcpRange", port,
+	}, []string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "tcp://" + l.Addr().String(),
+		"-remote", serverAddr,
+		"-remoteTimeout", "5s",
+		"-remoteConnections", "1",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	slow, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	go func() {
+		_, _ = slow.Write([]byte("s"))
+		_, _ = slow.Write(bytes.Repeat([]byte("x"), 16*1024*1024))
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("e" + util.RandomString(64*1024))
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("echo data does not match")
+	}
+}
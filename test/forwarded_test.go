@@ -0,0 +1,140 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+// setupForwardedServer 启动返回访问者地址相关请求头的本地服务
+func setupForwardedServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s|%s|%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"),
+				r.Header.Get("X-Real-IP"), r.Header.Get("Forwarded"))
+		}))
+	}()
+	return l
+}
+
+func TestVisitorAddr(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	httpService := setupForwardedServer(t)
+	defer httpService.Close()
+	echoServer := setupEchoServer(t)
+	defer echoServer.Close()
+
+	addr := net.JoinHostPort("127.0.0.1", util.RandomPort())
+	quicAddr := net.JoinHostPort("localhost", util.RandomPort())
+	port := util.RandomPort()
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-quicAddr", quicAddr,
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-tcpRange", port,
+		"-id", "forwarded-tcp",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "forwarded-quic",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "proxy-protocol",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, args := range [][]string{
+		{"-id", "forwarded-tcp", "-local", "http://" + httpService.Addr().String(), "-localForwardedHeaders", "x-forwarded,forwarded",
+			"-remote", "tcp://" + addr},
+		{"-id", "forwarded-quic", "-local", "http://" + httpService.Addr().String(), "-localForwardedHeaders", "x-forwarded,forwarded",
+			"-remote", "quic://" + quicAddr, "-remoteCert", filepath.Join(dir, "server.crt")},
+		{"-id", "proxy-protocol", "-local", "tcp://" + echoServer.Addr().String(), "-localProxyProtocol", "v1",
+			"-remote", "tcp://" + addr},
+	} {
+		c, err := client.New(append([]string{
+			"client",
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.WaitUntilReady(30 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	httpClient := setupHTTPClient(addr, nil)
+	defer httpClient.CloseIdleConnections()
+	for _, id := range []string{"forwarded-tcp", "forwarded-quic"} {
+		// keep-alive 连接上的每个请求都添加访问者的地址，访问者提供的 X-Forwarded-For 保留在之前
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest(http.MethodGet, "http://"+id+".example.com/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			req.Header.Set("X-Real-IP", "10.0.0.2")
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := "10.0.0.1, 127.0.0.1|http|127.0.0.1|for=127.0.0.1;proto=http"
+			if string(body) != expected {
+				t.Fatalf("%s: %q is not expected %q", id, body, expected)
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\nhello", local.Port, remote.Port)
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("%q is not expected %q", buf, expected)
+	}
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestLocalHealthCheck(t *testing.T) {
+	t.Parallel()
+	var unhealthy uint32
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && atomic.LoadUint32(&unhealthy) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = io.WriteString(w, "ok")
+		}))
+	}()
+
+	page := "<h1>maintenance</h1>"
+	pagePath := filepath.Join(t.TempDir(), "maintenance.html")
+	err = os.WriteFile(pagePath, []byte(page), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	local := "http://" + l.Addr().String()
+	s, c, _ := setupServerAndClient(t, local, []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", id,
+		"-secret", secret,
+		"-unhealthyStatus", "502",
+		"-unhealthyPage", pagePath,
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", local,
+		"-remote", serverAddr,
+		"-localHealthCheckPath", "/healthz",
+		"-localHealthCheckInterval", "100ms",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	httpClient := setupHTTPClient(serverAddr, nil)
+	get := func() (int, string) {
+		req, err := http.NewRequest("GET", "http://"+id+".example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = true
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	waitFor := func(code int, body string) {
+		for i := 0; ; i++ {
+			c, b := get()
+			if c == code && b == body {
+				return
+			}
+			if i > 20 {
+				t.Fatalf("unexpected response %d %q, %d %q is expected", c, b, code, body)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	waitFor(http.StatusOK, "ok")
+	atomic.StoreUint32(&unhealthy, 1)
+	waitFor(http.StatusBadGateway, page)
+	atomic.StoreUint32(&unhealthy, 0)
+	waitFor(http.StatusOK, "ok")
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestCustomHosts(t *testing.T) {
+	t.Parallel()
+	httpServer := setupNamedHTTPServer(t, "custom")
+	defer httpServer.Close()
+
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	usersPath := filepath.Join(t.TempDir(), "users.yaml")
+	err := os.WriteFile(usersPath, []byte(fmt.Sprintf(`%s:
+  secret: %s
+  hosts:
+    - app.customer.com
+    - "*.customer.org"
+`, id, secret)), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, c, _ := setupServerAndClient(t, "http://"+httpServer.Addr().String(), []string{
+		"server",
+		"-addr", serverAddr,
+		"-users", usersPath,
+		"-usersWatch", "0",
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", "http://" + httpServer.Addr().String(),
+		"-remote", serverAddr,
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	httpClient := setupHTTPClient(serverAddr, nil)
+	for _, host := range []string{"app.customer.com", "www.customer.org", id + ".example.com"} {
+		resp, err := httpClient.Get("http://" + host + "/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "custom /path" {
+			t.Fatalf("host %s: unexpected body %q", host, body)
+		}
+	}
+
+	resp, err := httpClient.Get("http://www.customer.com/path")
+	if err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatal("unknown host should not be forwarded")
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// setupH2CServer 启动支持 h2c 的本地服务，与 gRPC 相同，在 trailer 中返回状态
+func setupH2CServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = fmt.Fprintf(w, "%s %s %s", r.Proto, r.URL.Path, body)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	go func() {
+		_ = http.Serve(l, h2c.NewHandler(handler, &http2.Server{}))
+	}()
+	return l
+}
+
+func TestHTTP2(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	h2Service := setupH2CServer(t)
+	defer h2Service.Close()
+	h1Service := setupNamedHTTPServer(t, "h1")
+	defer h1Service.Close()
+
+	addr := net.JoinHostPort("localhost", util.RandomPort())
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-tlsAddr", tlsAddr,
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-http2",
+		"-id", "h2-service",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "h1-service",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, args := range [][]string{
+		{"-id", "h2-service", "-local", "http://" + h2Service.Addr().String(), "-localHTTP2"},
+		{"-id", "h1-service", "-local", "http://" + h1Service.Addr().String()},
+	} {
+		c, err := client.New(append([]string{
+			"client",
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-remote", "tcp://" + addr,
+		}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.WaitUntilReady(30 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer h2cClient.CloseIdleConnections()
+	h2Client := setupHTTPClient(tlsAddr, &tls.Config{InsecureSkipVerify: true})
+	defer h2Client.CloseIdleConnections()
+	h1Client := setupHTTPClient(addr, nil)
+	defer h1Client.CloseIdleConnections()
+
+	check := func(c *http.Client, url, body string, proto int, expected, trailer string) {
+		var r io.Reader
+		method := http.MethodGet
+		if body != "" {
+			r = strings.NewReader(body)
+			method = http.MethodPost
+		}
+		req, err := http.NewRequest(method, url, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if resp.ProtoMajor != proto || resp.StatusCode != http.StatusOK || string(data) != expected {
+			t.Errorf("%s: unexpected response %s %d %q", url, resp.Proto, resp.StatusCode, data)
+			return
+		}
+		if v := resp.Trailer.Get("Grpc-Status"); v != trailer {
+			t.Errorf("%s: unexpected trailer %q", url, v)
+		}
+	}
+
+	// 同一个 HTTP/2 连接上并发的 stream 分别转发给不同的客户端
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/grpc/%d", i)
+			check(h2cClient, "http://h2-service.example.com"+path, "ping", 2, "HTTP/2.0 "+path+" ping", "0")
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/h1/%d", i)
+			check(h2cClient, "http://h1-service.example.com"+path, "", 2, "h1 "+path, "")
+		}(i)
+	}
+	wg.Wait()
+
+	// 通过 ALPN 协商 h2
+	check(h2Client, "https://h2-service.example.com/tls", "pong", 2, "HTTP/2.0 /tls pong", "0")
+	check(h2Client, "https://h1-service.example.com/tls", "", 2, "h1 /tls", "")
+
+	// HTTP/1.1 的请求不受影响
+	check(h1Client, "http://h1-service.example.com/plain", "", 1, "h1 /plain", "")
+	check(h1Client, "http://h2-service.example.com/plain", "data", 1, "HTTP/1.1 /plain data", "0")
+}
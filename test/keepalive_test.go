@@ -0,0 +1,118 @@
+package test
+
+import (
+	stdbufio "bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestKeepAliveRouting(t *testing.T) {
+	t.Parallel()
+	addr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-id", "keepalive-one",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "keepalive-two",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"one", "two"} {
+		l := setupNamedHTTPServer(t, name)
+		defer l.Close()
+		c, err := client.New([]string{
+			"client",
+			"-id", "keepalive-" + name,
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-local", "http://" + l.Addr().String(),
+			"-remote", "tcp://" + addr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.WaitUntilReady(30 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := stdbufio.NewReader(conn)
+	requests := []struct {
+		text string
+		head bool
+		body string
+	}{
+		{text: "GET /a HTTP/1.1\r\nHost: keepalive-one.example.com\r\n\r\n", body: "one /a"},
+		{text: "GET /b HTTP/1.1\r\nhost: keepalive-two.example.com\r\n\r\n", body: "two /b"},
+		{text: "HEAD /c HTTP/1.1\r\nHOST: keepalive-two.example.com\r\n\r\n", head: true},
+		{text: "POST /d HTTP/1.1\r\nHost:\r\n keepalive-one.example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n", body: "one /d"},
+		{text: "GET http://keepalive-two.example.com/e HTTP/1.1\r\nHost: keepalive-one.example.com\r\n\r\n", body: "two /e"},
+		{text: "POST /f HTTP/1.1\r\nHost: keepalive-one.example.com\r\nContent-Length: 3\r\n\r\nabc", body: "one /f"},
+	}
+	// 一次写入所有请求，验证 pipelining 的请求按照各自的 host 转发
+	var pipelined string
+	for _, r := range requests {
+		pipelined += r.text
+	}
+	_, err = io.WriteString(conn, pipelined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(head bool, expected string) {
+		method := http.MethodGet
+		if head {
+			method = http.MethodHead
+		}
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != expected {
+			t.Fatal(&unexpectedResponse{resp.StatusCode, string(body)})
+		}
+	}
+	for _, r := range requests {
+		check(r.head, r.body)
+	}
+
+	// 等待响应之后再发送的请求
+	for _, r := range requests {
+		_, err = io.WriteString(conn, r.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(r.head, r.body)
+	}
+}
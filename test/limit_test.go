@@ -0,0 +1,113 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func setupLimitedServerAndClient(t *testing.T, limits string, local string) (func(), string) {
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	usersPath := filepath.Join(t.TempDir(), "users.yaml")
+	err := os.WriteFile(usersPath, []byte(fmt.Sprintf("%s:\n  secret: %s\n%s", id, secret, limits)), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, c, _ := setupServerAndClient(t, local, []string{
+		"server",
+		"-addr", serverAddr,
+		"-users", usersPath,
+		"-usersWatch", "0",
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", local,
+		"-remote", serverAddr,
+	})
+	return func() {
+		c.Close()
+		s.Close()
+	}, serverAddr
+}
+
+func getStatusCode(t *testing.T, httpClient *http.Client, url string) int {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Close = true
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	t.Parallel()
+	httpServer := setupNamedHTTPServer(t, "limited")
+	defer httpServer.Close()
+	closeFn, serverAddr := setupLimitedServerAndClient(t, "  connectionRate: 1\n", "http://"+httpServer.Addr().String())
+	defer closeFn()
+
+	httpClient := setupHTTPClient(serverAddr, nil)
+	url := "http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/"
+	if code := getStatusCode(t, httpClient, url); code != http.StatusOK {
+		t.Fatal("unexpected status code", code)
+	}
+	if code := getStatusCode(t, httpClient, url); code != http.StatusTooManyRequests {
+		t.Fatal("unexpected status code", code)
+	}
+	time.Sleep(time.Second)
+	if code := getStatusCode(t, httpClient, url); code != http.StatusOK {
+		t.Fatal("unexpected status code", code)
+	}
+}
+
+func TestMaxTasksLimit(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	}()
+	closeFn, serverAddr := setupLimitedServerAndClient(t, "  maxTasks: 1\n", "http://"+l.Addr().String())
+	defer closeFn()
+
+	httpClient := setupHTTPClient(serverAddr, nil)
+	url := "http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/"
+	done := make(chan int, 1)
+	go func() {
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if code := getStatusCode(t, httpClient, url); code != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status code", code)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatal("unexpected status code", code)
+	}
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	httpServer := setupNamedHTTPServer(t, "metrics")
+	defer httpServer.Close()
+
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	apiAddr := net.JoinHostPort("localhost", util.RandomPort())
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	local := "http://" + httpServer.Addr().String()
+	s, c, _ := setupServerAndClient(t, local, []string{
+		"server",
+		"-addr", serverAddr,
+		"-apiAddr", apiAddr,
+		"-id", id,
+		"-secret", secret,
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", local,
+		"-remote", serverAddr,
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	httpClient := setupHTTPClient(serverAddr, nil)
+	resp, err := httpClient.Get("http://" + id + ".example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get("http://" + apiAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(body)
+	for _, line := range []string{
+		"# TYPE gt_connections_accepted_total counter",
+		"gt_tunnels_total 1",
+		`gt_client_tunnels{id="` + id + `"} 1`,
+		`gt_auth_failures_total{reason="invalid_user"} 0`,
+		"gt_tunnel_handshake_seconds_count 1",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("%q not found in metrics:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, `gt_client_bytes_total{id="`+id+`",direction="ingress"} 0`) ||
+		strings.Contains(metrics, `gt_client_bytes_total{id="`+id+`",direction="egress"} 0`) {
+		t.Fatalf("bytes are not counted:\n%s", metrics)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestTunnelClientCert(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	// 自签名的客户端证书同时作为 CA
+	writeCert(t, dir, "client", "mtls-client-1")
+	writeCert(t, dir, "other", "mtls-client-2")
+
+	l := setupNamedHTTPServer(t, "mtls")
+	defer l.Close()
+
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", "",
+		"-tlsAddr", tlsAddr,
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-tunnelClientCA", filepath.Join(dir, "client.crt"),
+		"-timeout", "10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	newClient := func(args ...string) *client.Client {
+		c, err := client.New(append([]string{
+			"client",
+			"-local", "http://" + l.Addr().String(),
+			"-remote", "tls://" + tlsAddr,
+			"-remoteCert", filepath.Join(dir, "server.crt"),
+			"-remoteTimeout", "5s",
+		}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// 证书不是由 CA 签发的
+	c := newClient(
+		"-remoteClientCert", filepath.Join(dir, "other.crt"),
+		"-remoteClientKey", filepath.Join(dir, "other.key"),
+	)
+	if err = c.WaitUntilReady(3 * time.Second); err == nil {
+		t.Fatal("client with an untrusted cert should not be ready")
+	}
+	c.Close()
+
+	// 没有证书
+	c = newClient("-id", "mtls-client-1")
+	if err = c.WaitUntilReady(3 * time.Second); err == nil {
+		t.Fatal("client without cert should not be ready")
+	}
+	c.Close()
+
+	// id 与证书不一致
+	c = newClient(
+		"-id", "mtls-client-2",
+		"-remoteClientCert", filepath.Join(dir, "client.crt"),
+		"-remoteClientKey", filepath.Join(dir, "client.key"),
+	)
+	if err = c.WaitUntilReady(3 * time.Second); err == nil {
+		t.Fatal("client with mismatched id should not be ready")
+	}
+	c.Close()
+
+	// id 来自证书的 CN
+	c = newClient(
+		"-remoteClientCert", filepath.Join(dir, "client.crt"),
+		"-remoteClientKey", filepath.Join(dir, "client.key"),
+	)
+	defer c.Close()
+	err = c.WaitUntilReady(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 访问者不需要提供客户端证书，服务端也不会请求客户端证书
+	var certRequested int32
+	httpClient := setupHTTPClient(tlsAddr, &tls.Config{
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			atomic.StoreInt32(&certRequested, 1)
+			return &tls.Certificate{}, nil
+		},
+	})
+	resp, err := httpClient.Get("https://mtls-client-1.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "mtls /" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if atomic.LoadInt32(&certRequested) == 1 {
+		t.Fatal("visitors should not be asked for client certs")
+	}
+}
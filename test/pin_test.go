@@ -0,0 +1,103 @@
+package test
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func certPin(t *testing.T, file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestRemoteCertPin(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "gt.example.com", "gt.example.com")
+	writeCert(t, dir, "other", "gt.example.com", "gt.example.com")
+	pin := certPin(t, filepath.Join(dir, "server.crt"))
+	otherPin := certPin(t, filepath.Join(dir, "other.crt"))
+
+	port := util.RandomPort()
+	s, err := server.New([]string{
+		"server",
+		"-addr", "",
+		"-tlsAddr", net.JoinHostPort("localhost", port),
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name  string
+		args  []string
+		ready bool
+	}{
+		{"pin", []string{"-remoteCertPin", otherPin, "-remoteCertPin", pin}, true},
+		{"wrong pin", []string{"-remoteCertPin", otherPin}, false},
+		{"pin overrides insecure", []string{"-remoteCertPin", otherPin, "-remoteCertInsecure"}, false},
+		{"server name", []string{
+			"-remoteCert", filepath.Join(dir, "server.crt"),
+			"-remoteServerName", "gt.example.com",
+			"-remoteCertPin", pin,
+		}, true},
+		{"ip without server name", []string{
+			"-remoteCert", filepath.Join(dir, "server.crt"),
+			"-remoteCertPin", pin,
+		}, false},
+	}
+	for _, tt := range tests {
+		c, err := client.New(append([]string{
+			"client",
+			"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-local", "http://www.baidu.com",
+			"-remote", "tls://" + net.JoinHostPort("127.0.0.1", port),
+			"-remoteTimeout", "5s",
+		}, tt.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.WaitUntilReady(3 * time.Second)
+		c.Close()
+		if tt.ready && err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !tt.ready && err == nil {
+			t.Fatalf("%s: client should not be ready", tt.name)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+// pipe 在 a 与 b 之间双向复制数据
+func pipe(a, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	b.Close()
+}
+
+// setupConnectProxy 启动一个需要 Proxy-Authorization 的 HTTP CONNECT 代理，connects 记录建立的隧道数
+func setupConnectProxy(t *testing.T, connects *int32) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				// "user:password"
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNzd29yZA==" {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				atomic.AddInt32(connects, 1)
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				pipe(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+// setupSOCKS5Proxy 启动一个只支持用户名密码认证与 CONNECT 命令的 SOCKS5 代理
+func setupSOCKS5Proxy(t *testing.T, connects *int32) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 256)
+				// 版本与认证方法
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{5, 2})
+				// 用户名密码认证
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				user := make([]byte, buf[1])
+				if _, err := io.ReadFull(conn, user); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+					return
+				}
+				password := make([]byte, buf[0])
+				if _, err := io.ReadFull(conn, password); err != nil {
+					return
+				}
+				if string(user) != "user" || string(password) != "password" {
+					_, _ = conn.Write([]byte{1, 1})
+					return
+				}
+				_, _ = conn.Write([]byte{1, 0})
+				// CONNECT 请求
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+						return
+					}
+					host = net.IP(buf[:4]).String()
+				case 3:
+					if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+						return
+					}
+					n := buf[0]
+					if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+						return
+					}
+					host = string(buf[:n])
+				default:
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				port := binary.BigEndian.Uint16(buf[:2])
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				atomic.AddInt32(connects, 1)
+				_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRemoteProxy(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	l := setupNamedHTTPServer(t, "proxy")
+	defer l.Close()
+	var httpConnects, socksConnects int32
+	httpProxy := setupConnectProxy(t, &httpConnects)
+	defer httpProxy.Close()
+	socksProxy := setupSOCKS5Proxy(t, &socksConnects)
+	defer socksProxy.Close()
+
+	addr := net.JoinHostPort("localhost", util.RandomPort())
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-tlsAddr", tlsAddr,
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-tunnelWebSocketPath", "/tunnel",
+		"-id", "proxy-client-1",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "proxy-client-2",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "proxy-client-3",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "proxy-client-4",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		id     string
+		remote string
+		proxy  string
+	}{
+		{"proxy-client-1", "tcp://" + addr, "http://user:password@" + httpProxy.Addr().String()},
+		{"proxy-client-2", "tls://" + tlsAddr, "socks5://user:password@" + socksProxy.Addr().String()},
+		{"proxy-client-3", "wss://" + tlsAddr + "/tunnel", "http://user:password@" + httpProxy.Addr().String()},
+		{"proxy-client-4", "ws://" + addr + "/tunnel", "socks5://user:password@" + socksProxy.Addr().String()},
+	}
+	for _, tt := range tests {
+		c, err := client.New([]string{
+			"client",
+			"-id", tt.id,
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-local", "http://" + l.Addr().String(),
+			"-remote", tt.remote,
+			"-remoteCert", filepath.Join(dir, "server.crt"),
+			"-remoteProxy", tt.proxy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.WaitUntilReady(30 * time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.id, err)
+		}
+
+		httpClient := setupHTTPClient(addr, nil)
+		resp, err := httpClient.Get("http://" + tt.id + ".example.com/proxy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "proxy /proxy" {
+			t.Fatalf("%s: unexpected response %d %q", tt.id, resp.StatusCode, body)
+		}
+	}
+	if atomic.LoadInt32(&httpConnects) < 2 || atomic.LoadInt32(&socksConnects) < 2 {
+		t.Fatalf("tunnels are not connected through the proxies, http %d, socks5 %d", httpConnects, socksConnects)
+	}
+
+	c, err := client.New([]string{
+		"client",
+		"-id", "proxy-client-1",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + l.Addr().String(),
+		"-remote", "tcp://" + addr,
+		"-remoteProxy", "ftp://" + httpProxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err == nil {
+		c.Close()
+		t.Fatal("ftp:// proxy should be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	httpService := setupForwardedServer(t)
+	defer httpService.Close()
+
+	addr := net.JoinHostPort("127.0.0.1", util.RandomPort())
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-addrProxyProtocol", "require",
+		"-tlsAddr", tlsAddr,
+		"-tlsAddrProxyProtocol", "accept",
+		"-proxyProtocolTrusted", "127.0.0.1",
+		"-proxyProtocolTrusted", "::1",
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-id", "proxy-protocol",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// tlsAddr 的头部是可选的，tunnel 直接连接
+	c, err := client.New([]string{
+		"client",
+		"-id", "proxy-protocol",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + httpService.Addr().String(),
+		"-localForwardedHeaders", "x-forwarded",
+		"-remote", "tls://" + tlsAddr,
+		"-remoteCert", filepath.Join(dir, "server.crt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.WaitUntilReady(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(conn net.Conn) (body string, err error) {
+		req, err := http.NewRequest(http.MethodGet, "http://proxy-protocol.example.com/", nil)
+		if err != nil {
+			return
+		}
+		err = req.Write(conn)
+		if err != nil {
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		body = string(b)
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := get(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "203.0.113.7|http|203.0.113.7|"; body != expected {
+		t.Fatalf("%q is not expected %q", body, expected)
+	}
+
+	// v2 头部在 TLS 握手之前
+	rawConn, err := net.Dial("tcp", tlsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawConn.Close()
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0C")
+	header = append(header, 198, 51, 100, 9, 192, 0, 2, 1, 0xDC, 0x04, 0x01, 0xBB)
+	_, err = rawConn.Write(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(rawConn, &tls.Config{ServerName: "proxy-protocol.example.com", InsecureSkipVerify: true})
+	body, err = get(tlsConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "198.51.100.9|https|198.51.100.9|"; body != expected {
+		t.Fatalf("%q is not expected %q", body, expected)
+	}
+
+	// addr 要求头部，没有头部的连接会被关闭
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = get(conn)
+	if err == nil {
+		t.Fatal("the connection without the PROXY protocol header is not closed")
+	}
+}
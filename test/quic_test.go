@@ -0,0 +1,149 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestQUICTunnel(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	l := setupNamedHTTPServer(t, "quic")
+	defer l.Close()
+	echoServer := setupEchoServer(t)
+	defer echoServer.Close()
+
+	addr := net.JoinHostPort("localhost", util.RandomPort())
+	quicAddr := net.JoinHostPort("localhost", util.RandomPort())
+	port := util.RandomPort()
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-quicAddr", quicAddr,
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-tcpRange", port,
+		"-id", "quic-client-1",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "quic-client-2",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-timeout", "10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var clients []*client.Client
+	for id, local := range map[string]string{
+		"quic-client-1": "http://" + l.Addr().String(),
+		"quic-client-2": "tcp://" + echoServer.Addr().String(),
+	} {
+		c, err := client.New([]string{
+			"client",
+			"-id", id,
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-local", local,
+			"-remote", "quic://" + quicAddr,
+			"-remoteCert", filepath.Join(dir, "server.crt"),
+			// 小于 tunnel 的空闲时间，验证 ping 在 QUIC 上正常工作
+			"-remoteTimeout", "1s",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.WaitUntilReady(30 * time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		clients = append(clients, c)
+	}
+	time.Sleep(3 * time.Second)
+
+	// 并发的 task 使用各自的 stream
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			httpClient := setupHTTPClient(addr, nil)
+			resp, err := httpClient.Get("http://quic-client-1.example.com/quic")
+			if err != nil {
+				errs <- err
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if resp.StatusCode != http.StatusOK || string(body) != "quic /quic" {
+				errs <- &unexpectedResponse{resp.StatusCode, string(body)}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	var tcpPort uint16
+	for _, c := range clients {
+		if p := c.GetTCPPort(); p > 0 {
+			tcpPort = p
+		}
+	}
+	if strconv.FormatUint(uint64(tcpPort), 10) != port {
+		t.Fatalf("tcp port %d is opened, but %s is expected", tcpPort, port)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := []byte(util.RandomString(256 * 1024))
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("echo data does not match")
+	}
+}
+
+type unexpectedResponse struct {
+	code int
+	body string
+}
+
+func (e *unexpectedResponse) Error() string {
+	return "unexpected response " + strconv.Itoa(e.code) + " " + strconv.Quote(e.body)
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestReloadUsers(t *testing.T) {
+	t.Parallel()
+	usersPath := filepath.Join(t.TempDir(), "users.yaml")
+	err := os.WriteFile(usersPath, []byte("id1:\n  secret: secret1\nid2:\n  secret: secret2\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, c1, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-users", usersPath,
+		"-usersWatch", "0",
+	}, []string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", defaultClientLocal,
+		"-remote", serverAddr,
+	})
+	defer s.Close()
+	defer c1.Close()
+	c2, err := client.New([]string{
+		"client",
+		"-id", "id2",
+		"-secret", "secret2",
+		"-local", defaultClientLocal,
+		"-remote", serverAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	err = c2.WaitUntilReady(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed1 := make(chan struct{}, 1)
+	c1.OnTunnelClose.Store(func() {
+		closed1 <- struct{}{}
+	})
+	closed2 := make(chan struct{}, 1)
+	c2.OnTunnelClose.Store(func() {
+		closed2 <- struct{}{}
+	})
+
+	err = os.WriteFile(usersPath, []byte("id1:\n  secret: secret1-rotated\nid2:\n  secret: secret2\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ReloadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed1:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel of the client whose secret was changed should be closed")
+	}
+	select {
+	case <-closed2:
+		t.Fatal("tunnel of the unaffected client should not be closed")
+	case <-time.After(time.Second):
+	}
+}
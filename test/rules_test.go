@@ -0,0 +1,106 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestHTTPRules(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Powered-By", "test")
+			_, _ = fmt.Fprintf(w, "%s %s %s %q", r.Host, r.URL.RequestURI(), r.Header.Get("X-Env"), r.Header.Get("Cookie"))
+		}))
+	}()
+
+	id := "6a3a7bd4-5bba-4a5e-9d43-1b1b6e7c6f2d"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	config := fmt.Sprintf(`services:
+  - local: http://%s
+    useLocalAsHTTPHost: true
+    httpRules:
+      requestHeaders:
+        remove: [Cookie]
+        set:
+          X-Env: prod
+      responseHeaders:
+        remove: [X-Powered-By]
+        add:
+          Access-Control-Allow-Origin: "*"
+          Strict-Transport-Security: max-age=63072000
+      rewritePaths:
+        - prefix: /api/
+          replacement: /v1/
+options:
+  id: %s
+  secret: %s
+  remote: %s
+  remoteTimeout: 5s
+`, l.Addr(), id, secret, serverAddr)
+	configPath := filepath.Join(t.TempDir(), "client.yaml")
+	err = os.WriteFile(configPath, []byte(config), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, c, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", id,
+		"-secret", secret,
+	}, []string{
+		"client",
+		"-config", configPath,
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	// 同一个连接上的每个请求都按照规则改写，HEAD 请求的响应没有 body
+	httpClient := setupHTTPClient(serverAddr, nil)
+	defer httpClient.CloseIdleConnections()
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequest(method, "http://"+id+".example.com/api/users?id=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("X-Env", "dev")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("%s /v1/users?id=1 prod \"\"", l.Addr())
+		if method == http.MethodHead {
+			expected = ""
+		}
+		if string(body) != expected {
+			t.Fatalf("%s: %q is not expected %q", method, body, expected)
+		}
+		if resp.Header.Get("Access-Control-Allow-Origin") != "*" ||
+			resp.Header.Get("Strict-Transport-Security") != "max-age=63072000" ||
+			resp.Header.Get("X-Powered-By") != "" {
+			t.Fatalf("%s: response headers %v are not rewritten", method, resp.Header)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/server/api"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestScaleTunnels(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	}()
+
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	token := "admin-token"
+	usersPath := filepath.Join(t.TempDir(), "users.yaml")
+	err = os.WriteFile(usersPath, []byte(fmt.Sprintf("%s:\n  secret: %s\n  maxTunnels: 3\n", id, secret)), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiAddr := net.JoinHostPort("localhost", util.RandomPort())
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	local := "http://" + l.Addr().String()
+	s, c, _ := setupServerAndClient(t, local, []string{
+		"server",
+		"-addr", serverAddr,
+		"-apiAddr", apiAddr,
+		"-apiAdminToken", token,
+		"-users", usersPath,
+		"-usersWatch", "0",
+	}, []string{
+		"client",
+		"-id", id,
+		"-secret", secret,
+		"-local", local,
+		"-remote", serverAddr,
+		"-reconnectDelay", "1s",
+		"-remoteMaxConnections", "5",
+		"-remoteTasksPerConnection", "1",
+		"-remoteIdleTimeout", "1s",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+
+	tunnels := func() int {
+		req, err := http.NewRequest("GET", "http://"+apiAddr+"/clients/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info api.ClientInfo
+		err = json.NewDecoder(resp.Body).Decode(&info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(info.Tunnels)
+	}
+	waitTunnels := func(want int) {
+		for i := 0; ; i++ {
+			n := tunnels()
+			if n == want {
+				return
+			}
+			if i > 20 {
+				t.Fatalf("%d tunnels, but %d is expected", n, want)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	waitTunnels(1)
+
+	// task 阻塞时增加 tunnel，但不超过服务端的限制
+	httpClient := setupHTTPClient(serverAddr, nil)
+	done := make(chan struct{}, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			resp, err := httpClient.Get("http://" + id + ".example.com/")
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	waitTunnels(3)
+	time.Sleep(2 * time.Second)
+	if n := tunnels(); n != 3 {
+		t.Fatalf("%d tunnels exceed the limit of the server", n)
+	}
+
+	// task 结束后关闭空闲的 tunnel，关闭时分配到 tunnel 上的请求不会失败
+	close(release)
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	stop := make(chan struct{})
+	failures := make(chan error, 1)
+	go func() {
+		defer close(failures)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := httpClient.Get("http://" + id + ".example.com/")
+			if err == nil {
+				_ = resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+				}
+			}
+			if err != nil {
+				failures <- err
+				return
+			}
+		}
+	}()
+	waitTunnels(1)
+	close(stop)
+	if err = <-failures; err != nil {
+		t.Fatal(err)
+	}
+}
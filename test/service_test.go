@@ -0,0 +1,143 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func setupNamedHTTPServer(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+	}()
+	return l
+}
+
+func TestServices(t *testing.T) {
+	t.Parallel()
+	defaultService := setupNamedHTTPServer(t, "default")
+	defer defaultService.Close()
+	pathService := setupNamedHTTPServer(t, "path")
+	defer pathService.Close()
+	headerService := setupNamedHTTPServer(t, "header")
+	defer headerService.Close()
+	subdomainService := setupNamedHTTPServer(t, "subdomain")
+	defer subdomainService.Close()
+	echoServer := setupEchoServer(t)
+	defer echoServer.Close()
+
+	id := "05797ac9-86ae-40b0-b767-7a41e03a5486"
+	secret := "eec1eabf-2c59-4e19-bf10-34707c17ed89"
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	tcpPort := util.RandomPort()
+	config := fmt.Sprintf(`services:
+  - local: http://%s
+  - local: http://%s
+    pathPrefix: /api
+  - local: http://%s
+    headerName: X-Service
+    headerValue: header
+  - local: http://%s
+    subdomain: sub
+  - local: tcp://%s
+    remoteTCPPort: %s
+options:
+  id: %s
+  secret: %s
+  remote: %s
+  remoteTimeout: 5s
+  remoteConnections: 2
+`, defaultService.Addr(), pathService.Addr(), headerService.Addr(), subdomainService.Addr(), echoServer.Addr(), tcpPort, id, secret, serverAddr)
+	configPath := filepath.Join(t.TempDir(), "client.yaml")
+	err := os.WriteFile(configPath, []byte(config), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, c, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", id,
+		"-secret", secret,
+		"-tcpRange", tcpPort,
+	}, []string{
+		"client",
+		"-config", configPath,
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+	if c.GetServicePort(4) == 0 || c.GetTCPPort() != c.GetServicePort(4) {
+		t.Fatalf("invalid tcp port %d", c.GetServicePort(4))
+	}
+
+	httpClient := setupHTTPClient(serverAddr, nil)
+	cases := []struct {
+		host   string
+		path   string
+		header string
+		expect string
+	}{
+		{id + ".example.com", "/", "", "default /"},
+		{id + ".example.com", "/api/users", "", "path /api/users"},
+		{id + ".example.com", "/users", "header", "header /users"},
+		{id + ".example.com", "/users", "other", "default /users"},
+		{"sub." + id + ".example.com", "/users", "", "subdomain /users"},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest("GET", "http://"+tc.host+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 服务按连接路由，每个请求使用新的连接
+		req.Close = true
+		if tc.header != "" {
+			req.Header.Set("X-Service", tc.header)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.expect {
+			t.Fatalf("%s%s is routed to %q, but %q is expected", tc.host, tc.path, body, tc.expect)
+		}
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := []byte(util.RandomString(1024))
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("echo data does not match")
+	}
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func setupEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPForwarding(t *testing.T) {
+	t.Parallel()
+	l := setupEchoServer(t)
+	defer l.Close()
+
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	port := util.RandomPort()
+	s, c, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-tcpRange", port,
+	}, []string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "tcp://" + l.Addr().String(),
+		"-remote", serverAddr,
+		"-remoteTimeout", "5s",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+	if strconv.FormatUint(uint64(c.GetTCPPort()), 10) != port {
+		t.Fatalf("tcp port %d is opened, but %s is expected", c.GetTCPPort(), port)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("SSH-2.0-OpenSSH_8.9\r\n" + util.RandomString(10*1024))
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatal("echo data does not match")
+		}
+		err = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+func setupUDPEchoServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, err = pc.WriteTo(buf[:n], addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return pc
+}
+
+func TestUDPForwarding(t *testing.T) {
+	t.Parallel()
+	pc := setupUDPEchoServer(t)
+	defer pc.Close()
+
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	port := util.RandomPort()
+	s, c, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-udpRange", port,
+		"-udpTimeout", "2s",
+	}, []string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "udp://" + pc.LocalAddr().String(),
+		"-remote", serverAddr,
+		"-remoteTimeout", "5s",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+	if strconv.FormatUint(uint64(c.GetUDPPort()), 10) != port {
+		t.Fatalf("udp port %d is opened, but %s is expected", c.GetUDPPort(), port)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{1, 100, 5000, 20000} {
+			data := []byte(util.RandomString(size))
+			_, err = conn.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 65535)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, buf[:n]) {
+				t.Fatalf("echo packet does not match, %d bytes are expected, but got %d", size, n)
+			}
+		}
+		err = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
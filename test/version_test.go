@@ -0,0 +1,111 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+)
+
+// setupVersion1Server 在 serverAddr 前面模拟只支持 predef.Version1 的服务端，
+// 直接断开 predef.Version2 的握手，rejected 记录断开的握手数
+func setupVersion1Server(t *testing.T, serverAddr string, rejected *int32) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				version := make([]byte, 2)
+				_, err := io.ReadFull(conn, version)
+				if err != nil || version[0] != predef.VersionFirst || version[1] != predef.Version1 {
+					atomic.AddInt32(rejected, 1)
+					conn.Close()
+					return
+				}
+				s, err := net.Dial("tcp", serverAddr)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				_, err = s.Write(version)
+				if err != nil {
+					conn.Close()
+					s.Close()
+					return
+				}
+				pipe(conn, s)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestVersion1Fallback(t *testing.T) {
+	t.Parallel()
+	echo := setupSlowAndEchoServer(t)
+	defer echo.Close()
+
+	serverAddr := net.JoinHostPort("localhost", util.RandomPort())
+	var rejected int32
+	v1 := setupVersion1Server(t, serverAddr, &rejected)
+	defer v1.Close()
+
+	port := util.RandomPort()
+	s, c, _ := setupServerAndClient(t, "", []string{
+		"server",
+		"-addr", serverAddr,
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-tcpRange", port,
+	}, []string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "tcp://" + echo.Addr().String(),
+		"-remote", v1.Addr().String(),
+		"-remoteTimeout", "5s",
+		"-remoteConnections", "1",
+		"-reconnectDelay", "100ms",
+	})
+	defer func() {
+		c.Close()
+		s.Close()
+	}()
+	if atomic.LoadInt32(&rejected) == 0 {
+		t.Fatal("client should try protocol version 2 first")
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 数据量超过 predef.Version2 的流量控制窗口，没有窗口更新时也不会阻塞
+	data := []byte("e" + util.RandomString(4*1024*1024))
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("echo data does not match")
+	}
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/client"
+	"github.com/isrc-cas/gt/server"
+	"github.com/isrc-cas/gt/util"
+)
+
+func TestWebSocketTunnel(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "localhost", "localhost")
+	l := setupNamedHTTPServer(t, "ws")
+	defer l.Close()
+
+	addr := net.JoinHostPort("localhost", util.RandomPort())
+	tlsAddr := net.JoinHostPort("localhost", util.RandomPort())
+	s, err := server.New([]string{
+		"server",
+		"-addr", addr,
+		"-tlsAddr", tlsAddr,
+		"-certFile", filepath.Join(dir, "server.crt"),
+		"-keyFile", filepath.Join(dir, "server.key"),
+		"-tunnelWebSocketPath", "/tunnel",
+		"-id", "ws-client-1",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "ws-client-2",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-timeout", "10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for id, remote := range map[string]string{
+		"ws-client-1": "ws://" + addr + "/tunnel",
+		"ws-client-2": "wss://" + tlsAddr + "/tunnel?token=1",
+	} {
+		c, err := client.New([]string{
+			"client",
+			"-id", id,
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-local", "http://" + l.Addr().String(),
+			"-remote", remote,
+			"-remoteCert", filepath.Join(dir, "server.crt"),
+			// 小于 tunnel 的空闲时间，验证 ping 在 WebSocket 上正常工作
+			"-remoteTimeout", "1s",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.WaitUntilReady(30 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	for _, target := range []struct {
+		addr string
+		url  string
+	}{
+		{addr, "http://ws-client-1.example.com/ws"},
+		{addr, "http://ws-client-2.example.com/ws"},
+		{tlsAddr, "https://ws-client-1.example.com/ws"},
+	} {
+		httpClient := setupHTTPClient(target.addr, &tls.Config{InsecureSkipVerify: true})
+		resp, err := httpClient.Get(target.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "ws /ws" {
+			t.Fatalf("%s: unexpected response %d %q", target.url, resp.StatusCode, body)
+		}
+	}
+}